@@ -0,0 +1,188 @@
+// Command payments-dlq inspects and redrives the messages of the payments Dead Letter Queue
+//
+// Usage:
+//
+//	payments-dlq list [-provider name] [-class class] [-error text] [-id ids] [-json]
+//	payments-dlq show <message-id>
+//	payments-dlq redrive (-all | [-provider name] [-class class] [-error text] [-id ids]) [-dry-run] [-release-idempotency]
+//
+// The queues are read from the SQS_QUEUE_URL and SQS_DLQ_QUEUE_URL environment variables, or from the -queue and
+// -dlq flags. The -release-idempotency flag removes the idempotency records of the redriven critical messages from
+// the IDEMPOTENCY_DYNAMODB_TABLE table, or from the -table flag
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/dlq"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/idempotency"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/pkg/errors"
+)
+
+const usage = `Usage:
+  payments-dlq list [-provider name] [-class class] [-error text] [-id ids] [-json]
+  payments-dlq show <message-id>
+  payments-dlq redrive (-all | [-provider name] [-class class] [-error text] [-id ids]) [-dry-run] [-release-idempotency]
+
+Run "payments-dlq <command> -h" to see the flags of a command.
+`
+
+// Errors
+var (
+	ErrUsage            = errors.New("invalid usage")
+	ErrRedriveSelection = errors.New("select the messages to redrive with -id, -provider, -class or -error, or use -all")
+	ErrIdempotencyTable = errors.New("the idempotency table is required to release the records, set IDEMPOTENCY_DYNAMODB_TABLE or -table")
+)
+
+func main() {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	if err := run(context.Background(), os.Args[1:], os.Stdout, sqs.New(sess), dynamodb.New(sess)); err != nil {
+		if err == ErrUsage {
+			fmt.Fprint(os.Stderr, usage)
+		} else if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run runs the command of the arguments, writing the result to out
+func run(ctx context.Context, args []string, out io.Writer, s message.SQSManager, db idempotency.DynamoDBManager) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+
+	c := &config.Config{}
+	f := dlq.Filter{}
+	var ids string
+	var asJSON, all, dryRun, releaseIdempotency bool
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&c.SqsQueueURL, "queue", os.Getenv("SQS_QUEUE_URL"), "the main queue URL")
+	fs.StringVar(&c.SqsDLQQueueURL, "dlq", os.Getenv("SQS_DLQ_QUEUE_URL"), "the Dead Letter Queue URL")
+
+	switch args[0] {
+	case "list", "redrive":
+		fs.StringVar(&f.Provider, "provider", "", "only the messages of the provider")
+		fs.StringVar(&f.ErrorClass, "class", "", "only the messages of the error class (critical, validation, exhausted or undecodable)")
+		fs.StringVar(&f.Error, "error", "", "only the messages with an error containing the text")
+		fs.StringVar(&ids, "id", "", "only the messages with the comma separated DLQ or original message ids")
+	case "show":
+	default:
+		return ErrUsage
+	}
+	switch args[0] {
+	case "list":
+		fs.BoolVar(&asJSON, "json", false, "print the messages as JSON")
+	case "redrive":
+		fs.BoolVar(&all, "all", false, "redrive all the messages")
+		fs.BoolVar(&dryRun, "dry-run", false, "only print the messages that would be redriven")
+		fs.BoolVar(&releaseIdempotency, "release-idempotency", false, "remove the idempotency records of the critical messages, only after checking with the provider that the payments weren't processed")
+		fs.StringVar(&c.IdempotencyDynamoDBTable, "table", os.Getenv("IDEMPOTENCY_DYNAMODB_TABLE"), "the DynamoDB table of the idempotency records")
+	}
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if c.SqsDLQQueueURL == "" {
+		return errors.New("the DLQ URL is required, set SQS_DLQ_QUEUE_URL or -dlq")
+	}
+	if ids != "" {
+		f.IDs = strings.Split(ids, ",")
+	}
+
+	manager := dlq.NewManager(c, s)
+	switch args[0] {
+	case "list":
+		messages, err := manager.List(ctx, f)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(out, messages)
+		}
+		return printList(out, messages)
+	case "show":
+		if fs.NArg() != 1 {
+			return ErrUsage
+		}
+		m, err := manager.Get(ctx, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		return printJSON(out, m)
+	default:
+		if !all && f.IDs == nil && f.Provider == "" && f.ErrorClass == "" && f.Error == "" {
+			return ErrRedriveSelection
+		}
+		if c.SqsQueueURL == "" && !dryRun {
+			return errors.New("the main queue URL is required, set SQS_QUEUE_URL or -queue")
+		}
+		if releaseIdempotency && !dryRun {
+			if c.IdempotencyDynamoDBTable == "" {
+				return ErrIdempotencyTable
+			}
+			manager.ReleaseIdempotency(idempotency.NewDynamoDBStore(c, db))
+		}
+		messages, err := manager.Redrive(ctx, f, dryRun)
+		printRedrive(out, messages, dryRun)
+		return err
+	}
+}
+
+// printList prints the messages as a table, one message per line
+func printList(out io.Writer, messages []dlq.Message) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tORIGINAL ID\tPROVIDER\tCLASS\tRECEIVES\tMOVED AT\tERROR")
+	for _, m := range messages {
+		movedAt := ""
+		if !m.MovedAt.IsZero() {
+			movedAt = m.MovedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", m.ID, m.OriginalID, m.Provider, m.ErrorClass, m.ReceiveCount, movedAt, m.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "%d message(s)\n", len(messages))
+	return err
+}
+
+// printRedrive prints the redriven messages
+func printRedrive(out io.Writer, messages []dlq.Message, dryRun bool) {
+	action := "redriven"
+	if dryRun {
+		action = "would be redriven"
+	}
+	for _, m := range messages {
+		fmt.Fprintf(out, "%s %s\n", m.ID, action)
+	}
+	fmt.Fprintf(out, "%d message(s) %s\n", len(messages), action)
+}
+
+// printJSON prints the value as indented JSON
+func printJSON(out io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(b))
+	return err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/idempotency"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRun(t *testing.T) {
+	dlqMessage := &sqs.Message{
+		MessageId:     aws.String("dlq-1"),
+		ReceiptHandle: aws.String("receipt-1"),
+		Body:          aws.String(`{"provider":"Example","order":{"id":"order-1"}}`),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			message.AttributeError:      {DataType: aws.String("String"), StringValue: aws.String("test")},
+			message.AttributeErrorClass: {DataType: aws.String("String"), StringValue: aws.String("critical")},
+			message.AttributeProvider:   {DataType: aws.String("String"), StringValue: aws.String("Example")},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		args         []string
+		wantOut      string
+		wantSent     int
+		wantReleased int
+		wantError    error
+	}{
+		{
+			name:      "no command",
+			wantError: ErrUsage,
+		},
+		{
+			name:      "unknown command",
+			args:      []string{"purge", "-dlq", "http://sqs.dlq.host/"},
+			wantError: ErrUsage,
+		},
+		{
+			name: "list",
+			args: []string{"list", "-dlq", "http://sqs.dlq.host/", "-provider", "Example"},
+			wantOut: "ID     ORIGINAL ID  PROVIDER  CLASS     RECEIVES  MOVED AT  ERROR\n" +
+				"dlq-1               Example   critical  0                   test\n" +
+				"1 message(s)\n",
+		},
+		{
+			name:      "show without id",
+			args:      []string{"show", "-dlq", "http://sqs.dlq.host/"},
+			wantError: ErrUsage,
+		},
+		{
+			name:      "redrive without selection",
+			args:      []string{"redrive", "-dlq", "http://sqs.dlq.host/", "-queue", "http://sqs.host/"},
+			wantError: ErrRedriveSelection,
+		},
+		{
+			name:    "redrive dry run",
+			args:    []string{"redrive", "-dlq", "http://sqs.dlq.host/", "-class", "critical", "-dry-run"},
+			wantOut: "dlq-1 would be redriven\n1 message(s) would be redriven\n",
+		},
+		{
+			name:     "redrive all",
+			args:     []string{"redrive", "-dlq", "http://sqs.dlq.host/", "-queue", "http://sqs.host/", "-all"},
+			wantOut:  "dlq-1 redriven\n1 message(s) redriven\n",
+			wantSent: 1,
+		},
+		{
+			name:         "redrive releasing the idempotency records",
+			args:         []string{"redrive", "-dlq", "http://sqs.dlq.host/", "-queue", "http://sqs.host/", "-all", "-release-idempotency", "-table", "payments"},
+			wantOut:      "dlq-1 redriven\n1 message(s) redriven\n",
+			wantSent:     1,
+			wantReleased: 1,
+		},
+		{
+			name:      "redrive releasing the idempotency records without table",
+			args:      []string{"redrive", "-dlq", "http://sqs.dlq.host/", "-queue", "http://sqs.host/", "-all", "-release-idempotency"},
+			wantError: ErrIdempotencyTable,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockSQS := new(message.MockSQS)
+			mockSQS.On("ReceiveMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.ReceiveMessageInput")).
+				Return(&sqs.ReceiveMessageOutput{Messages: []*sqs.Message{dlqMessage}}, nil).Once()
+			mockSQS.On("ReceiveMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.ReceiveMessageInput")).
+				Return(&sqs.ReceiveMessageOutput{}, nil)
+			mockSQS.On("ChangeMessageVisibilityWithContext", mock.Anything, mock.Anything).Return(nil, nil)
+			mockSQS.On("SendMessageWithContext", mock.Anything, mock.Anything).Return(nil, nil)
+			mockSQS.On("DeleteMessageWithContext", mock.Anything, mock.Anything).Return(nil, nil)
+
+			mockDynamoDB := new(idempotency.MockDynamoDB)
+			mockDynamoDB.On("DeleteItemWithContext", mock.Anything, mock.AnythingOfType("*dynamodb.DeleteItemInput")).
+				Return(&dynamodb.DeleteItemOutput{}, nil)
+
+			out := &bytes.Buffer{}
+			err := run(context.TODO(), tc.args, out, mockSQS, mockDynamoDB)
+
+			assert.Equal(t, tc.wantError, err)
+			assert.Equal(t, tc.wantOut, out.String())
+			mockSQS.AssertNumberOfCalls(t, "SendMessageWithContext", tc.wantSent)
+			mockDynamoDB.AssertNumberOfCalls(t, "DeleteItemWithContext", tc.wantReleased)
+		})
+	}
+}
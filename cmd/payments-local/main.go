@@ -0,0 +1,232 @@
+// Command payments-local runs the payments handler on a local queue, without Lambda and SQS
+//
+// Usage:
+//
+//	payments-local [-input file] [-dir directory] [-timeout duration]
+//	payments-local -explain [-input file]
+//
+// Each line of the input (a JSON lines file, or the standard input with "-") is the body of a message sent to the
+// local queue before the handler runs. The queue is kept in memory, or in the JSON lines files of -dir, where the
+// messages left for a new attempt and the DLQ stay for the next runs. The handler response is printed as JSON
+//
+// With -explain nothing is processed, it prints how the provider of each input message is chosen by the routing rules
+// of PROVIDER_ROUTING_RULES
+//
+// The configuration is read from the same environment variables of the Lambda function, the SQS URLs are optional
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/handler"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/idempotency"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/logger"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/validation"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Errors
+var (
+	ErrDynamoDBStore = errors.New("the dynamodb idempotency store needs AWS, use the memory or file store")
+	ErrNoRouter      = errors.New("the providers don't explain the routing")
+)
+
+// explanation represents the routing decision of an input message
+type explanation struct {
+	Line     int                `json:"line"`
+	Decision *provider.Decision `json:"decision,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+func main() {
+	// The local queue replaces SQS, the URLs only name the queues
+	setDefaultEnv("SQS_QUEUE_URL", "local://payments")
+	setDefaultEnv("SQS_DLQ_QUEUE_URL", "local://payments-dlq")
+	setDefaultEnv("IDEMPOTENCY_STORE", idempotency.StoreMemory)
+
+	c, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "cannot load config"))
+		os.Exit(1)
+	}
+	l := logger.NewLogger(c)
+	providers, err := provider.NewRouterFromConfig(c, provider.NewBreakers(c, l, provider.NewLimiters(c, l, provider.NewProviders(c))))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, c, l, providers); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run sends the input messages to the local queue and runs the handler, writing the response to out
+func run(
+	ctx context.Context,
+	args []string,
+	in io.Reader,
+	out io.Writer,
+	c *config.Config,
+	l *log.Logger,
+	p provider.ProcessorList,
+) error {
+	var input, dir string
+	var timeout time.Duration
+	var explain bool
+
+	fs := flag.NewFlagSet("payments-local", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&input, "input", "", `the JSON lines file with a message body per line, "-" reads the standard input`)
+	fs.StringVar(&dir, "dir", "", "the directory that keeps the queue and the DLQ between runs, in memory when it's empty")
+	fs.DurationVar(&timeout, "timeout", 0, "the invocation timeout, the handler stops receiving messages HANDLER_DEADLINE_MARGIN before it")
+	fs.BoolVar(&explain, "explain", false, "only print how the provider of each input message is chosen by the routing rules")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if explain {
+		e, ok := p.(provider.Explainer)
+		if !ok {
+			return ErrNoRouter
+		}
+		r := in
+		if input != "" && input != "-" {
+			f, err := os.Open(input)
+			if err != nil {
+				return errors.Wrap(err, "failed to open the input")
+			}
+			defer f.Close()
+			r = f
+		}
+		explanations, err := explainLines(c, e, r)
+		if err != nil {
+			return err
+		}
+		return printJSON(out, explanations)
+	}
+
+	var adapter *message.LocalAdapter
+	if dir != "" {
+		adapter = message.NewFileAdapter(c, dir)
+	} else {
+		adapter = message.NewMemoryAdapter(c)
+	}
+
+	switch input {
+	case "":
+	case "-":
+		if err := sendLines(ctx, adapter, in); err != nil {
+			return err
+		}
+	default:
+		f, err := os.Open(input)
+		if err != nil {
+			return errors.Wrap(err, "failed to open the input")
+		}
+		defer f.Close()
+		if err := sendLines(ctx, adapter, f); err != nil {
+			return err
+		}
+	}
+
+	var store idempotency.Store
+	switch c.IdempotencyStore {
+	case idempotency.StoreDynamoDB:
+		return ErrDynamoDBStore
+	case idempotency.StoreFile:
+		store = idempotency.NewFileStore(c.IdempotencyFilePath)
+	default:
+		store = idempotency.NewMemoryStore()
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	h := handler.NewHandler(c, l, p, adapter, validation.NewOrderValidator(c), store)
+	resp, err := h.Handler(ctx, handler.Event{})
+	if perr := printJSON(out, resp); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// sendLines sends each non empty line of the input to the queue as a message body
+func sendLines(ctx context.Context, adapter *message.LocalAdapter, in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	// A line has a whole message, up to the payload limit of SQS
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), message.MaxBatchPayload+1)
+	for scanner.Scan() {
+		body := strings.TrimSpace(scanner.Text())
+		if body == "" {
+			continue
+		}
+		if _, err := adapter.Send(ctx, body, nil); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "failed to read the input")
+	}
+	return nil
+}
+
+// explainLines explains the routing of each non empty line of the input
+func explainLines(c *config.Config, e provider.Explainer, in io.Reader) ([]explanation, error) {
+	codec := message.NewCodec(c)
+	explanations := []explanation{}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), message.MaxBatchPayload+1)
+	for n := 1; scanner.Scan(); n++ {
+		body := strings.TrimSpace(scanner.Text())
+		if body == "" {
+			continue
+		}
+		m, err := codec.Decode([]byte(body))
+		if err != nil {
+			explanations = append(explanations, explanation{Line: n, Error: err.Error()})
+			continue
+		}
+		d := e.Explain(m)
+		explanations = append(explanations, explanation{Line: n, Decision: &d})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read the input")
+	}
+	return explanations, nil
+}
+
+// setDefaultEnv sets an environment variable that is not set
+func setDefaultEnv(key, value string) {
+	if _, ok := os.LookupEnv(key); !ok {
+		_ = os.Setenv(key, value)
+	}
+}
+
+// printJSON prints the value as indented JSON
+func printJSON(out io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(b))
+	return err
+}
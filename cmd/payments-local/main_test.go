@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/handler"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// validBody returns the body of a valid message of the order
+func validBody(t *testing.T, orderID string) string {
+	address := message.Address{
+		FirstName: "John",
+		LastName:  "Doe",
+		Street:    "Main Street",
+		Number:    "1",
+		ZipCode:   "90000-000",
+		City:      "Porto Alegre",
+		State:     "RS",
+		Country:   "BR",
+	}
+	b, err := json.Marshal(message.Message{
+		Provider: "Example",
+		Order: message.Order{
+			Id:             orderID,
+			PaymentMethod:  "credit_card",
+			ShippingAmount: message.NewMoney(1000, "BRL"),
+			Total:          message.NewMoney(7050, "BRL"),
+			OrderItem: []message.OrderItem{
+				{Id: "item-1", Name: "Book", UnitPrice: message.NewMoney(6050, "BRL")},
+			},
+			Customer: message.Customer{
+				Id:        "customer-1",
+				FirstName: "John",
+				LastName:  "Doe",
+				Email:     "john@doe.com",
+			},
+			BillingAddress:  address,
+			ShippingAddress: address,
+		},
+	})
+	assert.Nil(t, err)
+	return string(b)
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "payments-local")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	inputFile := filepath.Join(dir, "messages.jsonl")
+	assert.Nil(t, ioutil.WriteFile(inputFile, []byte(validBody(t, "order-1")+"\n\n"+validBody(t, "order-2")+"\n"), 0600))
+
+	approved := provider.ProcessResult{TransactionID: "tx-1", Status: provider.PaymentStatusApproved}
+
+	tests := []struct {
+		name            string
+		args            []string
+		in              string
+		idempotency     string
+		wantStatuses    map[string]int
+		wantQuarantined int
+		wantError       bool
+	}{
+		{
+			name:         "no input",
+			wantStatuses: map[string]int{},
+		},
+		{
+			name:            "messages from the standard input",
+			args:            []string{"-input", "-"},
+			in:              validBody(t, "order-1") + "\n" + `{"provider":"Example"}` + "\nthis is not a valid json body\n",
+			wantStatuses:    map[string]int{handler.MessageStatusSuccess: 1, handler.MessageStatusInvalid: 1},
+			wantQuarantined: 1,
+		},
+		{
+			name:         "messages from a file kept in a directory",
+			args:         []string{"-input", inputFile, "-dir", filepath.Join(dir, "queue")},
+			wantStatuses: map[string]int{handler.MessageStatusSuccess: 2},
+		},
+		{
+			name:      "missing input file",
+			args:      []string{"-input", filepath.Join(dir, "missing.jsonl")},
+			wantError: true,
+		},
+		{
+			name:        "dynamodb idempotency store",
+			idempotency: "dynamodb",
+			wantError:   true,
+		},
+		{
+			name:      "invalid flag",
+			args:      []string{"-unknown"},
+			wantError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l := log.New()
+			l.Out = ioutil.Discard
+
+			providerMock := new(provider.MockProvider)
+			providerMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).Return(approved, nil)
+			providersMock := new(provider.MockProviderList)
+			providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerMock)
+
+			c := &config.Config{
+				HandlerConcurrency:      2,
+				SqsMaxNumberOfMessages:  10,
+				SupportedPaymentMethods: []string{"credit_card"},
+				IdempotencyStore:        tc.idempotency,
+			}
+			out := &bytes.Buffer{}
+			err := run(context.TODO(), tc.args, strings.NewReader(tc.in), out, c, l, providersMock)
+
+			if tc.wantError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			var resp handler.Response
+			assert.Nil(t, json.Unmarshal(out.Bytes(), &resp))
+			statuses := make(map[string]int)
+			for _, mr := range resp.Messages {
+				statuses[mr.Status]++
+			}
+			assert.Equal(t, tc.wantStatuses, statuses)
+			assert.Len(t, resp.Quarantined, tc.wantQuarantined)
+		})
+	}
+}
+
+func TestRun_Dir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "payments-local")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	l := log.New()
+	l.Out = ioutil.Discard
+	providersMock := new(provider.MockProviderList)
+	c := &config.Config{HandlerConcurrency: 1, SqsMaxNumberOfMessages: 10, SupportedPaymentMethods: []string{"credit_card"}}
+
+	// The invalid message is moved to the DLQ kept in the directory
+	err = run(context.TODO(), []string{"-input", "-", "-dir", dir}, strings.NewReader(`{"provider":"Example"}`), ioutil.Discard, c, l, providersMock)
+	assert.Nil(t, err)
+
+	deadLetters, err := message.NewFileAdapter(c, dir).DeadLetters(context.TODO())
+	assert.Nil(t, err)
+	if assert.Len(t, deadLetters, 1) {
+		assert.Equal(t, message.ErrorClassValidation, deadLetters[0].Attributes[message.AttributeErrorClass])
+	}
+}
+
+func TestRun_Explain(t *testing.T) {
+	l := log.New()
+	l.Out = ioutil.Discard
+	c := &config.Config{}
+	router, err := provider.NewRouter(provider.Providers{"Example": new(provider.MockProvider)}, provider.Rules{
+		Rules: []provider.Rule{
+			{Name: "pix", Provider: "Example", Match: provider.Match{PaymentMethods: []string{"pix"}}},
+		},
+	})
+	assert.Nil(t, err)
+
+	in := `{"provider":"auto","order":{"payment_method":"pix"}}` + "\n" +
+		`{"provider":"auto","order":{"payment_method":"boleto"}}` + "\n" +
+		"this is not a valid json body\n"
+	out := &bytes.Buffer{}
+	err = run(context.TODO(), []string{"-explain", "-input", "-"}, strings.NewReader(in), out, c, l, router)
+
+	assert.Nil(t, err)
+	var explanations []explanation
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &explanations))
+	if assert.Len(t, explanations, 3) {
+		assert.Equal(t, &provider.Decision{Provider: "Example", Rule: "pix"}, explanations[0].Decision)
+		assert.Equal(t, &provider.Decision{
+			Skipped: []provider.SkippedRule{{Rule: "pix", Reason: `payment method "boleto" is not one of pix`}},
+		}, explanations[1].Decision)
+		assert.Equal(t, 3, explanations[2].Line)
+		assert.Contains(t, explanations[2].Error, "failed to decode the message (malformed)")
+	}
+
+	// The providers without routing rules can't explain
+	err = run(context.TODO(), []string{"-explain"}, strings.NewReader(in), out, c, l, new(provider.MockProviderList))
+	assert.Equal(t, ErrNoRouter, err)
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/handler"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/idempotency"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/logger"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/validation"
 )
 
 func main() {
@@ -21,8 +24,12 @@ func main() {
 	l.Info("application started successfully")
 	l.WithField("config", c).Info("loaded config")
 
-	// Create a list with all available providers
-	providers := provider.NewProviders(c)
+	// Create a list with all available providers behind their rate limiters and circuit breakers, the messages without
+	// a provider are routed by the rules
+	providers, err := provider.NewRouterFromConfig(c, provider.NewBreakers(c, l, provider.NewLimiters(c, l, provider.NewProviders(c))))
+	if err != nil {
+		l.WithError(err).Panic("cannot load the routing rules")
+	}
 	l.WithField("providers", providers.GetNames()).Info("providers list")
 
 	// Create a new SQS adapter
@@ -31,8 +38,38 @@ func main() {
 	}))
 	adapter := message.NewSQSAdapter(c, sqs.New(sess))
 
+	// Create a new validator to check the messages before they reach the providers
+	validator := validation.NewOrderValidator(c)
+
+	// Create the idempotency store to not charge the same order twice, a message can be delivered again to any Lambda
+	// container so only the dynamodb store is shared by all of them
+	// Without the table the function only refuses to start when IDEMPOTENCY_REQUIRED is set, otherwise it keeps running
+	// with a store of its own container until the table is provisioned (see make dynamodb_create_table)
+	var store idempotency.Store
+	switch {
+	case c.IdempotencyStore == idempotency.StoreDynamoDB && c.IdempotencyDynamoDBTable != "":
+		store = idempotency.NewDynamoDBStore(c, dynamodb.New(sess))
+	case c.IdempotencyRequired:
+		l.WithField("store", c.IdempotencyStore).
+			Panic("the idempotency store must be dynamodb with IDEMPOTENCY_DYNAMODB_TABLE when IDEMPOTENCY_REQUIRED is set")
+	default:
+		l.WithField("store", c.IdempotencyStore).
+			Warn("the idempotency store isn't shared by the Lambda containers, a payment delivered again to another container may be charged twice, set IDEMPOTENCY_DYNAMODB_TABLE")
+		if c.IdempotencyStore == idempotency.StoreFile {
+			store = idempotency.NewFileStore(c.IdempotencyFilePath)
+		} else {
+			store = idempotency.NewMemoryStore()
+		}
+	}
+
 	// Create a new handler to handle the Lambda invocation
-	h := handler.NewHandler(l, providers, adapter)
+	h := handler.NewHandler(c, l, providers, adapter, validator, store)
 
-	lambda.Start(h.Handler)
+	// Pick the entry point: pull the messages from SQS or receive them from the SQS event source
+	switch c.HandlerMode {
+	case config.HandlerModeEvent:
+		lambda.Start(h.SQSHandler)
+	default:
+		lambda.Start(h.Handler)
+	}
 }
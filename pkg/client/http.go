@@ -3,6 +3,10 @@ package client
 import (
 	"errors"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/trace"
 )
 
 // List of errors
@@ -11,6 +15,7 @@ var (
 )
 
 // HttpCaller representation of the client call
+// The context of the call is the request context (see http.Request.WithContext)
 type HttpCaller interface {
 	Do(r *http.Request) (*http.Response, error)
 }
@@ -27,7 +32,16 @@ func NewHttpClient(c HttpCaller) *HttpClient {
 
 // Do Perform a request returning the response this wrapper was creating for testing purposes and to have
 // an easier way to switch from the native client in case needed
+// The request id and the trace id of the request context are propagated as headers
 func (c HttpClient) Do(r *http.Request) (*http.Response, error) {
+	ctx := r.Context()
+	if id := trace.RequestID(ctx); id != "" && r.Header.Get(trace.HeaderRequestID) == "" {
+		r.Header.Set(trace.HeaderRequestID, id)
+	}
+	if id := trace.TraceID(ctx); id != "" && r.Header.Get(trace.HeaderTraceID) == "" {
+		r.Header.Set(trace.HeaderTraceID, id)
+	}
+
 	res, err := c.client.Do(r)
 
 	if err != nil {
@@ -40,3 +54,22 @@ func (c HttpClient) Do(r *http.Request) (*http.Response, error) {
 
 	return res, nil
 }
+
+// RetryAfter returns how long to wait before a new request from the Retry-After header of the response, in seconds
+// or as an HTTP date, zero when the header is missing or invalid
+func RetryAfter(res *http.Response, now time.Time) time.Duration {
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s < 0 {
+			return 0
+		}
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -2,12 +2,15 @@ package client_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/fredw/igti-aws-lambda-payments/pkg/client"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/trace"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -61,3 +64,64 @@ func TestDo(t *testing.T) {
 		})
 	}
 }
+
+func TestDoPropagatesTraceHeaders(t *testing.T) {
+	ctx := trace.WithTraceID(trace.WithRequestID(context.Background(), "request-1"), "trace-1")
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(ctx)
+
+	mock := new(client.MockHTTPClient)
+	mock.On("Do", req).Return(&http.Response{Body: ioutil.NopCloser(bytes.NewBufferString(""))}, nil)
+
+	_, err := client.NewHttpClient(mock).Do(req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "request-1", req.Header.Get(trace.HeaderRequestID))
+	assert.Equal(t, "trace-1", req.Header.Get(trace.HeaderTraceID))
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{
+			name: "without header",
+		},
+		{
+			name:   "in seconds",
+			header: "120",
+			want:   2 * time.Minute,
+		},
+		{
+			name:   "negative seconds",
+			header: "-1",
+		},
+		{
+			name:   "as an HTTP date",
+			header: "Wed, 01 Jan 2020 10:00:30 GMT",
+			want:   30 * time.Second,
+		},
+		{
+			name:   "as a past HTTP date",
+			header: "Wed, 01 Jan 2020 09:00:00 GMT",
+		},
+		{
+			name:   "invalid",
+			header: "soon",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := &http.Response{Header: http.Header{}}
+			if tc.header != "" {
+				res.Header.Set("Retry-After", tc.header)
+			}
+			assert.Equal(t, tc.want, client.RetryAfter(res, now))
+		})
+	}
+}
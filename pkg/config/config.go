@@ -1,16 +1,53 @@
 package config
 
 import (
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 )
 
+// Handler modes
+const (
+	HandlerModePull  = "pull"
+	HandlerModeEvent = "event"
+)
+
 // Config represents common application parameters
 type Config struct {
-	LogLevel                  string `envconfig:"LOG_LEVEL" default:"INFO"`
-	SqsQueueURL               string `envconfig:"SQS_QUEUE_URL" required:"true"`
-	SqsDLQQueueURL            string `envconfig:"SQS_DLQ_QUEUE_URL" required:"true"`
-	SqsMaxNumberOfMessages    int64  `envconfig:"SQS_MAX_NUMBER_OF_MESSAGES" default:"1"`
-	ProviderExampleRequestURI string `envconfig:"PROVIDER_EXAMPLE_REQUEST_URI" required:"true"`
+	LogLevel                    string             `envconfig:"LOG_LEVEL" default:"INFO"`
+	MetricsNamespace            string             `envconfig:"METRICS_NAMESPACE" default:"Payments"`
+	HandlerMode                 string             `envconfig:"HANDLER_MODE" default:"pull"`
+	HandlerConcurrency          int                `envconfig:"HANDLER_CONCURRENCY" default:"10"`
+	ProviderConcurrency         map[string]int     `envconfig:"PROVIDER_CONCURRENCY"`
+	HandlerDeadlineMargin       time.Duration      `envconfig:"HANDLER_DEADLINE_MARGIN" default:"60s"`
+	HandlerMaxBatches           int                `envconfig:"HANDLER_MAX_BATCHES" default:"0"`
+	MaxAttempts                 int                `envconfig:"MAX_ATTEMPTS" default:"5"`
+	RetryBackoffBase            time.Duration      `envconfig:"RETRY_BACKOFF_BASE" default:"10s"`
+	RetryBackoffMax             time.Duration      `envconfig:"RETRY_BACKOFF_MAX" default:"15m"`
+	VisibilityHeartbeatInterval time.Duration      `envconfig:"VISIBILITY_HEARTBEAT_INTERVAL" default:"20s"`
+	VisibilityHeartbeatMax      time.Duration      `envconfig:"VISIBILITY_HEARTBEAT_MAX" default:"15m"`
+	SqsQueueURL                 string             `envconfig:"SQS_QUEUE_URL" required:"true"`
+	SqsDLQQueueURL              string             `envconfig:"SQS_DLQ_QUEUE_URL" required:"true"`
+	SqsMaxNumberOfMessages      int64              `envconfig:"SQS_MAX_NUMBER_OF_MESSAGES" default:"1"`
+	SqsWaitTimeSeconds          int64              `envconfig:"SQS_WAIT_TIME_SECONDS" default:"0"`
+	SqsVisibilityTimeout        int64              `envconfig:"SQS_VISIBILITY_TIMEOUT" default:"0"`
+	SqsReceiveRequestAttemptID  bool               `envconfig:"SQS_RECEIVE_REQUEST_ATTEMPT_ID" default:"false"`
+	SqsAttributeNames           []string           `envconfig:"SQS_ATTRIBUTE_NAMES" default:"All"`
+	SqsMessageAttributeNames    []string           `envconfig:"SQS_MESSAGE_ATTRIBUTE_NAMES" default:"All"`
+	MessageStrictDecoding       bool               `envconfig:"MESSAGE_STRICT_DECODING" default:"false"`
+	SupportedPaymentMethods     []string           `envconfig:"SUPPORTED_PAYMENT_METHODS" default:"credit_card,debit_card,boleto,pix"`
+	IdempotencyStore            string             `envconfig:"IDEMPOTENCY_STORE" default:"dynamodb"`
+	IdempotencyFilePath         string             `envconfig:"IDEMPOTENCY_FILE_PATH" default:"/tmp/payments-idempotency.json"`
+	IdempotencyDynamoDBTable    string             `envconfig:"IDEMPOTENCY_DYNAMODB_TABLE"`
+	IdempotencyRequired         bool               `envconfig:"IDEMPOTENCY_REQUIRED" default:"false"`
+	ProviderRoutingRules        string             `envconfig:"PROVIDER_ROUTING_RULES"`
+	ProviderFailover            map[string]string  `envconfig:"PROVIDER_FAILOVER"`
+	ProviderBreakerThreshold    int                `envconfig:"PROVIDER_BREAKER_THRESHOLD" default:"5"`
+	ProviderBreakerCooldown     time.Duration      `envconfig:"PROVIDER_BREAKER_COOLDOWN" default:"30s"`
+	ProviderRateLimit           map[string]float64 `envconfig:"PROVIDER_RATE_LIMIT"`
+	ProviderRateBurst           map[string]int     `envconfig:"PROVIDER_RATE_BURST"`
+	ProviderRateMaxWait         time.Duration      `envconfig:"PROVIDER_RATE_MAX_WAIT" default:"1s"`
+	ProviderExampleRequestURI   string             `envconfig:"PROVIDER_EXAMPLE_REQUEST_URI" required:"true"`
 }
 
 // Load loads the environment variables
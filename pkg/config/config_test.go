@@ -3,6 +3,7 @@ package config_test
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
 	"github.com/stretchr/testify/assert"
@@ -22,14 +23,74 @@ func TestLoad(t *testing.T) {
 				"SQS_QUEUE_URL":                "http://sqs.host/",
 				"SQS_DLQ_QUEUE_URL":            "http://sqs.dlq.host/",
 				"SQS_MAX_NUMBER_OF_MESSAGES":   "1",
+				"SQS_VISIBILITY_TIMEOUT":       "30",
+				"PROVIDER_CONCURRENCY":         "Example:2",
+				"PROVIDER_FAILOVER":            "credit_card:Example|Backup",
+				"PROVIDER_RATE_LIMIT":          "Example:2.5",
+				"PROVIDER_RATE_BURST":          "Example:5",
 				"PROVIDER_EXAMPLE_REQUEST_URI": "http://provider.host/",
 			},
 			want: &config.Config{
-				LogLevel:                  "INFO",
-				SqsQueueURL:               "http://sqs.host/",
-				SqsDLQQueueURL:            "http://sqs.dlq.host/",
-				SqsMaxNumberOfMessages:    1,
-				ProviderExampleRequestURI: "http://provider.host/",
+				LogLevel:                    "INFO",
+				MetricsNamespace:            "Payments",
+				HandlerMode:                 config.HandlerModePull,
+				HandlerConcurrency:          10,
+				HandlerDeadlineMargin:       60 * time.Second,
+				MaxAttempts:                 5,
+				RetryBackoffBase:            10 * time.Second,
+				RetryBackoffMax:             15 * time.Minute,
+				VisibilityHeartbeatInterval: 20 * time.Second,
+				VisibilityHeartbeatMax:      15 * time.Minute,
+				ProviderConcurrency:         map[string]int{"Example": 2},
+				SqsQueueURL:                 "http://sqs.host/",
+				SqsDLQQueueURL:              "http://sqs.dlq.host/",
+				SqsMaxNumberOfMessages:      1,
+				SqsVisibilityTimeout:        30,
+				SqsAttributeNames:           []string{"All"},
+				SqsMessageAttributeNames:    []string{"All"},
+				SupportedPaymentMethods:     []string{"credit_card", "debit_card", "boleto", "pix"},
+				IdempotencyStore:            "dynamodb",
+				IdempotencyFilePath:         "/tmp/payments-idempotency.json",
+				ProviderBreakerThreshold:    5,
+				ProviderBreakerCooldown:     30 * time.Second,
+				ProviderFailover:            map[string]string{"credit_card": "Example|Backup"},
+				ProviderRateLimit:           map[string]float64{"Example": 2.5},
+				ProviderRateBurst:           map[string]int{"Example": 5},
+				ProviderRateMaxWait:         time.Second,
+				ProviderExampleRequestURI:   "http://provider.host/",
+			},
+		},
+		{
+			name: "event handler mode",
+			env: map[string]string{
+				"HANDLER_MODE":                 "event",
+				"SQS_QUEUE_URL":                "http://sqs.host/",
+				"SQS_DLQ_QUEUE_URL":            "http://sqs.dlq.host/",
+				"PROVIDER_EXAMPLE_REQUEST_URI": "http://provider.host/",
+			},
+			want: &config.Config{
+				LogLevel:                    "INFO",
+				MetricsNamespace:            "Payments",
+				HandlerMode:                 config.HandlerModeEvent,
+				HandlerConcurrency:          10,
+				HandlerDeadlineMargin:       60 * time.Second,
+				MaxAttempts:                 5,
+				RetryBackoffBase:            10 * time.Second,
+				RetryBackoffMax:             15 * time.Minute,
+				VisibilityHeartbeatInterval: 20 * time.Second,
+				VisibilityHeartbeatMax:      15 * time.Minute,
+				SqsQueueURL:                 "http://sqs.host/",
+				SqsDLQQueueURL:              "http://sqs.dlq.host/",
+				SqsMaxNumberOfMessages:      1,
+				SqsAttributeNames:           []string{"All"},
+				SqsMessageAttributeNames:    []string{"All"},
+				SupportedPaymentMethods:     []string{"credit_card", "debit_card", "boleto", "pix"},
+				IdempotencyStore:            "dynamodb",
+				IdempotencyFilePath:         "/tmp/payments-idempotency.json",
+				ProviderBreakerThreshold:    5,
+				ProviderBreakerCooldown:     30 * time.Second,
+				ProviderRateMaxWait:         time.Second,
+				ProviderExampleRequestURI:   "http://provider.host/",
 			},
 		},
 		{
@@ -0,0 +1,338 @@
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/idempotency"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// VisibilityTimeout is the time the DLQ messages are hidden from other consumers while they are inspected, the
+// messages that are not redriven are released as soon as the inspection finishes
+const VisibilityTimeout = 60 * time.Second
+
+// Errors
+var (
+	ErrMessageNotFound = errors.New("message not found on the DLQ")
+)
+
+// Message represents a message of the DLQ with the metadata of the failure that moved it
+// ID is the message id on the DLQ, OriginalID and GroupID the message id and the FIFO group on the main queue
+type Message struct {
+	ReceiptHandle    string          `json:"-"`
+	ID               string          `json:"id"`
+	OriginalID       string          `json:"original_id,omitempty"`
+	GroupID          string          `json:"group_id,omitempty"`
+	Provider         string          `json:"provider,omitempty"`
+	ErrorClass       string          `json:"error_class,omitempty"`
+	Error            string          `json:"error,omitempty"`
+	ValidationErrors json.RawMessage `json:"validation_errors,omitempty"`
+	DecodeFailure    string          `json:"decode_failure,omitempty"`
+	ReceiveCount     int             `json:"receive_count,omitempty"`
+	SentAt           time.Time       `json:"sent_at"`
+	MovedAt          time.Time       `json:"moved_at"`
+	Body             string          `json:"body"`
+}
+
+// Filter selects the DLQ messages, the empty values match all the messages
+// IDs match the DLQ or the original message id and Error matches a part of the error text
+type Filter struct {
+	IDs        []string
+	Provider   string
+	ErrorClass string
+	Error      string
+}
+
+// Match checks if the message is selected by the filter
+func (f Filter) Match(m Message) bool {
+	if len(f.IDs) > 0 {
+		found := false
+		for _, id := range f.IDs {
+			if id == m.ID || (m.OriginalID != "" && id == m.OriginalID) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Provider != "" && f.Provider != m.Provider {
+		return false
+	}
+	if f.ErrorClass != "" && f.ErrorClass != m.ErrorClass {
+		return false
+	}
+	if f.Error != "" && !strings.Contains(m.Error, f.Error) {
+		return false
+	}
+	return true
+}
+
+// Manager inspects and redrives the messages of the DLQ
+type Manager struct {
+	config *config.Config
+	sqs    message.SQSManager
+	codec  *message.Codec
+	store  idempotency.Store
+}
+
+// NewManager creates a new DLQ manager
+func NewManager(c *config.Config, sqs message.SQSManager) *Manager {
+	m := &Manager{
+		config: c,
+		sqs:    sqs,
+		codec:  message.NewCodec(c),
+	}
+	return m
+}
+
+// ReleaseIdempotency makes the redrive remove the in progress idempotency records of the critical messages
+// The handler keeps the record of a critical payment in progress, as the customer may have been charged, so without
+// the release a redriven critical message is moved back to the DLQ. Only release the records after checking with the
+// provider that the payments weren't processed
+func (d *Manager) ReleaseIdempotency(s idempotency.Store) {
+	d.store = s
+}
+
+// List returns the DLQ messages selected by the filter, the messages are kept on the DLQ
+// A FIFO DLQ only delivers the next messages of a group after the previous ones are deleted, so only the first messages
+// of each group may be listed
+func (d *Manager) List(ctx context.Context, f Filter) ([]Message, error) {
+	messages, err := d.receiveAll(ctx)
+	defer d.release(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := []Message{}
+	for _, m := range messages {
+		if f.Match(m) {
+			selected = append(selected, m)
+		}
+	}
+	return selected, nil
+}
+
+// Get returns a single DLQ message by its DLQ or original message id
+func (d *Manager) Get(ctx context.Context, id string) (Message, error) {
+	messages, err := d.List(ctx, Filter{IDs: []string{id}})
+	if err != nil {
+		return Message{}, err
+	}
+	if len(messages) == 0 {
+		return Message{}, ErrMessageNotFound
+	}
+	return messages[0], nil
+}
+
+// Redrive sends the DLQ messages selected by the filter back to the main queue and returns them
+// On a FIFO main queue the messages keep their original group and are sent in the order they are read from the DLQ,
+// so the order of each group is preserved. They are sent with a new deduplication id, so they aren't discarded as
+// duplicates of the original messages. In dry run mode the selected messages are only returned and all of them are
+// kept on the DLQ
+func (d *Manager) Redrive(ctx context.Context, f Filter, dryRun bool) ([]Message, error) {
+	redriven := []Message{}
+	for {
+		n, err := d.redrivePass(ctx, f, dryRun, &redriven)
+		if err != nil {
+			return redriven, err
+		}
+		// A FIFO DLQ only delivers the next messages of a group after the previous ones are deleted, so it's read
+		// again until there is nothing more to redrive
+		if dryRun || n == 0 || !message.IsFIFO(d.config.SqsDLQQueueURL) {
+			return redriven, nil
+		}
+	}
+}
+
+// redrivePass reads the DLQ once and redrives the selected messages, adding them to redriven
+// It returns the number of messages redriven by the pass
+func (d *Manager) redrivePass(ctx context.Context, f Filter, dryRun bool, redriven *[]Message) (int, error) {
+	messages, err := d.receiveAll(ctx)
+	if err != nil {
+		d.release(ctx, messages)
+		return 0, err
+	}
+
+	n := 0
+	kept := []Message{}
+	for i, m := range messages {
+		if !f.Match(m) {
+			kept = append(kept, m)
+			continue
+		}
+		if dryRun {
+			*redriven = append(*redriven, m)
+			kept = append(kept, m)
+			continue
+		}
+		if err := d.redrive(ctx, m); err != nil {
+			d.release(ctx, append(kept, messages[i:]...))
+			return n, errors.Wrapf(err, "failed to redrive the message %s", m.ID)
+		}
+		*redriven = append(*redriven, m)
+		n++
+	}
+
+	d.release(ctx, kept)
+	return n, nil
+}
+
+// redrive sends a message to the main queue and deletes it from the DLQ
+// The idempotency record of a critical message is released first, when the release is enabled
+func (d *Manager) redrive(ctx context.Context, m Message) error {
+	if d.store != nil && m.ErrorClass == message.ErrorClassCritical {
+		if err := d.releaseIdempotency(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	input := &sqs.SendMessageInput{
+		MessageBody: aws.String(m.Body),
+		QueueUrl:    aws.String(d.config.SqsQueueURL),
+	}
+	if message.IsFIFO(d.config.SqsQueueURL) {
+		groupID := m.GroupID
+		if groupID == "" {
+			groupID = uuid.NewV4().String()
+		}
+		input.MessageGroupId = aws.String(groupID)
+		input.MessageDeduplicationId = aws.String(uuid.NewV4().String())
+	}
+	_, err := d.sqs.SendMessageWithContext(ctx, input)
+	if err != nil {
+		return errors.Wrap(err, "failed to send the message to the main queue")
+	}
+
+	_, err = d.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(d.config.SqsDLQQueueURL),
+		ReceiptHandle: aws.String(m.ReceiptHandle),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to delete the message from the DLQ")
+	}
+
+	return nil
+}
+
+// releaseIdempotency removes the in progress idempotency record of the payment of a message
+// A missing record is not an error, and neither is a completed one: the store keeps it, so the redriven message of a
+// processed payment (e.g. one whose delete failed) is acknowledged without charging the customer again
+func (d *Manager) releaseIdempotency(ctx context.Context, m Message) error {
+	pm, err := d.codec.Decode([]byte(m.Body))
+	if err != nil {
+		return errors.Wrap(err, "failed to decode the message to release its idempotency record")
+	}
+	err = d.store.Release(ctx, idempotency.Key(pm))
+	if err != nil && err != idempotency.ErrRecordNotFound && err != idempotency.ErrRecordCompleted {
+		return errors.Wrap(err, "failed to release the idempotency record")
+	}
+	return nil
+}
+
+// receiveAll receives the DLQ messages until the queue is empty, hiding them from other consumers
+// The messages received before an error are returned with it, so they can be released
+func (d *Manager) receiveAll(ctx context.Context) ([]Message, error) {
+	messages := []Message{}
+	seen := make(map[string]bool)
+	for {
+		result, err := d.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+			MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+			QueueUrl:              aws.String(d.config.SqsDLQQueueURL),
+			MaxNumberOfMessages:   aws.Int64(10),
+			VisibilityTimeout:     aws.Int64(int64(VisibilityTimeout / time.Second)),
+			WaitTimeSeconds:       aws.Int64(0),
+		})
+		if err != nil {
+			return messages, errors.Wrap(err, "failed to read messages from the DLQ")
+		}
+		if len(result.Messages) == 0 {
+			return messages, nil
+		}
+
+		// A message received again means the visibility timeout expired during the inspection, the whole queue
+		// was already read
+		received := 0
+		for _, rm := range result.Messages {
+			m := newMessage(rm)
+			if seen[m.ID] {
+				continue
+			}
+			seen[m.ID] = true
+			messages = append(messages, m)
+			received++
+		}
+		if received == 0 {
+			return messages, nil
+		}
+	}
+}
+
+// release makes the messages visible again on the DLQ
+// A message that can't be released is visible again anyway after the visibility timeout
+func (d *Manager) release(ctx context.Context, messages []Message) {
+	for _, m := range messages {
+		_, _ = d.sqs.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(d.config.SqsDLQQueueURL),
+			ReceiptHandle:     aws.String(m.ReceiptHandle),
+			VisibilityTimeout: aws.Int64(0),
+		})
+	}
+}
+
+// newMessage creates a DLQ message from a SQS message and the failure attributes attached to it
+func newMessage(rm *sqs.Message) Message {
+	attributes := rm.MessageAttributes
+	m := Message{
+		ReceiptHandle: aws.StringValue(rm.ReceiptHandle),
+		ID:            aws.StringValue(rm.MessageId),
+		OriginalID:    stringValue(attributes[message.AttributeMessageID]),
+		GroupID:       stringValue(attributes[message.AttributeGroupID]),
+		Provider:      stringValue(attributes[message.AttributeProvider]),
+		ErrorClass:    stringValue(attributes[message.AttributeErrorClass]),
+		Error:         stringValue(attributes[message.AttributeError]),
+		DecodeFailure: stringValue(attributes[message.AttributeDecodeFailure]),
+		SentAt:        timestampValue(attributes[message.AttributeSentTimestamp]),
+		MovedAt:       timestampValue(attributes[message.AttributeMovedTimestamp]),
+		Body:          aws.StringValue(rm.Body),
+	}
+	if m.GroupID == "" {
+		// The group of a FIFO DLQ message is the original one
+		m.GroupID = aws.StringValue(rm.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+	}
+	if v := stringValue(attributes[message.AttributeValidationErrors]); v != "" && json.Valid([]byte(v)) {
+		m.ValidationErrors = json.RawMessage(v)
+	}
+	if n, err := strconv.Atoi(stringValue(attributes[message.AttributeReceiveCount])); err == nil {
+		m.ReceiveCount = n
+	}
+	return m
+}
+
+// stringValue returns the value of a message attribute, empty when it's not attached
+func stringValue(a *sqs.MessageAttributeValue) string {
+	if a == nil {
+		return ""
+	}
+	return aws.StringValue(a.StringValue)
+}
+
+// timestampValue returns the time of a timestamp attribute in epoch milliseconds, zero when it's not attached
+func timestampValue(a *sqs.MessageAttributeValue) time.Time {
+	ms, err := strconv.ParseInt(stringValue(a), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
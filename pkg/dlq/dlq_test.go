@@ -0,0 +1,447 @@
+package dlq_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/dlq"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/idempotency"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var (
+	testConfig = &config.Config{
+		SqsQueueURL:    "http://sqs.host/",
+		SqsDLQQueueURL: "http://sqs.dlq.host/",
+	}
+	fifoConfig = &config.Config{
+		SqsQueueURL:    "http://sqs.host/payments.fifo",
+		SqsDLQQueueURL: "http://sqs.host/payments-dlq.fifo",
+	}
+)
+
+// newSQSMessage creates a DLQ message with the failure attributes
+func newSQSMessage(id, provider, class, reason string) *sqs.Message {
+	attributes := map[string]*sqs.MessageAttributeValue{
+		message.AttributeError:          {DataType: aws.String("String"), StringValue: aws.String(reason)},
+		message.AttributeErrorClass:     {DataType: aws.String("String"), StringValue: aws.String(class)},
+		message.AttributeMessageID:      {DataType: aws.String("String"), StringValue: aws.String("original-" + id)},
+		message.AttributeGroupID:        {DataType: aws.String("String"), StringValue: aws.String("group-" + provider)},
+		message.AttributeReceiveCount:   {DataType: aws.String("Number"), StringValue: aws.String("3")},
+		message.AttributeSentTimestamp:  {DataType: aws.String("Number"), StringValue: aws.String("1546300800000")},
+		message.AttributeMovedTimestamp: {DataType: aws.String("Number"), StringValue: aws.String("1546300860000")},
+	}
+	if provider != "" {
+		attributes[message.AttributeProvider] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(provider)}
+	}
+	if class == message.ErrorClassUndecodable {
+		attributes[message.AttributeDecodeFailure] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String("unknown_field"),
+		}
+	}
+	if class == message.ErrorClassValidation {
+		attributes[message.AttributeValidationErrors] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(`[{"field":"order.id","message":"is required"}]`),
+		}
+	}
+	return &sqs.Message{
+		MessageId:         aws.String(id),
+		ReceiptHandle:     aws.String("receipt-" + id),
+		Body:              aws.String(`{"provider":"` + provider + `"}`),
+		MessageAttributes: attributes,
+	}
+}
+
+// newMockSQS creates a mocked SQS returning the batches of DLQ messages, then an empty batch
+func newMockSQS(batches ...[]*sqs.Message) *message.MockSQS {
+	mockSQS := new(message.MockSQS)
+	for _, b := range batches {
+		mockSQS.On("ReceiveMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.ReceiveMessageInput")).
+			Return(&sqs.ReceiveMessageOutput{Messages: b}, nil).Once()
+	}
+	mockSQS.On("ReceiveMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.ReceiveMessageInput")).
+		Return(&sqs.ReceiveMessageOutput{}, nil)
+	mockSQS.On("ChangeMessageVisibilityWithContext", mock.Anything, mock.AnythingOfType("*sqs.ChangeMessageVisibilityInput")).
+		Return(nil, nil)
+	return mockSQS
+}
+
+func TestManager_List(t *testing.T) {
+	batch := []*sqs.Message{
+		newSQSMessage("1", "Example", message.ErrorClassCritical, "provider internal error"),
+		newSQSMessage("2", "Other", message.ErrorClassExhausted, "attempts exhausted after 5 receives: timeout"),
+	}
+
+	tests := []struct {
+		name    string
+		batches [][]*sqs.Message
+		filter  dlq.Filter
+		wantIDs []string
+	}{
+		{
+			name:    "all messages",
+			batches: [][]*sqs.Message{batch[:1], batch[1:]},
+			wantIDs: []string{"1", "2"},
+		},
+		{
+			name:    "messages received again are listed once",
+			batches: [][]*sqs.Message{batch, batch[:1]},
+			wantIDs: []string{"1", "2"},
+		},
+		{
+			name:    "filtered by provider",
+			batches: [][]*sqs.Message{batch},
+			filter:  dlq.Filter{Provider: "Other"},
+			wantIDs: []string{"2"},
+		},
+		{
+			name:    "filtered by error class",
+			batches: [][]*sqs.Message{batch},
+			filter:  dlq.Filter{ErrorClass: message.ErrorClassCritical},
+			wantIDs: []string{"1"},
+		},
+		{
+			name:    "filtered by error",
+			batches: [][]*sqs.Message{batch},
+			filter:  dlq.Filter{Error: "timeout"},
+			wantIDs: []string{"2"},
+		},
+		{
+			name:    "filtered by original id",
+			batches: [][]*sqs.Message{batch},
+			filter:  dlq.Filter{IDs: []string{"original-2"}},
+			wantIDs: []string{"2"},
+		},
+		{
+			name:    "no messages",
+			wantIDs: []string{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockSQS := newMockSQS(tc.batches...)
+
+			messages, err := dlq.NewManager(testConfig, mockSQS).List(context.TODO(), tc.filter)
+
+			assert.Nil(t, err)
+			ids := []string{}
+			for _, m := range messages {
+				ids = append(ids, m.ID)
+			}
+			assert.Equal(t, tc.wantIDs, ids)
+			mockSQS.AssertNotCalled(t, "SendMessageWithContext", mock.Anything, mock.Anything)
+			mockSQS.AssertNotCalled(t, "DeleteMessageWithContext", mock.Anything, mock.Anything)
+			// All the received messages are released, even the ones that were not selected
+			released := 0
+			if len(tc.batches) > 0 {
+				released = len(batch)
+			}
+			mockSQS.AssertNumberOfCalls(t, "ChangeMessageVisibilityWithContext", released)
+		})
+	}
+}
+
+func TestManager_List_ReadError(t *testing.T) {
+	mockSQS := new(message.MockSQS)
+	mockSQS.On("ReceiveMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.ReceiveMessageInput")).
+		Return(&sqs.ReceiveMessageOutput{Messages: []*sqs.Message{newSQSMessage("1", "Example", "critical", "test")}}, nil).Once()
+	mockSQS.On("ReceiveMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.ReceiveMessageInput")).
+		Return((*sqs.ReceiveMessageOutput)(nil), errors.New("test"))
+	mockSQS.On("ChangeMessageVisibilityWithContext", mock.Anything, mock.AnythingOfType("*sqs.ChangeMessageVisibilityInput")).
+		Return(nil, nil)
+
+	messages, err := dlq.NewManager(testConfig, mockSQS).List(context.TODO(), dlq.Filter{})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, messages)
+	mockSQS.AssertNumberOfCalls(t, "ChangeMessageVisibilityWithContext", 1)
+}
+
+func TestManager_Get(t *testing.T) {
+	mockSQS := newMockSQS([]*sqs.Message{
+		newSQSMessage("1", "Example", message.ErrorClassCritical, "test"),
+		newSQSMessage("2", "Example", message.ErrorClassValidation, "invalid message: order.id: is required"),
+	})
+	manager := dlq.NewManager(testConfig, mockSQS)
+
+	m, err := manager.Get(context.TODO(), "2")
+
+	assert.Nil(t, err)
+	assert.Equal(t, dlq.Message{
+		ReceiptHandle:    "receipt-2",
+		ID:               "2",
+		OriginalID:       "original-2",
+		GroupID:          "group-Example",
+		Provider:         "Example",
+		ErrorClass:       message.ErrorClassValidation,
+		Error:            "invalid message: order.id: is required",
+		ValidationErrors: json.RawMessage(`[{"field":"order.id","message":"is required"}]`),
+		ReceiveCount:     3,
+		SentAt:           time.Unix(1546300800, 0).UTC(),
+		MovedAt:          time.Unix(1546300860, 0).UTC(),
+		Body:             `{"provider":"Example"}`,
+	}, m)
+
+	_, err = manager.Get(context.TODO(), "3")
+	assert.Equal(t, dlq.ErrMessageNotFound, err)
+
+	mockSQS = newMockSQS([]*sqs.Message{
+		newSQSMessage("4", "Example", message.ErrorClassUndecodable, "failed to decode the message (unknown_field): test"),
+	})
+	manager = dlq.NewManager(testConfig, mockSQS)
+
+	m, err = manager.Get(context.TODO(), "4")
+
+	assert.Nil(t, err)
+	assert.Equal(t, message.ErrorClassUndecodable, m.ErrorClass)
+	assert.Equal(t, "unknown_field", m.DecodeFailure)
+}
+
+func TestManager_Redrive(t *testing.T) {
+	batch := []*sqs.Message{
+		newSQSMessage("1", "Example", message.ErrorClassCritical, "test"),
+		newSQSMessage("2", "Other", message.ErrorClassExhausted, "test"),
+		newSQSMessage("3", "Example", message.ErrorClassExhausted, "test"),
+	}
+
+	tests := []struct {
+		name         string
+		config       *config.Config
+		filter       dlq.Filter
+		dryRun       bool
+		sendError    error
+		wantIDs      []string
+		wantSent     int
+		wantReleased int
+		wantError    bool
+	}{
+		{
+			name:         "all messages redriven",
+			wantIDs:      []string{"1", "2", "3"},
+			wantSent:     3,
+			wantReleased: 0,
+		},
+		{
+			name:         "all messages redriven to a standard queue",
+			config:       testConfig,
+			wantIDs:      []string{"1", "2", "3"},
+			wantSent:     3,
+			wantReleased: 0,
+		},
+		{
+			name:         "selected messages redriven",
+			filter:       dlq.Filter{Provider: "Example", ErrorClass: message.ErrorClassExhausted},
+			wantIDs:      []string{"3"},
+			wantSent:     1,
+			wantReleased: 2,
+		},
+		{
+			name:         "dry run",
+			filter:       dlq.Filter{Provider: "Example"},
+			dryRun:       true,
+			wantIDs:      []string{"1", "3"},
+			wantSent:     0,
+			wantReleased: 3,
+		},
+		{
+			name:         "send failed",
+			sendError:    errors.New("test"),
+			wantIDs:      []string{},
+			wantSent:     1,
+			wantReleased: 3,
+			wantError:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := fifoConfig
+			if tc.config != nil {
+				c = tc.config
+			}
+			mockSQS := newMockSQS(batch)
+			mockSQS.On("SendMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.SendMessageInput")).
+				Return(nil, tc.sendError)
+			mockSQS.On("DeleteMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageInput")).
+				Return(nil, nil)
+
+			messages, err := dlq.NewManager(c, mockSQS).Redrive(context.TODO(), tc.filter, tc.dryRun)
+
+			if tc.wantError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+			ids := []string{}
+			for _, m := range messages {
+				ids = append(ids, m.ID)
+			}
+			assert.Equal(t, tc.wantIDs, ids)
+			mockSQS.AssertNumberOfCalls(t, "SendMessageWithContext", tc.wantSent)
+			mockSQS.AssertNumberOfCalls(t, "ChangeMessageVisibilityWithContext", tc.wantReleased)
+
+			dedupIDs := make(map[string]bool)
+			groups := []string{}
+			for _, call := range mockSQS.Calls {
+				switch call.Method {
+				case "SendMessageWithContext":
+					smi := call.Arguments.Get(1).(*sqs.SendMessageInput)
+					assert.Equal(t, c.SqsQueueURL, *smi.QueueUrl)
+					if !message.IsFIFO(c.SqsQueueURL) {
+						assert.Nil(t, smi.MessageGroupId)
+						assert.Nil(t, smi.MessageDeduplicationId)
+						continue
+					}
+					assert.False(t, dedupIDs[*smi.MessageDeduplicationId], "deduplication id reused")
+					dedupIDs[*smi.MessageDeduplicationId] = true
+					groups = append(groups, *smi.MessageGroupId)
+				case "DeleteMessageWithContext":
+					dmi := call.Arguments.Get(1).(*sqs.DeleteMessageInput)
+					assert.Equal(t, c.SqsDLQQueueURL, *dmi.QueueUrl)
+				}
+			}
+			if tc.wantSent == 3 && message.IsFIFO(c.SqsQueueURL) {
+				// The messages keep their group and are sent in the order they were read
+				assert.Equal(t, []string{"group-Example", "group-Other", "group-Example"}, groups)
+			}
+		})
+	}
+}
+
+func TestManager_Redrive_FIFOGroups(t *testing.T) {
+	// The second message of the group is only delivered by the FIFO DLQ after the first one is deleted
+	mockSQS := newMockSQS(
+		[]*sqs.Message{newSQSMessage("1", "Example", message.ErrorClassExhausted, "test")},
+		nil,
+		[]*sqs.Message{newSQSMessage("2", "Example", message.ErrorClassExhausted, "test")},
+	)
+	mockSQS.On("SendMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.SendMessageInput")).Return(nil, nil)
+	mockSQS.On("DeleteMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageInput")).Return(nil, nil)
+
+	messages, err := dlq.NewManager(fifoConfig, mockSQS).Redrive(context.TODO(), dlq.Filter{}, false)
+
+	assert.Nil(t, err)
+	assert.Len(t, messages, 2)
+	mockSQS.AssertNumberOfCalls(t, "SendMessageWithContext", 2)
+}
+
+func TestManager_Redrive_ReleaseIdempotency(t *testing.T) {
+	critical := newSQSMessage("1", "Example", message.ErrorClassCritical, "test")
+	critical.Body = aws.String(`{"provider":"Example","order":{"id":"order-1"}}`)
+	undecodable := newSQSMessage("2", "Example", message.ErrorClassCritical, "test")
+	undecodable.Body = aws.String(`{`)
+
+	tests := []struct {
+		name         string
+		message      *sqs.Message
+		releaseError error
+		wantReleased bool
+		wantSent     int
+		wantError    bool
+	}{
+		{
+			name:         "critical message released",
+			message:      critical,
+			wantReleased: true,
+			wantSent:     1,
+		},
+		{
+			name:         "critical message without record",
+			message:      critical,
+			releaseError: idempotency.ErrRecordNotFound,
+			wantReleased: true,
+			wantSent:     1,
+		},
+		{
+			name:         "critical message with a completed record",
+			message:      critical,
+			releaseError: idempotency.ErrRecordCompleted,
+			wantReleased: true,
+			wantSent:     1,
+		},
+		{
+			name:         "release failed",
+			message:      critical,
+			releaseError: errors.New("test"),
+			wantReleased: true,
+			wantError:    true,
+		},
+		{
+			name:      "undecodable critical message",
+			message:   undecodable,
+			wantError: true,
+		},
+		{
+			name:     "other classes not released",
+			message:  newSQSMessage("3", "Example", message.ErrorClassExhausted, "test"),
+			wantSent: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockSQS := newMockSQS([]*sqs.Message{tc.message})
+			mockSQS.On("SendMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.SendMessageInput")).Return(nil, nil)
+			mockSQS.On("DeleteMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageInput")).Return(nil, nil)
+
+			mockStore := new(idempotency.MockStore)
+			mockStore.On("Release", mock.Anything, "Example:order-1").Return(tc.releaseError)
+
+			manager := dlq.NewManager(testConfig, mockSQS)
+			manager.ReleaseIdempotency(mockStore)
+			_, err := manager.Redrive(context.TODO(), dlq.Filter{}, false)
+
+			if tc.wantError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+			if tc.wantReleased {
+				mockStore.AssertCalled(t, "Release", mock.Anything, "Example:order-1")
+			} else {
+				mockStore.AssertNotCalled(t, "Release", mock.Anything, mock.Anything)
+			}
+			mockSQS.AssertNumberOfCalls(t, "SendMessageWithContext", tc.wantSent)
+		})
+	}
+}
+
+func TestManager_Redrive_CompletedRecord(t *testing.T) {
+	// A processed payment whose message delete failed reaches the DLQ as critical with a completed record
+	m := newSQSMessage("1", "Example", message.ErrorClassCritical, "failed to delete messages from SQS")
+	m.Body = aws.String(`{"provider":"Example","order":{"id":"order-1"}}`)
+	mockSQS := newMockSQS([]*sqs.Message{m})
+	mockSQS.On("SendMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.SendMessageInput")).Return(nil, nil)
+	mockSQS.On("DeleteMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageInput")).Return(nil, nil)
+
+	ctx := context.TODO()
+	store := idempotency.NewMemoryStore()
+	_, err := store.Begin(ctx, "Example:order-1")
+	assert.Nil(t, err)
+	assert.Nil(t, store.Complete(ctx, "Example:order-1", provider.ProcessResult{TransactionID: "tx-1"}))
+
+	manager := dlq.NewManager(testConfig, mockSQS)
+	manager.ReleaseIdempotency(store)
+	messages, err := manager.Redrive(ctx, dlq.Filter{}, false)
+
+	assert.Nil(t, err)
+	assert.Len(t, messages, 1)
+	r, err := store.Begin(ctx, "Example:order-1")
+	assert.Nil(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, idempotency.StatusCompleted, r.Status)
+		assert.Equal(t, "tx-1", r.Result.TransactionID)
+	}
+}
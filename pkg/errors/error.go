@@ -1,5 +1,11 @@
 package errors
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 // NewCriticalError returns an new critical error
 func NewCriticalError(s string) error {
 	return &CriticalError{s}
@@ -13,3 +19,121 @@ type CriticalError struct {
 func (e *CriticalError) Error() string {
 	return e.s
 }
+
+// NewInfrastructureError returns a new infrastructure error
+func NewInfrastructureError(s string) error {
+	return &InfrastructureError{s}
+}
+
+// InfrastructureError is an error of a provider that couldn't be reached or failed before answering, the payment
+// wasn't declined and it can be sent again to the same or to another provider
+type InfrastructureError struct {
+	s string
+}
+
+func (e *InfrastructureError) Error() string {
+	return e.s
+}
+
+// NewUncertainError returns a new uncertain error
+func NewUncertainError(s string) error {
+	return &UncertainError{s}
+}
+
+// UncertainError is an error of a provider request whose outcome is unknown (e.g. a timeout after the request was
+// sent), the payment may have been processed so it can only be sent again to the same provider
+type UncertainError struct {
+	s string
+}
+
+func (e *UncertainError) Error() string {
+	return e.s
+}
+
+// Release reasons
+const (
+	ReleaseCircuitOpen = "circuit_open"
+	ReleaseRateLimited = "rate_limited"
+)
+
+// NewReleaseError returns a new release error
+func NewReleaseError(reason string, delay time.Duration, err error) error {
+	return &ReleaseError{Reason: reason, Delay: delay, Err: err}
+}
+
+// ReleaseError is an error of a message that wasn't sent to the provider, it's released back to the queue to be
+// received again after the delay, without failing
+type ReleaseError struct {
+	Reason string
+	Delay  time.Duration
+	Err    error
+}
+
+func (e *ReleaseError) Error() string {
+	return fmt.Sprintf("message released (%s): %s", e.Reason, e.Err)
+}
+
+// FieldError represents the validation failure of a single message field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// NewValidationError returns a new validation error
+func NewValidationError(errs []FieldError) error {
+	return &ValidationError{errs}
+}
+
+// ValidationError is an error of a message that is invalid, it doesn't allow the message to be processed again
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var s []string
+	for _, fe := range e.Errors {
+		s = append(s, fe.Field+": "+fe.Message)
+	}
+	return "invalid message: " + strings.Join(s, "; ")
+}
+
+// NewAttemptsExhaustedError returns a new attempts exhausted error
+func NewAttemptsExhaustedError(attempts int, err error) error {
+	return &AttemptsExhaustedError{Attempts: attempts, Err: err}
+}
+
+// AttemptsExhaustedError is an error of a message that failed in all the allowed attempts, it doesn't allow the
+// message to be processed again
+type AttemptsExhaustedError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *AttemptsExhaustedError) Error() string {
+	return fmt.Sprintf("attempts exhausted after %d receives: %s", e.Attempts, e.Err)
+}
+
+// Decode failure reasons
+const (
+	DecodeMalformed          = "malformed"
+	DecodeUnknownField       = "unknown_field"
+	DecodeUnsupportedVersion = "unsupported_version"
+	DecodeUpgradeFailed      = "upgrade_failed"
+)
+
+// NewDecodeError returns a new decode error
+func NewDecodeError(reason string, version int, err error) error {
+	return &DecodeError{Reason: reason, Version: version, Err: err}
+}
+
+// DecodeError is an error of a message body that can't be decoded, it doesn't allow the message to be processed again
+// Version is the schema version of the body, zero when it's unknown
+type DecodeError struct {
+	Reason  string
+	Version int
+	Err     error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode the message (%s): %s", e.Reason, e.Err)
+}
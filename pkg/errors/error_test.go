@@ -1,7 +1,9 @@
 package errors_test
 
 import (
+	goerrors "errors"
 	"testing"
+	"time"
 
 	"github.com/fredw/igti-aws-lambda-payments/pkg/errors"
 	"github.com/stretchr/testify/assert"
@@ -12,3 +14,43 @@ func TestNewCriticalError(t *testing.T) {
 	assert.IsType(t, &errors.CriticalError{}, err)
 	assert.Equal(t, "test", err.Error())
 }
+
+func TestNewInfrastructureError(t *testing.T) {
+	err := errors.NewInfrastructureError("test")
+	assert.IsType(t, &errors.InfrastructureError{}, err)
+	assert.Equal(t, "test", err.Error())
+}
+
+func TestNewUncertainError(t *testing.T) {
+	err := errors.NewUncertainError("test")
+	assert.IsType(t, &errors.UncertainError{}, err)
+	assert.Equal(t, "test", err.Error())
+}
+
+func TestNewReleaseError(t *testing.T) {
+	err := errors.NewReleaseError(errors.ReleaseCircuitOpen, time.Minute, goerrors.New("test"))
+	assert.IsType(t, &errors.ReleaseError{}, err)
+	assert.Equal(t, time.Minute, err.(*errors.ReleaseError).Delay)
+	assert.Equal(t, "message released (circuit_open): test", err.Error())
+}
+
+func TestNewValidationError(t *testing.T) {
+	err := errors.NewValidationError([]errors.FieldError{
+		{Field: "order.id", Message: "is required"},
+		{Field: "order.customer.email", Message: "is invalid"},
+	})
+	assert.IsType(t, &errors.ValidationError{}, err)
+	assert.Equal(t, "invalid message: order.id: is required; order.customer.email: is invalid", err.Error())
+}
+
+func TestNewAttemptsExhaustedError(t *testing.T) {
+	err := errors.NewAttemptsExhaustedError(5, goerrors.New("test"))
+	assert.IsType(t, &errors.AttemptsExhaustedError{}, err)
+	assert.Equal(t, "attempts exhausted after 5 receives: test", err.Error())
+}
+
+func TestNewDecodeError(t *testing.T) {
+	err := errors.NewDecodeError(errors.DecodeUnsupportedVersion, 3, goerrors.New("schema version 3 is not supported"))
+	assert.IsType(t, &errors.DecodeError{}, err)
+	assert.Equal(t, "failed to decode the message (unsupported_version): schema version 3 is not supported", err.Error())
+}
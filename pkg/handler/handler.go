@@ -3,147 +3,606 @@ package handler
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
 	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/idempotency"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/metrics"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/retry"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/trace"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/validation"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/worker"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
 // Errors
 var (
-	ErrFailedReadMessages = errors.New("failed to read messages from SQS")
+	ErrFailedReadMessages        = errors.New("failed to read messages from SQS")
+	ErrCriticalPaymentInProgress = perrors.NewCriticalError("payment may have been processed by a previous attempt that didn't finish")
 )
 
 // Message statuses
 var (
-	MessageStatusSuccess  = "success"
-	MessageStatusError    = "error"
-	MessageStatusCritical = "critical"
+	MessageStatusSuccess     = "success"
+	MessageStatusError       = "error"
+	MessageStatusCritical    = "critical"
+	MessageStatusInvalid     = "invalid"
+	MessageStatusExhausted   = "exhausted"
+	MessageStatusCircuitOpen = perrors.ReleaseCircuitOpen
+	MessageStatusRateLimited = perrors.ReleaseRateLimited
 )
 
+// Acknowledgements of a processed message
+const (
+	ackNone = iota
+	ackDelete
+	ackMoveToFailed
+)
+
+// outcome represents a processed message waiting for its acknowledgement, which is applied in batch at the end of
+// the processing round
+// A message kept in the queue for a new attempt may have a delay before it's visible again
+type outcome struct {
+	message   message.Message
+	payment   *provider.ProcessResult
+	err       error
+	ack       int
+	delay     time.Duration
+	duplicate bool
+	attempts  []Attempt
+}
+
 // Event represents the Lambda event
 type Event struct{}
 
 // Handler represents the handler
 type Handler struct {
+	config    *config.Config
 	log       *log.Logger
 	providers provider.ProcessorList
 	adapter   message.Adapter
+	codec     *message.Codec
+	validator validation.Validator
+	store     idempotency.Store
+	pool      *worker.Pool
+	backoff   *retry.Backoff
+	failover  provider.Failover
 }
 
 // Response represents the lambda response
 type Response struct {
-	Result   string            `json:"result"`
-	Messages []MessageResponse `json:"messages"`
+	Result      string                `json:"result"`
+	Batches     int                   `json:"batches,omitempty"`
+	Messages    []MessageResponse     `json:"messages"`
+	Quarantined []message.Quarantined `json:"quarantined,omitempty"`
 }
 
 // MessageResponse represents the message response
 type MessageResponse struct {
-	ID     *string `json:"id"`
-	Status string  `json:"status"`
-	Error  string  `json:"error,omitempty"`
+	ID               *string                 `json:"id"`
+	Status           string                  `json:"status"`
+	Error            string                  `json:"error,omitempty"`
+	ValidationErrors []perrors.FieldError    `json:"validation_errors,omitempty"`
+	Payment          *provider.ProcessResult `json:"payment,omitempty"`
+	Duplicate        bool                    `json:"duplicate,omitempty"`
+	Attempts         []Attempt               `json:"attempts,omitempty"`
+}
+
+// Attempt represents a provider call of a message with a failover chain, Failover is set on the calls to the
+// providers of the chain
+type Attempt struct {
+	Provider string `json:"provider"`
+	Status   string `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Failover bool   `json:"failover,omitempty"`
 }
 
 // NewHandler creates a new handler struct
-func NewHandler(l *log.Logger, p provider.ProcessorList, a message.Adapter) *Handler {
+func NewHandler(
+	c *config.Config,
+	l *log.Logger,
+	p provider.ProcessorList,
+	a message.Adapter,
+	v validation.Validator,
+	s idempotency.Store,
+) *Handler {
 	h := &Handler{
+		config:    c,
 		log:       l,
 		providers: p,
 		adapter:   a,
+		codec:     message.NewCodec(c),
+		validator: v,
+		store:     s,
+		pool:      worker.NewPool(c.HandlerConcurrency, c.ProviderConcurrency),
+		backoff:   retry.NewBackoff(c.RetryBackoffBase, c.RetryBackoffMax),
+		failover:  provider.NewFailover(c),
 	}
 	return h
 }
 
 // Handler handles the lambda invoke
+// It keeps receiving and processing batches of messages until the queue is empty, the maximum number of batches is
+// reached or the invocation deadline is near, leaving the configured margin to finish the in-flight payments
 func (h *Handler) Handler(ctx context.Context, event Event) (Response, error) {
-	messages, err := h.adapter.GetMessages()
+	ctx = trace.FromLambda(ctx)
+	resp := Response{}
+	for {
+		if !h.hasTimeForBatch(ctx, resp.Batches) {
+			h.logger(ctx).WithField("batches", resp.Batches).Info("invocation deadline is near, stop receiving messages")
+			break
+		}
+		if h.config.HandlerMaxBatches > 0 && resp.Batches >= h.config.HandlerMaxBatches {
+			break
+		}
 
-	if err != nil {
-		return Response{}, ErrFailedReadMessages
+		messages, quarantined, err := h.adapter.GetMessages(ctx)
+		if err != nil {
+			if resp.Batches == 0 {
+				return Response{}, ErrFailedReadMessages
+			}
+			// The messages of the previous batches were already handled, they must be reported anyway
+			h.logger(ctx).WithError(err).Info("problem to read messages, stop receiving messages")
+			break
+		}
+		if len(messages) == 0 && len(quarantined) == 0 {
+			break
+		}
+		if len(quarantined) > 0 {
+			h.logger(ctx).WithField("quarantined", quarantined).Info("messages quarantined")
+		}
+
+		mrs := h.processMessages(ctx, messages, true)
+		h.logger(ctx).WithField("messages", mrs).Info("messages processed")
+
+		resp.Batches++
+		resp.Messages = append(resp.Messages, mrs...)
+		resp.Quarantined = append(resp.Quarantined, quarantined...)
+
+		// The released messages would be received again in this invocation as soon as their short delay ends, using a
+		// receive each time, while their provider is still unavailable
+		if allReleased(mrs) {
+			h.logger(ctx).WithField("batches", resp.Batches).Info("all the messages of the batch were released, stop receiving messages")
+			break
+		}
 	}
-	if len(messages) == 0 {
+
+	h.reportBreakers(ctx)
+
+	if resp.Batches == 0 {
 		return Response{Result: "No messages received"}, nil
 	}
+	resp.Result = "Messages processed"
+
+	return resp, nil
+}
+
+// allReleased checks if all the messages of a batch were released back to the queue without being processed
+func allReleased(mrs []MessageResponse) bool {
+	if len(mrs) == 0 {
+		return false
+	}
+	for _, mr := range mrs {
+		if mr.Status != MessageStatusCircuitOpen && mr.Status != MessageStatusRateLimited {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTimeForBatch checks if there is time to receive and process another batch before the invocation deadline
+// The first batch is always received, so a margin longer than the timeout of the function doesn't leave it idle
+func (h *Handler) hasTimeForBatch(ctx context.Context, batches int) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok || batches == 0 {
+		return true
+	}
+	return time.Until(deadline) > h.config.HandlerDeadlineMargin
+}
+
+// SQSHandler handles the lambda invoke triggered by the SQS event source
+// Successful and critical messages are removed from the queue by Lambda and by the DLQ move respectively,
+// only the messages that must be retried are reported back as batch item failures
+// On a FIFO queue the messages of a group are processed in order: once a message of a group fails, the next messages
+// of the group are reported as failures without being processed, so they are received again after it
+func (h *Handler) SQSHandler(ctx context.Context, event events.SQSEvent) (events.SQSEventResponse, error) {
+	ctx = trace.FromLambda(ctx)
+	failures := []events.SQSBatchItemFailure{}
+	blocked := make(map[string]bool)
+
+	// Keep the SQS message id of each receipt handle, Lambda identifies the failed items by the message id
+	ids := make(map[string]string)
+	messages := message.Messages{}
+	for _, r := range event.Records {
+		m, err := message.NewMessageFromEvent(r, h.codec)
+		if err != nil {
+			// Isolate the message that can't be decoded, it's only retried when the quarantine fails
+			if errQ := h.adapter.Quarantine(ctx, m, r.Body, err); errQ != nil {
+				h.logger(ctx).WithError(errQ).WithField("message_id", r.MessageId).Info("problem to quarantine message")
+				failures = append(failures, events.SQSBatchItemFailure{ItemIdentifier: r.MessageId})
+				if g := m.Metadata.GroupID; g != "" {
+					blocked[g] = true
+				}
+				continue
+			}
+			h.logger(ctx).WithError(err).WithField("message_id", r.MessageId).Info("message quarantined")
+			continue
+		}
+		ids[r.ReceiptHandle] = r.MessageId
+		messages = append(messages, m)
+	}
+
+	mrs := []MessageResponse{}
+	for _, round := range groupRounds(messages) {
+		pending := message.Messages{}
+		for _, m := range round {
+			if blocked[m.Metadata.GroupID] {
+				failures = append(failures, events.SQSBatchItemFailure{ItemIdentifier: ids[*m.Id]})
+				h.logger(ctx).WithField("message", m).Info("message not processed, a previous message of its group failed")
+				continue
+			}
+			pending = append(pending, m)
+		}
+
+		for i, mr := range h.processMessages(ctx, pending, false) {
+			switch mr.Status {
+			case MessageStatusError, MessageStatusCircuitOpen, MessageStatusRateLimited:
+				failures = append(failures, events.SQSBatchItemFailure{ItemIdentifier: ids[*mr.ID]})
+				if g := pending[i].Metadata.GroupID; g != "" {
+					blocked[g] = true
+				}
+			}
+			mrs = append(mrs, mr)
+		}
+	}
+
+	h.logger(ctx).WithField("messages", mrs).Info("messages processed")
+	h.reportBreakers(ctx)
+
+	return events.SQSEventResponse{BatchItemFailures: failures}, nil
+}
 
-	// Process all messages concurrently
-	cmr := make(chan MessageResponse)
+// groupRounds splits the messages in rounds processed one after the other, each round has the next message of each
+// FIFO group, so the messages of a group are processed in order. The messages without group are in the first round
+func groupRounds(messages message.Messages) []message.Messages {
+	rounds := []message.Messages{}
+	positions := make(map[string]int)
 	for _, m := range messages {
-		go h.processMessage(m, cmr)
-		h.log.WithField("message", m).Info("message processed successfully")
+		r := 0
+		if g := m.Metadata.GroupID; g != "" {
+			r = positions[g]
+			positions[g]++
+		}
+		for len(rounds) <= r {
+			rounds = append(rounds, message.Messages{})
+		}
+		rounds[r] = append(rounds[r], m)
 	}
+	return rounds
+}
 
-	// Create a list of message responses
-	var mrs []MessageResponse
-	for range messages {
-		mrs = append(mrs, <-cmr)
+// processMessages process all messages concurrently through the worker pool and returns the list of message
+// responses in the same order of the messages
+// The messages are acknowledged in batch when all of them are processed
+// When deleteOnSuccess is false, the successful messages are kept for the caller to acknowledge
+func (h *Handler) processMessages(ctx context.Context, messages message.Messages, deleteOnSuccess bool) []MessageResponse {
+	if len(messages) == 0 {
+		return nil
 	}
 
-	h.log.WithField("messages", mrs).Info("messages processed")
+	// Resolve the provider of each message once, it's the key of the provider concurrency limits and the provider of
+	// the logs and of the DLQ
+	routed := make(message.Messages, len(messages))
+	for i, m := range messages {
+		m.Metadata.RoutedProvider = h.providerName(m)
+		routed[i] = m
+	}
+
+	// The messages waiting for a worker or for the acknowledgement are also kept hidden
+	hb := h.startHeartbeat(ctx, routed)
+	outcomes := make([]outcome, len(routed))
+	h.pool.Run(
+		len(routed),
+		func(i int) string { return routed[i].ResolvedProvider() },
+		func(i int) { outcomes[i] = h.processMessage(ctx, routed[i], deleteOnSuccess) },
+	)
+	hb.Stop()
+
+	h.acknowledge(ctx, outcomes)
 
-	return Response{Result: "Messages processed", Messages: mrs}, nil
+	mrs := make([]MessageResponse, len(outcomes))
+	for i, o := range outcomes {
+		mrs[i] = h.getMessageResponse(ctx, o)
+	}
+
+	return mrs
 }
 
-// processMessage process a message calling the provider logic and handle the message through the SQS
-func (h *Handler) processMessage(m message.Message, cmr chan MessageResponse) {
+// processMessage process a message calling the provider logic and returns what must be done with the message
+func (h *Handler) processMessage(ctx context.Context, m message.Message, deleteOnSuccess bool) outcome {
+	// Invalid messages never reach the provider, they are moved to the DLQ with the list of invalid fields
+	if err := h.validator.Validate(m); err != nil {
+		return h.processErrorMessage(ctx, m, nil, err)
+	}
+
 	// Get the provider and process the message using the own provider logic
-	p := h.providers.GetByMessage(m)
+	p := h.getProvider(m, m.ResolvedProvider())
 	if p == nil {
-		err := fmt.Errorf("provider %s not available to process this message", m.Provider)
-		cmr <- h.getMessageResponse(m, err)
-		return
+		err := fmt.Errorf("provider %s not available to process this message", m.ResolvedProvider())
+		return h.processRetryableError(ctx, m, nil, err)
 	}
 
-	// Try to process the message
-	if err := p.Process(m); err != nil {
-		cmr <- h.getMessageResponse(m, h.processErrorMessage(m, err))
-		return
+	// Check if the payment was already sent to the provider by a previous delivery of the message
+	key := idempotency.Key(m)
+	record, err := h.store.Begin(ctx, key)
+	if err != nil {
+		err = errors.Wrap(err, "failed to check the idempotency of the payment")
+		return h.processRetryableError(ctx, m, nil, err)
+	}
+	if record != nil {
+		if record.Status == idempotency.StatusCompleted {
+			return h.processDuplicateMessage(m, record, deleteOnSuccess)
+		}
+		return h.processErrorMessage(ctx, m, nil, ErrCriticalPaymentInProgress)
 	}
 
-	// After successful process, try to delete the message from SQS
-	if err := h.adapter.Delete(m.Id); err != nil {
-		cmr <- h.getMessageResponse(m, h.processErrorMessage(m, err))
-		return
+	// Try to process the message, keeping the provider answer only when there is one
+	var payment *provider.ProcessResult
+	result, attempts, err := h.processPayment(ctx, m, p)
+	if result.Status != "" {
+		payment = &result
+	}
+	if err != nil {
+		// Only a non critical failure allows a new attempt, a critical one may have charged the customer
+		if _, ok := err.(*perrors.CriticalError); !ok {
+			if errR := h.store.Release(ctx, key); errR != nil {
+				h.logger(ctx).WithError(errR).WithField("key", key).Info("problem to release the idempotency record")
+			}
+		}
+		o := h.processErrorMessage(ctx, m, payment, err)
+		o.attempts = attempts
+		return o
+	}
+	if err := h.store.Complete(ctx, key, result); err != nil {
+		h.logger(ctx).WithError(err).WithField("key", key).Info("problem to complete the idempotency record")
+	}
+
+	// After successful process, the message is deleted from SQS
+	o := outcome{message: m, payment: payment, attempts: attempts}
+	if deleteOnSuccess {
+		o.ack = ackDelete
+	}
+	return o
+}
+
+// processPayment sends the payment to the provider, trying the next providers of the failover chain of the payment
+// method while the failure is an infrastructure one and nothing was captured
+// The attempts are only recorded when the payment method has a failover chain
+func (h *Handler) processPayment(ctx context.Context, m message.Message, p provider.Processor) (provider.ProcessResult, []Attempt, error) {
+	result, err := p.Process(ctx, m)
+	chain := h.failover.Chain(m.Order.PaymentMethod)
+	if len(chain) == 0 {
+		return result, nil, err
+	}
+
+	name := m.ResolvedProvider()
+	attempts := []Attempt{newAttempt(name, result, err, false)}
+	tried := map[string]bool{name: true}
+	for _, next := range chain {
+		if !provider.CanFailover(result, err) {
+			break
+		}
+		if tried[next] {
+			continue
+		}
+		tried[next] = true
+
+		fm := m
+		fm.Provider = next
+		fm.Metadata.RoutedProvider = next
+		fp := h.getProvider(fm, next)
+		if fp == nil {
+			h.logger(ctx).WithField("provider", next).Info("failover provider not available")
+			continue
+		}
+		h.logger(ctx).WithError(err).WithFields(log.Fields{"from": name, "to": next}).Info("failing over to the next provider")
+		result, err = fp.Process(ctx, fm)
+		attempts = append(attempts, newAttempt(next, result, err, true))
+		name = next
+	}
+	return result, attempts, err
+}
+
+// getProvider returns the processor of a provider resolved for the message, without routing the message again
+func (h *Handler) getProvider(m message.Message, name string) provider.Processor {
+	rm := m
+	rm.Provider = name
+	return h.providers.GetByMessage(rm)
+}
+
+// providerName returns the name of the provider chosen for the message, the one chosen by the routing rules when the
+// providers explain it
+func (h *Handler) providerName(m message.Message) string {
+	if e, ok := h.providers.(provider.Explainer); ok {
+		return e.Explain(m).Provider
 	}
+	return m.Provider
+}
+
+// newAttempt returns the attempt of a provider call
+func newAttempt(name string, result provider.ProcessResult, err error, failover bool) Attempt {
+	a := Attempt{Provider: name, Status: result.Status, Failover: failover}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	return a
+}
 
-	cmr <- h.getMessageResponse(m, nil)
+// processDuplicateMessage handles a message whose payment was already processed, it's acknowledged without calling
+// the provider again
+func (h *Handler) processDuplicateMessage(m message.Message, record *idempotency.Record, deleteOnSuccess bool) outcome {
+	payment := record.Result
+	o := outcome{message: m, payment: &payment, duplicate: true}
+	if deleteOnSuccess {
+		o.ack = ackDelete
+	}
+	return o
 }
 
 // processErrorMessage process a message with an error
-func (h *Handler) processErrorMessage(m message.Message, err error) error {
+func (h *Handler) processErrorMessage(ctx context.Context, m message.Message, payment *provider.ProcessResult, err error) outcome {
 	switch err.(type) {
-	case *perrors.CriticalError:
-		// If it's a critical failure, move the message directly to the failed list
-		errM := h.adapter.MoveToFailed(m)
-		if errM != nil {
-			return errors.Wrap(err, "problem to move the message to DLQ")
+	case *perrors.CriticalError, *perrors.ValidationError:
+		// If it's a critical failure or an invalid message, move the message directly to the failed list
+		return outcome{message: m, payment: payment, err: err, ack: ackMoveToFailed}
+	case *perrors.ReleaseError:
+		// The provider wasn't called, the message is received again after the delay and it's never moved to the failed
+		// list because of a release. The receive still increments ApproximateReceiveCount, so the releases count
+		// towards MaxAttempts on a later failure and towards the maxReceiveCount of the redrive policy of the queue
+		return outcome{message: m, payment: payment, err: err, delay: err.(*perrors.ReleaseError).Delay}
+	}
+	return h.processRetryableError(ctx, m, payment, errors.Wrap(err, "failed to process the payment"))
+}
+
+// processRetryableError process a message with an error that allows a new attempt
+// The message is kept in the queue to be received again until the maximum number of attempts is reached, then it's
+// moved to the failed list
+// Each new attempt is delayed by the backoff policy, giving time to a struggling provider to recover
+func (h *Handler) processRetryableError(ctx context.Context, m message.Message, payment *provider.ProcessResult, err error) outcome {
+	if h.config.MaxAttempts <= 0 || m.Metadata.ReceiveCount < h.config.MaxAttempts {
+		o := outcome{message: m, payment: payment, err: err}
+		if h.backoff.Enabled() {
+			o.delay = h.backoff.Delay(m.Metadata.ReceiveCount)
+		}
+		return o
+	}
+	err = perrors.NewAttemptsExhaustedError(m.Metadata.ReceiveCount, err)
+	return outcome{message: m, payment: payment, err: err, ack: ackMoveToFailed}
+}
+
+// acknowledge applies the acknowledgement of the processed messages in batch, first deleting the successful ones
+// and then moving the failed ones to the DLQ, the retries of the other failed ones are delayed
+// The outcome of a message whose acknowledgement failed is updated with the failure
+func (h *Handler) acknowledge(ctx context.Context, outcomes []outcome) {
+	deletes := []int{}
+	ids := []*string{}
+	for i, o := range outcomes {
+		if o.ack == ackDelete {
+			deletes = append(deletes, i)
+			ids = append(ids, o.message.Id)
+		}
+	}
+	if len(ids) > 0 {
+		for j, err := range h.adapter.DeleteBatch(ctx, ids) {
+			if err != nil {
+				o := outcomes[deletes[j]]
+				outcomes[deletes[j]] = h.processErrorMessage(ctx, o.message, o.payment, err)
+				outcomes[deletes[j]].attempts = o.attempts
+			}
+		}
+	}
+
+	moves := []int{}
+	failed := []message.Failed{}
+	for i, o := range outcomes {
+		if o.ack == ackMoveToFailed {
+			moves = append(moves, i)
+			failed = append(failed, message.Failed{Message: o.message, Reason: o.err})
+		}
+	}
+	if len(failed) > 0 {
+		for j, err := range h.adapter.MoveToFailedBatch(ctx, failed) {
+			if err != nil {
+				o := &outcomes[moves[j]]
+				o.err = errors.Wrap(o.err, "problem to move the message to DLQ")
+			}
+		}
+	}
+
+	for _, o := range outcomes {
+		if o.ack == ackNone && o.delay > 0 {
+			if err := h.adapter.ChangeVisibility(ctx, o.message.Id, o.delay); err != nil {
+				// The message is still retried, after the default visibility timeout of the queue
+				h.logger(ctx).WithError(err).WithField("message", o.message).Info("problem to delay the message retry")
+			}
 		}
-		return err
 	}
-	return errors.Wrap(err, "failed to process the payment")
 }
 
 // getMessageResponse returns a message response
-func (h *Handler) getMessageResponse(m message.Message, err error) MessageResponse {
+func (h *Handler) getMessageResponse(ctx context.Context, o outcome) MessageResponse {
+	m, payment, err := o.message, o.payment, o.err
 	if err != nil {
 		mStatus := MessageStatusError
-		switch err.(type) {
+		var validationErrors []perrors.FieldError
+		switch e := err.(type) {
 		case *perrors.CriticalError:
 			mStatus = MessageStatusCritical
+		case *perrors.ValidationError:
+			mStatus = MessageStatusInvalid
+			validationErrors = e.Errors
+		case *perrors.AttemptsExhaustedError:
+			mStatus = MessageStatusExhausted
+		case *perrors.ReleaseError:
+			mStatus = e.Reason
 		}
 
-		h.log.WithError(err).WithField("message", m).Info("problem to process message")
+		h.logger(ctx).WithError(err).WithField("message", m).WithField("provider", m.ResolvedProvider()).WithField("payment", payment).Info("problem to process message")
 
 		return MessageResponse{
-			ID:     m.Id,
-			Status: mStatus,
-			Error:  err.Error(),
+			ID:               m.Id,
+			Status:           mStatus,
+			Error:            err.Error(),
+			ValidationErrors: validationErrors,
+			Payment:          payment,
+			Attempts:         o.attempts,
 		}
 	}
 
+	if o.duplicate {
+		h.logger(ctx).WithField("message", m).WithField("provider", m.ResolvedProvider()).WithField("payment", payment).Info("message already processed")
+	} else {
+		h.logger(ctx).WithField("message", m).WithField("provider", m.ResolvedProvider()).WithField("payment", payment).Info("message processed successfully")
+	}
+
 	return MessageResponse{
-		ID:     m.Id,
-		Status: MessageStatusSuccess,
+		ID:        m.Id,
+		Status:    MessageStatusSuccess,
+		Payment:   payment,
+		Duplicate: o.duplicate,
+		Attempts:  o.attempts,
+	}
+}
+
+// reportBreakers logs the state of the circuit breakers of the providers, publishing it as metrics
+func (h *Handler) reportBreakers(ctx context.Context) {
+	bl, ok := h.providers.(provider.BreakerList)
+	if !ok {
+		return
 	}
+	for _, b := range bl.Breakers() {
+		s := b.Collect()
+		open := 0.0
+		if s.State != provider.BreakerClosed {
+			open = 1
+		}
+		fields := metrics.Fields(h.config.MetricsNamespace, map[string]string{"Provider": s.Provider}, []metrics.Metric{
+			{Name: "CircuitOpen", Unit: metrics.UnitNone, Value: open},
+			{Name: "CircuitRejected", Unit: metrics.UnitCount, Value: float64(s.Rejected)},
+		})
+		h.logger(ctx).WithFields(fields).WithField("breaker", s).Info("circuit breaker state")
+	}
+}
+
+// logger returns a log entry with the request scoped values of the context
+func (h *Handler) logger(ctx context.Context) *log.Entry {
+	return h.log.WithFields(trace.Fields(ctx))
 }
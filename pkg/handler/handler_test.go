@@ -1,14 +1,23 @@
 package handler_test
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
 	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/handler"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/idempotency"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/trace"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/validation"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -23,13 +32,35 @@ func TestNewHandler(t *testing.T) {
 			Provider: "Example",
 		},
 	}
+	approved := provider.ProcessResult{
+		TransactionID:  "tx-1",
+		Status:         provider.PaymentStatusApproved,
+		AmountCaptured: message.NewMoney(1000, "BRL"),
+	}
+	quarantinedID := "quarantined-id"
+	quarantined := []message.Quarantined{
+		{Id: &quarantinedID, Error: "invalid character 'h' in literal true (expecting 'r')"},
+	}
+	invalid := perrors.NewValidationError([]perrors.FieldError{
+		{Field: "order.id", Message: "is required"},
+	})
+	declined := provider.ProcessResult{
+		TransactionID: "tx-1",
+		Status:        provider.PaymentStatusDeclined,
+		DeclineCode:   "insufficient_funds",
+	}
 
 	tests := []struct {
 		name                      string
 		adapterGetMessageResponse message.Messages
+		adapterGetQuarantined     []message.Quarantined
 		adapterGetMessageError    error
 		adapterDeleteError        error
 		adapterMoveDLQError       error
+		validationError           error
+		storeRecord               *idempotency.Record
+		storeError                error
+		processResult             provider.ProcessResult
 		processError              error
 		providerEmpty             bool
 		wantResponse              handler.Response
@@ -48,7 +79,8 @@ func TestNewHandler(t *testing.T) {
 				},
 			},
 			wantResponse: handler.Response{
-				Result: "Messages processed",
+				Result:  "Messages processed",
+				Batches: 1,
 				Messages: []handler.MessageResponse{
 					{
 						ID:     &messageID,
@@ -61,6 +93,58 @@ func TestNewHandler(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:                      "messages processed successful with the provider result",
+			adapterGetMessageResponse: messages,
+			processResult:             approved,
+			wantResponse: handler.Response{
+				Result:  "Messages processed",
+				Batches: 1,
+				Messages: []handler.MessageResponse{
+					{
+						ID:      &messageID,
+						Status:  handler.MessageStatusSuccess,
+						Payment: &approved,
+					},
+				},
+			},
+		},
+		{
+			name:                      "messages processed with the provider result and delete error",
+			adapterGetMessageResponse: messages,
+			processResult:             approved,
+			adapterDeleteError:        perrors.NewCriticalError("failed to delete messages from SQS"),
+			wantResponse: handler.Response{
+				Result:  "Messages processed",
+				Batches: 1,
+				Messages: []handler.MessageResponse{
+					{
+						ID:      &messageID,
+						Status:  handler.MessageStatusCritical,
+						Error:   "failed to delete messages from SQS",
+						Payment: &approved,
+					},
+				},
+			},
+		},
+		{
+			name:                      "messages processed with error and the declined provider result",
+			adapterGetMessageResponse: messages,
+			processResult:             declined,
+			processError:              errors.New("test"),
+			wantResponse: handler.Response{
+				Result:  "Messages processed",
+				Batches: 1,
+				Messages: []handler.MessageResponse{
+					{
+						ID:      &messageID,
+						Status:  handler.MessageStatusError,
+						Error:   "failed to process the payment: test",
+						Payment: &declined,
+					},
+				},
+			},
+		},
 		{
 			name:                   "failed to return messages",
 			adapterGetMessageError: errors.New("test"),
@@ -73,12 +157,39 @@ func TestNewHandler(t *testing.T) {
 				Result: "No messages received",
 			},
 		},
+		{
+			name:                      "only quarantined messages",
+			adapterGetMessageResponse: message.Messages{},
+			adapterGetQuarantined:     quarantined,
+			wantResponse: handler.Response{
+				Result:      "Messages processed",
+				Batches:     1,
+				Quarantined: quarantined,
+			},
+		},
+		{
+			name:                      "messages processed with quarantined messages",
+			adapterGetMessageResponse: messages,
+			adapterGetQuarantined:     quarantined,
+			wantResponse: handler.Response{
+				Result:  "Messages processed",
+				Batches: 1,
+				Messages: []handler.MessageResponse{
+					{
+						ID:     &messageID,
+						Status: handler.MessageStatusSuccess,
+					},
+				},
+				Quarantined: quarantined,
+			},
+		},
 		{
 			name:                      "messages processed with error",
 			adapterGetMessageResponse: messages,
 			processError:              errors.New("test"),
 			wantResponse: handler.Response{
-				Result: "Messages processed",
+				Result:  "Messages processed",
+				Batches: 1,
 				Messages: []handler.MessageResponse{
 					{
 						ID:     &messageID,
@@ -93,7 +204,8 @@ func TestNewHandler(t *testing.T) {
 			adapterGetMessageResponse: messages,
 			providerEmpty:             true,
 			wantResponse: handler.Response{
-				Result: "Messages processed",
+				Result:  "Messages processed",
+				Batches: 1,
 				Messages: []handler.MessageResponse{
 					{
 						ID:     &messageID,
@@ -108,7 +220,8 @@ func TestNewHandler(t *testing.T) {
 			adapterGetMessageResponse: messages,
 			processError:              perrors.NewCriticalError("test"),
 			wantResponse: handler.Response{
-				Result: "Messages processed",
+				Result:  "Messages processed",
+				Batches: 1,
 				Messages: []handler.MessageResponse{
 					{
 						ID:     &messageID,
@@ -123,7 +236,8 @@ func TestNewHandler(t *testing.T) {
 			adapterGetMessageResponse: messages,
 			adapterDeleteError:        perrors.NewCriticalError("failed to delete messages from SQS"),
 			wantResponse: handler.Response{
-				Result: "Messages processed",
+				Result:  "Messages processed",
+				Batches: 1,
 				Messages: []handler.MessageResponse{
 					{
 						ID:     &messageID,
@@ -133,13 +247,105 @@ func TestNewHandler(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:                      "duplicated message acknowledged without processing the payment again",
+			adapterGetMessageResponse: messages,
+			storeRecord: &idempotency.Record{
+				Status: idempotency.StatusCompleted,
+				Result: approved,
+			},
+			processError: errors.New("provider must not be called"),
+			wantResponse: handler.Response{
+				Result:  "Messages processed",
+				Batches: 1,
+				Messages: []handler.MessageResponse{
+					{
+						ID:        &messageID,
+						Status:    handler.MessageStatusSuccess,
+						Payment:   &approved,
+						Duplicate: true,
+					},
+				},
+			},
+		},
+		{
+			name:                      "message with a payment in progress moved to the DLQ",
+			adapterGetMessageResponse: messages,
+			storeRecord: &idempotency.Record{
+				Status: idempotency.StatusInProgress,
+			},
+			wantResponse: handler.Response{
+				Result:  "Messages processed",
+				Batches: 1,
+				Messages: []handler.MessageResponse{
+					{
+						ID:     &messageID,
+						Status: handler.MessageStatusCritical,
+						Error:  handler.ErrCriticalPaymentInProgress.Error(),
+					},
+				},
+			},
+		},
+		{
+			name:                      "messages processed with idempotency store error",
+			adapterGetMessageResponse: messages,
+			storeError:                errors.New("test"),
+			wantResponse: handler.Response{
+				Result:  "Messages processed",
+				Batches: 1,
+				Messages: []handler.MessageResponse{
+					{
+						ID:     &messageID,
+						Status: handler.MessageStatusError,
+						Error:  "failed to check the idempotency of the payment: test",
+					},
+				},
+			},
+		},
+		{
+			name:                      "messages processed with validation error",
+			adapterGetMessageResponse: messages,
+			validationError:           invalid,
+			wantResponse: handler.Response{
+				Result:  "Messages processed",
+				Batches: 1,
+				Messages: []handler.MessageResponse{
+					{
+						ID:     &messageID,
+						Status: handler.MessageStatusInvalid,
+						Error:  "invalid message: order.id: is required",
+						ValidationErrors: []perrors.FieldError{
+							{Field: "order.id", Message: "is required"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name:                      "messages processed with validation and DLQ error",
+			adapterGetMessageResponse: messages,
+			validationError:           invalid,
+			adapterMoveDLQError:       errors.New("test"),
+			wantResponse: handler.Response{
+				Result:  "Messages processed",
+				Batches: 1,
+				Messages: []handler.MessageResponse{
+					{
+						ID:     &messageID,
+						Status: handler.MessageStatusError,
+						Error:  "problem to move the message to DLQ: invalid message: order.id: is required",
+					},
+				},
+			},
+		},
 		{
 			name:                      "messages processed with DLQ error",
 			adapterGetMessageResponse: messages,
 			processError:              perrors.NewCriticalError("test"),
 			adapterMoveDLQError:       errors.New("test"),
 			wantResponse: handler.Response{
-				Result: "Messages processed",
+				Result:  "Messages processed",
+				Batches: 1,
 				Messages: []handler.MessageResponse{
 					{
 						ID:     &messageID,
@@ -160,7 +366,7 @@ func TestNewHandler(t *testing.T) {
 			l.Out = ioutil.Discard
 
 			providerMock := new(provider.MockProvider)
-			providerMock.On("Process", mock.AnythingOfType("message.Message")).Return(tc.processError)
+			providerMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).Return(tc.processResult, tc.processError)
 
 			providerReturn := providerMock
 			if tc.providerEmpty {
@@ -171,11 +377,18 @@ func TestNewHandler(t *testing.T) {
 			providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerReturn)
 
 			mockAdapter := new(message.MockAdapter)
-			mockAdapter.On("GetMessages").Return(tc.adapterGetMessageResponse, tc.adapterGetMessageError)
-			mockAdapter.On("Delete", mock.Anything).Return(tc.adapterDeleteError)
-			mockAdapter.On("MoveToFailed", mock.Anything).Return(tc.adapterMoveDLQError)
+			mockAdapter.On("GetMessages", mock.Anything).
+				Return(tc.adapterGetMessageResponse, tc.adapterGetQuarantined, tc.adapterGetMessageError).Once()
+			mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{}, []message.Quarantined(nil), nil)
+			mockAdapter.On("DeleteBatch", mock.Anything, mock.Anything).Return([]error{tc.adapterDeleteError})
+			mockAdapter.On("MoveToFailedBatch", mock.Anything, mock.Anything).Return([]error{tc.adapterMoveDLQError})
+
+			mockValidator := new(validation.MockValidator)
+			mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(tc.validationError)
 
-			h := handler.NewHandler(l, providersMock, mockAdapter)
+			mockStore := newMockStore(tc.storeRecord, tc.storeError)
+
+			h := handler.NewHandler(&config.Config{}, l, providersMock, mockAdapter, mockValidator, mockStore)
 			resp, err := h.Handler(ctx, handler.Event{})
 
 			assert.Equal(t, tc.wantResponse, resp)
@@ -183,3 +396,1194 @@ func TestNewHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_Drain(t *testing.T) {
+	messageID := "message-id"
+	messages := message.Messages{
+		{
+			Id:       &messageID,
+			Provider: "Example",
+		},
+	}
+	success := handler.MessageResponse{
+		ID:     &messageID,
+		Status: handler.MessageStatusSuccess,
+	}
+
+	tests := []struct {
+		name         string
+		config       *config.Config
+		ctx          func() (context.Context, context.CancelFunc)
+		batches      []error
+		wantResponse handler.Response
+	}{
+		{
+			name:    "batches received until the queue is empty",
+			config:  &config.Config{},
+			batches: []error{nil, nil, nil},
+			wantResponse: handler.Response{
+				Result:   "Messages processed",
+				Batches:  3,
+				Messages: []handler.MessageResponse{success, success, success},
+			},
+		},
+		{
+			name:    "batches received until the maximum number of batches",
+			config:  &config.Config{HandlerMaxBatches: 2},
+			batches: []error{nil, nil, nil},
+			wantResponse: handler.Response{
+				Result:   "Messages processed",
+				Batches:  2,
+				Messages: []handler.MessageResponse{success, success},
+			},
+		},
+		{
+			name:    "batches received until a read error",
+			config:  &config.Config{},
+			batches: []error{nil, errors.New("test")},
+			wantResponse: handler.Response{
+				Result:   "Messages processed",
+				Batches:  1,
+				Messages: []handler.MessageResponse{success},
+			},
+		},
+		{
+			name:   "only the first batch received when the deadline is near",
+			config: &config.Config{HandlerDeadlineMargin: time.Minute},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 30*time.Second)
+			},
+			batches: []error{nil, nil},
+			wantResponse: handler.Response{
+				Result:   "Messages processed",
+				Batches:  1,
+				Messages: []handler.MessageResponse{success},
+			},
+		},
+		{
+			name:   "no batch received when the invocation is canceled",
+			config: &config.Config{},
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx, cancel
+			},
+			batches: []error{nil},
+			wantResponse: handler.Response{
+				Result: "No messages received",
+			},
+		},
+		{
+			name:   "batches received when there is time before the deadline",
+			config: &config.Config{HandlerDeadlineMargin: time.Second},
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Minute)
+			},
+			batches: []error{nil},
+			wantResponse: handler.Response{
+				Result:   "Messages processed",
+				Batches:  1,
+				Messages: []handler.MessageResponse{success},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l := log.New()
+			l.Out = ioutil.Discard
+
+			providerMock := new(provider.MockProvider)
+			providerMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).Return(provider.ProcessResult{}, nil)
+
+			providersMock := new(provider.MockProviderList)
+			providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerMock)
+
+			mockAdapter := new(message.MockAdapter)
+			for _, err := range tc.batches {
+				batch := messages
+				if err != nil {
+					batch = nil
+				}
+				mockAdapter.On("GetMessages", mock.Anything).Return(batch, []message.Quarantined(nil), err).Once()
+			}
+			mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{}, []message.Quarantined(nil), nil)
+			mockAdapter.On("DeleteBatch", mock.Anything, mock.Anything).Return([]error{nil})
+
+			mockValidator := new(validation.MockValidator)
+			mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+			mockStore := newMockStore(nil, nil)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if tc.ctx != nil {
+				ctx, cancel = tc.ctx()
+			}
+			defer cancel()
+
+			h := handler.NewHandler(tc.config, l, providersMock, mockAdapter, mockValidator, mockStore)
+			resp, err := h.Handler(ctx, handler.Event{})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.wantResponse, resp)
+		})
+	}
+}
+
+func TestHandler_DrainReleased(t *testing.T) {
+	released := "released-id"
+	processed := "processed-id"
+	releasedMessage := message.Message{Id: &released, Provider: "Example", Order: message.Order{Id: "released"}}
+	processedMessage := message.Message{Id: &processed, Provider: "Example", Order: message.Order{Id: "processed"}}
+
+	tests := []struct {
+		name        string
+		batch       message.Messages
+		wantBatches int
+	}{
+		{
+			name:        "stop receiving when the whole batch is released",
+			batch:       message.Messages{releasedMessage},
+			wantBatches: 1,
+		},
+		{
+			name:        "keep receiving when a message of the batch is processed",
+			batch:       message.Messages{releasedMessage, processedMessage},
+			wantBatches: 3,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l := log.New()
+			l.Out = ioutil.Discard
+
+			providerMock := new(provider.MockProvider)
+			providerMock.On("Process", mock.Anything, mock.MatchedBy(func(m message.Message) bool { return m.Order.Id == "released" })).
+				Return(provider.ProcessResult{}, perrors.NewReleaseError(perrors.ReleaseCircuitOpen, time.Second, errors.New("test")))
+			providerMock.On("Process", mock.Anything, mock.MatchedBy(func(m message.Message) bool { return m.Order.Id == "processed" })).
+				Return(provider.ProcessResult{}, nil)
+
+			providersMock := new(provider.MockProviderList)
+			providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerMock)
+
+			mockAdapter := new(message.MockAdapter)
+			mockAdapter.On("GetMessages", mock.Anything).Return(tc.batch, []message.Quarantined(nil), nil).Times(3)
+			mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{}, []message.Quarantined(nil), nil)
+			mockAdapter.On("DeleteBatch", mock.Anything, mock.Anything).Return([]error{nil})
+			mockAdapter.On("ChangeVisibility", mock.Anything, &released, time.Second).Return(nil)
+
+			mockValidator := new(validation.MockValidator)
+			mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+			h := handler.NewHandler(&config.Config{}, l, providersMock, mockAdapter, mockValidator, newMockStore(nil, nil))
+			resp, err := h.Handler(context.TODO(), handler.Event{})
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.wantBatches, resp.Batches)
+		})
+	}
+}
+
+func TestHandler_Context(t *testing.T) {
+	messageID := "message-id"
+	l := log.New()
+	l.Out = ioutil.Discard
+
+	withRequestID := mock.MatchedBy(func(ctx context.Context) bool {
+		return trace.RequestID(ctx) == "request-1"
+	})
+
+	providerMock := new(provider.MockProvider)
+	providerMock.On("Process", withRequestID, mock.AnythingOfType("message.Message")).Return(provider.ProcessResult{}, nil)
+
+	providersMock := new(provider.MockProviderList)
+	providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerMock)
+
+	mockAdapter := new(message.MockAdapter)
+	mockAdapter.On("GetMessages", withRequestID).
+		Return(message.Messages{{Id: &messageID, Provider: "Example"}}, []message.Quarantined(nil), nil).Once()
+	mockAdapter.On("GetMessages", withRequestID).Return(message.Messages{}, []message.Quarantined(nil), nil)
+	mockAdapter.On("DeleteBatch", withRequestID, []*string{&messageID}).Return([]error{nil})
+
+	mockValidator := new(validation.MockValidator)
+	mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+	mockStore := newMockStore(nil, nil)
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-1"})
+
+	h := handler.NewHandler(&config.Config{}, l, providersMock, mockAdapter, mockValidator, mockStore)
+	_, err := h.Handler(ctx, handler.Event{})
+
+	assert.Nil(t, err)
+	providerMock.AssertExpectations(t)
+	mockAdapter.AssertExpectations(t)
+}
+
+func TestHandler_MaxAttempts(t *testing.T) {
+	messageID := "message-id"
+
+	tests := []struct {
+		name                string
+		receiveCount        int
+		maxAttempts         int
+		processError        error
+		providerEmpty       bool
+		adapterMoveDLQError error
+		wantMoveToFailed    bool
+		wantMessage         handler.MessageResponse
+	}{
+		{
+			name:         "attempts left",
+			receiveCount: 4,
+			maxAttempts:  5,
+			processError: errors.New("test"),
+			wantMessage: handler.MessageResponse{
+				ID:     &messageID,
+				Status: handler.MessageStatusError,
+				Error:  "failed to process the payment: test",
+			},
+		},
+		{
+			name:         "no attempts limit",
+			receiveCount: 50,
+			processError: errors.New("test"),
+			wantMessage: handler.MessageResponse{
+				ID:     &messageID,
+				Status: handler.MessageStatusError,
+				Error:  "failed to process the payment: test",
+			},
+		},
+		{
+			name:             "attempts exhausted",
+			receiveCount:     5,
+			maxAttempts:      5,
+			processError:     errors.New("test"),
+			wantMoveToFailed: true,
+			wantMessage: handler.MessageResponse{
+				ID:     &messageID,
+				Status: handler.MessageStatusExhausted,
+				Error:  "attempts exhausted after 5 receives: failed to process the payment: test",
+			},
+		},
+		{
+			name:         "released after the maximum attempts",
+			receiveCount: 6,
+			maxAttempts:  5,
+			processError: perrors.NewReleaseError(perrors.ReleaseCircuitOpen, 0, errors.New("test")),
+			wantMessage: handler.MessageResponse{
+				ID:     &messageID,
+				Status: handler.MessageStatusCircuitOpen,
+				Error:  "message released (circuit_open): test",
+			},
+		},
+		{
+			name:             "attempts exhausted with provider not available",
+			receiveCount:     6,
+			maxAttempts:      5,
+			providerEmpty:    true,
+			wantMoveToFailed: true,
+			wantMessage: handler.MessageResponse{
+				ID:     &messageID,
+				Status: handler.MessageStatusExhausted,
+				Error:  "attempts exhausted after 6 receives: provider Example not available to process this message",
+			},
+		},
+		{
+			name:                "attempts exhausted with DLQ error",
+			receiveCount:        5,
+			maxAttempts:         5,
+			processError:        errors.New("test"),
+			adapterMoveDLQError: errors.New("test"),
+			wantMoveToFailed:    true,
+			wantMessage: handler.MessageResponse{
+				ID:     &messageID,
+				Status: handler.MessageStatusError,
+				Error:  "problem to move the message to DLQ: attempts exhausted after 5 receives: failed to process the payment: test",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l := log.New()
+			l.Out = ioutil.Discard
+
+			providerMock := new(provider.MockProvider)
+			providerMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).Return(provider.ProcessResult{}, tc.processError)
+
+			providerReturn := providerMock
+			if tc.providerEmpty {
+				providerReturn = nil
+			}
+
+			providersMock := new(provider.MockProviderList)
+			providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerReturn)
+
+			m := message.Message{Id: &messageID, Provider: "Example", Metadata: message.Metadata{ReceiveCount: tc.receiveCount}}
+			mockAdapter := new(message.MockAdapter)
+			mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{m}, []message.Quarantined(nil), nil).Once()
+			mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{}, []message.Quarantined(nil), nil)
+			exhausted := mock.MatchedBy(func(failed []message.Failed) bool {
+				if len(failed) != 1 {
+					return false
+				}
+				_, ok := failed[0].Reason.(*perrors.AttemptsExhaustedError)
+				return failed[0].Message.Id == m.Id && ok
+			})
+			mockAdapter.On("MoveToFailedBatch", mock.Anything, exhausted).Return([]error{tc.adapterMoveDLQError})
+
+			mockValidator := new(validation.MockValidator)
+			mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+			mockStore := newMockStore(nil, nil)
+
+			h := handler.NewHandler(&config.Config{MaxAttempts: tc.maxAttempts}, l, providersMock, mockAdapter, mockValidator, mockStore)
+			resp, err := h.Handler(context.TODO(), handler.Event{})
+
+			assert.Nil(t, err)
+			assert.Equal(t, []handler.MessageResponse{tc.wantMessage}, resp.Messages)
+			if tc.wantMoveToFailed {
+				mockAdapter.AssertCalled(t, "MoveToFailedBatch", mock.Anything, exhausted)
+			} else {
+				mockAdapter.AssertNotCalled(t, "MoveToFailedBatch", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestHandler_Backoff(t *testing.T) {
+	messageID := "message-id"
+
+	tests := []struct {
+		name             string
+		receiveCount     int
+		changeError      error
+		wantChange       bool
+		wantMin, wantMax time.Duration
+	}{
+		{
+			name:         "first retry delayed by the base",
+			receiveCount: 1,
+			wantChange:   true,
+			wantMin:      5 * time.Second,
+			wantMax:      10 * time.Second,
+		},
+		{
+			name:         "retry delayed exponentially",
+			receiveCount: 3,
+			wantChange:   true,
+			wantMin:      20 * time.Second,
+			wantMax:      40 * time.Second,
+		},
+		{
+			name:         "retry delay failed",
+			receiveCount: 2,
+			changeError:  errors.New("test"),
+			wantChange:   true,
+			wantMin:      10 * time.Second,
+			wantMax:      20 * time.Second,
+		},
+		{
+			name:         "attempts exhausted not delayed",
+			receiveCount: 5,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l := log.New()
+			l.Out = ioutil.Discard
+
+			providerMock := new(provider.MockProvider)
+			providerMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).Return(provider.ProcessResult{}, errors.New("test"))
+
+			providersMock := new(provider.MockProviderList)
+			providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerMock)
+
+			m := message.Message{Id: &messageID, Provider: "Example", Metadata: message.Metadata{ReceiveCount: tc.receiveCount}}
+			mockAdapter := new(message.MockAdapter)
+			mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{m}, []message.Quarantined(nil), nil).Once()
+			mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{}, []message.Quarantined(nil), nil)
+			mockAdapter.On("MoveToFailedBatch", mock.Anything, mock.Anything).Return([]error{nil})
+			mockAdapter.On("ChangeVisibility", mock.Anything, &messageID, mock.AnythingOfType("time.Duration")).Return(tc.changeError)
+
+			mockValidator := new(validation.MockValidator)
+			mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+			c := &config.Config{MaxAttempts: 5, RetryBackoffBase: 10 * time.Second, RetryBackoffMax: time.Minute}
+			h := handler.NewHandler(c, l, providersMock, mockAdapter, mockValidator, newMockStore(nil, nil))
+			resp, err := h.Handler(context.TODO(), handler.Event{})
+
+			assert.Nil(t, err)
+			if !tc.wantChange {
+				mockAdapter.AssertNotCalled(t, "ChangeVisibility", mock.Anything, mock.Anything, mock.Anything)
+				assert.Equal(t, handler.MessageStatusExhausted, resp.Messages[0].Status)
+				return
+			}
+			assert.Equal(t, handler.MessageStatusError, resp.Messages[0].Status)
+			mockAdapter.AssertNumberOfCalls(t, "ChangeVisibility", 1)
+			for _, call := range mockAdapter.Calls {
+				if call.Method == "ChangeVisibility" {
+					d := call.Arguments.Get(2).(time.Duration)
+					assert.True(t, d >= tc.wantMin && d <= tc.wantMax, "delay %s out of [%s, %s]", d, tc.wantMin, tc.wantMax)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_Failover(t *testing.T) {
+	messageID := "message-id"
+	approved := provider.ProcessResult{TransactionID: "tx-2", Status: provider.PaymentStatusApproved}
+	declined := provider.ProcessResult{TransactionID: "tx-2", Status: provider.PaymentStatusDeclined}
+	captured := provider.ProcessResult{TransactionID: "tx-1"}
+
+	tests := []struct {
+		name          string
+		paymentMethod string
+		primaryResult provider.ProcessResult
+		primaryError  error
+		backupResult  provider.ProcessResult
+		backupError   error
+		backupEmpty   bool
+		wantStatus    string
+		wantPayment   *provider.ProcessResult
+		wantAttempts  []handler.Attempt
+	}{
+		{
+			name:          "payment approved by the backup provider after a connection failure",
+			paymentMethod: "credit_card",
+			primaryError:  provider.ErrConnectionFailed,
+			backupResult:  approved,
+			wantStatus:    handler.MessageStatusSuccess,
+			wantPayment:   &approved,
+			wantAttempts: []handler.Attempt{
+				{Provider: "Example", Error: provider.ErrConnectionFailed.Error()},
+				{Provider: "Backup", Status: provider.PaymentStatusApproved, Failover: true},
+			},
+		},
+		{
+			name:          "payment declined by the backup provider after an outage",
+			paymentMethod: "credit_card",
+			primaryError:  provider.ErrProviderUnavailable,
+			backupResult:  declined,
+			backupError:   provider.ErrFailProcessPayment,
+			wantStatus:    handler.MessageStatusError,
+			wantPayment:   &declined,
+			wantAttempts: []handler.Attempt{
+				{Provider: "Example", Error: provider.ErrProviderUnavailable.Error()},
+				{Provider: "Backup", Status: provider.PaymentStatusDeclined, Error: provider.ErrFailProcessPayment.Error(), Failover: true},
+			},
+		},
+		{
+			name:          "all providers of the chain unavailable",
+			paymentMethod: "credit_card",
+			primaryError:  provider.ErrProviderUnavailable,
+			backupError:   provider.ErrConnectionFailed,
+			wantStatus:    handler.MessageStatusError,
+			wantAttempts: []handler.Attempt{
+				{Provider: "Example", Error: provider.ErrProviderUnavailable.Error()},
+				{Provider: "Backup", Error: provider.ErrConnectionFailed.Error(), Failover: true},
+			},
+		},
+		{
+			name:          "no failover when the primary provider may have captured",
+			paymentMethod: "credit_card",
+			primaryResult: captured,
+			primaryError:  provider.ErrProviderUnavailable,
+			wantStatus:    handler.MessageStatusError,
+			wantAttempts: []handler.Attempt{
+				{Provider: "Example", Error: provider.ErrProviderUnavailable.Error()},
+			},
+		},
+		{
+			name:          "no failover when the outcome of the request is uncertain",
+			paymentMethod: "credit_card",
+			primaryError:  provider.ErrFailedRequest,
+			wantStatus:    handler.MessageStatusError,
+			wantAttempts: []handler.Attempt{
+				{Provider: "Example", Error: provider.ErrFailedRequest.Error()},
+			},
+		},
+		{
+			name:          "no failover on a declined payment",
+			paymentMethod: "credit_card",
+			primaryResult: declined,
+			primaryError:  provider.ErrFailProcessPayment,
+			wantStatus:    handler.MessageStatusError,
+			wantPayment:   &declined,
+			wantAttempts: []handler.Attempt{
+				{Provider: "Example", Status: provider.PaymentStatusDeclined, Error: provider.ErrFailProcessPayment.Error()},
+			},
+		},
+		{
+			name:          "no failover on a critical error",
+			paymentMethod: "credit_card",
+			primaryError:  provider.ErrCriticalProviderInternal,
+			wantStatus:    handler.MessageStatusCritical,
+			wantAttempts: []handler.Attempt{
+				{Provider: "Example", Error: provider.ErrCriticalProviderInternal.Error()},
+			},
+		},
+		{
+			name:          "backup provider not available",
+			paymentMethod: "credit_card",
+			primaryError:  provider.ErrConnectionFailed,
+			backupEmpty:   true,
+			wantStatus:    handler.MessageStatusError,
+			wantAttempts: []handler.Attempt{
+				{Provider: "Example", Error: provider.ErrConnectionFailed.Error()},
+			},
+		},
+		{
+			name:          "payment method without failover chain",
+			paymentMethod: "pix",
+			primaryError:  provider.ErrConnectionFailed,
+			wantStatus:    handler.MessageStatusError,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l := log.New()
+			l.Out = ioutil.Discard
+
+			primaryMock := new(provider.MockProvider)
+			primaryMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).Return(tc.primaryResult, tc.primaryError)
+			backupMock := new(provider.MockProvider)
+			backupMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).Return(tc.backupResult, tc.backupError)
+			backupReturn := backupMock
+			if tc.backupEmpty {
+				backupReturn = nil
+			}
+
+			providersMock := new(provider.MockProviderList)
+			providersMock.On("GetByMessage", mock.MatchedBy(func(m message.Message) bool { return m.Provider == "Example" })).Return(primaryMock)
+			providersMock.On("GetByMessage", mock.MatchedBy(func(m message.Message) bool { return m.Provider == "Backup" })).Return(backupReturn)
+
+			m := message.Message{Id: &messageID, Provider: "Example", Order: message.Order{Id: "1", PaymentMethod: tc.paymentMethod}}
+			mockAdapter := new(message.MockAdapter)
+			mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{m}, []message.Quarantined(nil), nil).Once()
+			mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{}, []message.Quarantined(nil), nil)
+			mockAdapter.On("DeleteBatch", mock.Anything, mock.Anything).Return([]error{nil})
+			mockAdapter.On("MoveToFailedBatch", mock.Anything, mock.Anything).Return([]error{nil})
+
+			mockValidator := new(validation.MockValidator)
+			mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+			c := &config.Config{ProviderFailover: map[string]string{"credit_card": "Example|Backup"}}
+			h := handler.NewHandler(c, l, providersMock, mockAdapter, mockValidator, newMockStore(nil, nil))
+			resp, err := h.Handler(context.TODO(), handler.Event{})
+
+			assert.Nil(t, err)
+			if !assert.Len(t, resp.Messages, 1) {
+				return
+			}
+			mr := resp.Messages[0]
+			assert.Equal(t, tc.wantStatus, mr.Status)
+			assert.Equal(t, tc.wantPayment, mr.Payment)
+			assert.Equal(t, tc.wantAttempts, mr.Attempts)
+			if len(tc.wantAttempts) < 2 {
+				backupMock.AssertNotCalled(t, "Process", mock.Anything, mock.Anything)
+			} else {
+				backupMock.AssertCalled(t, "Process", mock.Anything, mock.MatchedBy(func(m message.Message) bool {
+					return m.Provider == "Backup" && m.Order.Id == "1"
+				}))
+			}
+		})
+	}
+}
+
+func TestHandler_Routing(t *testing.T) {
+	ids := []string{"message-1", "message-2", "message-3"}
+	messages := message.Messages{
+		{Id: &ids[0], Provider: provider.ProviderAuto, Order: message.Order{Id: "1"}},
+		{Id: &ids[1], Order: message.Order{Id: "2"}},
+		{Id: &ids[2], Provider: "Example", Order: message.Order{Id: "3"}},
+	}
+
+	l := log.New()
+	l.Out = ioutil.Discard
+
+	// The calls of the provider are tracked to check its concurrency limit
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	providerMock := new(provider.MockProvider)
+	providerMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).
+		Return(provider.ProcessResult{}, perrors.NewCriticalError("test")).
+		Run(func(args mock.Arguments) {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+		})
+	router, err := provider.NewRouter(provider.Providers{"Example": providerMock}, provider.Rules{Fallback: "Example"})
+	assert.Nil(t, err)
+
+	mockAdapter := new(message.MockAdapter)
+	mockAdapter.On("GetMessages", mock.Anything).Return(messages, []message.Quarantined(nil), nil).Once()
+	mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{}, []message.Quarantined(nil), nil)
+	mockAdapter.On("MoveToFailedBatch", mock.Anything, mock.Anything).Return([]error{nil, nil, nil})
+
+	mockValidator := new(validation.MockValidator)
+	mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+	c := &config.Config{HandlerConcurrency: 10, ProviderConcurrency: map[string]int{"Example": 1}}
+	h := handler.NewHandler(c, l, router, mockAdapter, mockValidator, newMockStore(nil, nil))
+	resp, err := h.Handler(context.TODO(), handler.Event{})
+
+	// The routed messages share the concurrency limit and the DLQ provider of the chosen provider
+	assert.Nil(t, err)
+	assert.Len(t, resp.Messages, 3)
+	assert.Equal(t, 1, maxActive)
+	for _, call := range mockAdapter.Calls {
+		if call.Method == "MoveToFailedBatch" {
+			failed := call.Arguments.Get(1).([]message.Failed)
+			if assert.Len(t, failed, 3) {
+				for _, f := range failed {
+					assert.Equal(t, "Example", f.Message.ResolvedProvider())
+				}
+			}
+		}
+	}
+}
+
+func TestHandler_CircuitBreaker(t *testing.T) {
+	ids := []string{"message-1", "message-2"}
+	messages := message.Messages{
+		{Id: &ids[0], Provider: "Example", Order: message.Order{Id: "1"}},
+		{Id: &ids[1], Provider: "Example", Order: message.Order{Id: "2"}},
+	}
+
+	var out bytes.Buffer
+	l := log.New()
+	l.Out = &out
+	l.Formatter = &log.JSONFormatter{}
+
+	providerMock := new(provider.MockProvider)
+	providerMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).Return(provider.ProcessResult{}, provider.ErrFailedRequest)
+
+	c := &config.Config{MaxAttempts: 5, ProviderBreakerThreshold: 1, ProviderBreakerCooldown: time.Minute, MetricsNamespace: "Payments"}
+	providers := provider.NewBreakers(c, l, provider.Providers{"Example": providerMock})
+
+	mockAdapter := new(message.MockAdapter)
+	mockAdapter.On("GetMessages", mock.Anything).Return(messages, []message.Quarantined(nil), nil).Once()
+	mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{}, []message.Quarantined(nil), nil)
+	mockAdapter.On("ChangeVisibility", mock.Anything, &ids[1], mock.AnythingOfType("time.Duration")).Return(nil)
+
+	mockValidator := new(validation.MockValidator)
+	mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+	h := handler.NewHandler(c, l, providers, mockAdapter, mockValidator, newMockStore(nil, nil))
+	resp, err := h.Handler(context.TODO(), handler.Event{})
+
+	// The first failure opens the circuit, the second message is released without calling the provider
+	assert.Nil(t, err)
+	if !assert.Len(t, resp.Messages, 2) {
+		return
+	}
+	assert.Equal(t, handler.MessageStatusError, resp.Messages[0].Status)
+	assert.Equal(t, handler.MessageStatusCircuitOpen, resp.Messages[1].Status)
+	assert.Equal(t, "message released (circuit_open): the circuit breaker of the provider Example is open", resp.Messages[1].Error)
+	providerMock.AssertNumberOfCalls(t, "Process", 1)
+	mockAdapter.AssertNotCalled(t, "MoveToFailedBatch", mock.Anything, mock.Anything)
+	mockAdapter.AssertNumberOfCalls(t, "ChangeVisibility", 1)
+	for _, call := range mockAdapter.Calls {
+		if call.Method == "ChangeVisibility" && call.Arguments.Get(1) == &ids[1] {
+			d := call.Arguments.Get(2).(time.Duration)
+			assert.True(t, d > 59*time.Second && d <= time.Minute, "delay %s", d)
+		}
+	}
+
+	// The breaker state is logged and published as metrics
+	assert.Contains(t, out.String(), `"msg":"circuit breaker state changed"`)
+	assert.Contains(t, out.String(), `"CircuitOpen":1`)
+	assert.Contains(t, out.String(), `"CircuitRejected":1`)
+	assert.Contains(t, out.String(), `"Namespace":"Payments"`)
+}
+
+func TestHandler_Acknowledge(t *testing.T) {
+	ids := []string{"message-1", "message-2", "message-3"}
+	messages := message.Messages{
+		{Id: &ids[0], Provider: "Example", Order: message.Order{Id: "1"}},
+		{Id: &ids[1], Provider: "Example", Order: message.Order{Id: "2"}},
+		{Id: &ids[2], Provider: "Example", Order: message.Order{Id: "3"}},
+	}
+	approved := provider.ProcessResult{TransactionID: "tx-1", Status: provider.PaymentStatusApproved}
+	order := func(id string) interface{} {
+		return mock.MatchedBy(func(m message.Message) bool { return m.Order.Id == id })
+	}
+
+	l := log.New()
+	l.Out = ioutil.Discard
+
+	providerMock := new(provider.MockProvider)
+	providerMock.On("Process", mock.Anything, order("1")).Return(approved, nil)
+	providerMock.On("Process", mock.Anything, order("2")).Return(approved, nil)
+	providerMock.On("Process", mock.Anything, order("3")).Return(provider.ProcessResult{}, perrors.NewCriticalError("test"))
+
+	providersMock := new(provider.MockProviderList)
+	providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerMock)
+
+	// The second message fails to be deleted and is moved to the DLQ with the third one, which fails to be moved
+	mockAdapter := new(message.MockAdapter)
+	mockAdapter.On("GetMessages", mock.Anything).Return(messages, []message.Quarantined(nil), nil).Once()
+	mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{}, []message.Quarantined(nil), nil)
+	mockAdapter.On("DeleteBatch", mock.Anything, []*string{&ids[0], &ids[1]}).
+		Return([]error{nil, perrors.NewCriticalError("failed to delete messages from SQS")})
+	moved := mock.MatchedBy(func(failed []message.Failed) bool {
+		return len(failed) == 2 && failed[0].Message.Id == &ids[1] && failed[1].Message.Id == &ids[2]
+	})
+	mockAdapter.On("MoveToFailedBatch", mock.Anything, moved).Return([]error{nil, errors.New("test")})
+
+	mockValidator := new(validation.MockValidator)
+	mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+	h := handler.NewHandler(&config.Config{HandlerConcurrency: 3}, l, providersMock, mockAdapter, mockValidator, newMockStore(nil, nil))
+	resp, err := h.Handler(context.TODO(), handler.Event{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []handler.MessageResponse{
+		{ID: &ids[0], Status: handler.MessageStatusSuccess, Payment: &approved},
+		{ID: &ids[1], Status: handler.MessageStatusCritical, Error: "failed to delete messages from SQS", Payment: &approved},
+		{ID: &ids[2], Status: handler.MessageStatusError, Error: "problem to move the message to DLQ: test"},
+	}, resp.Messages)
+	mockAdapter.AssertNumberOfCalls(t, "DeleteBatch", 1)
+	mockAdapter.AssertNumberOfCalls(t, "MoveToFailedBatch", 1)
+}
+
+// TestHandler_LocalAdapter exercises the handler end to end with a local queue
+func TestHandler_LocalAdapter(t *testing.T) {
+	ctx := context.TODO()
+	adapter := message.NewMemoryAdapter(&config.Config{SqsMaxNumberOfMessages: 10})
+	for _, body := range []string{
+		`{"provider":"Example","order":{"id":"1"}}`,
+		`{"provider":"Example","order":{"id":"2"}}`,
+		`{"provider":"Example","order":{"id":"3"}}`,
+		`this is not a valid json body`,
+	} {
+		_, err := adapter.Send(ctx, body, nil)
+		assert.Nil(t, err)
+	}
+	approved := provider.ProcessResult{TransactionID: "tx-1", Status: provider.PaymentStatusApproved}
+	order := func(id string) interface{} {
+		return mock.MatchedBy(func(m message.Message) bool { return m.Order.Id == id })
+	}
+
+	l := log.New()
+	l.Out = ioutil.Discard
+
+	providerMock := new(provider.MockProvider)
+	providerMock.On("Process", mock.Anything, order("1")).Return(approved, nil)
+	providerMock.On("Process", mock.Anything, order("2")).Return(provider.ProcessResult{}, perrors.NewCriticalError("test"))
+	providerMock.On("Process", mock.Anything, order("3")).Return(provider.ProcessResult{}, errors.New("timeout"))
+
+	providersMock := new(provider.MockProviderList)
+	providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerMock)
+
+	mockValidator := new(validation.MockValidator)
+	mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+	c := &config.Config{HandlerConcurrency: 3, MaxAttempts: 5}
+	h := handler.NewHandler(c, l, providersMock, adapter, mockValidator, idempotency.NewMemoryStore())
+	resp, err := h.Handler(ctx, handler.Event{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, resp.Batches)
+	assert.Len(t, resp.Quarantined, 1)
+	statuses := make(map[string]int)
+	for _, mr := range resp.Messages {
+		statuses[mr.Status]++
+	}
+	assert.Equal(t, map[string]int{
+		handler.MessageStatusSuccess:  1,
+		handler.MessageStatusCritical: 1,
+		handler.MessageStatusError:    1,
+	}, statuses)
+
+	// The failed payment waits in the queue for a new attempt, the critical and the undecodable ones are on the DLQ
+	stored, err := adapter.Messages(ctx)
+	assert.Nil(t, err)
+	if assert.Len(t, stored, 1) {
+		assert.Equal(t, `{"provider":"Example","order":{"id":"3"}}`, stored[0].Body)
+		assert.Equal(t, 1, stored[0].ReceiveCount)
+	}
+	deadLetters, err := adapter.DeadLetters(ctx)
+	assert.Nil(t, err)
+	classes := make(map[string]int)
+	for _, dl := range deadLetters {
+		classes[dl.Attributes[message.AttributeErrorClass]]++
+	}
+	assert.Equal(t, map[string]int{message.ErrorClassCritical: 1, message.ErrorClassUndecodable: 1}, classes)
+}
+
+func TestHandler_Heartbeat(t *testing.T) {
+	messageID := "message-id"
+
+	tests := []struct {
+		name          string
+		interval      time.Duration
+		max           time.Duration
+		visibility    time.Duration
+		visibilityErr error
+		wantTimeout   time.Duration
+		wantMin       int
+		wantMax       int
+	}{
+		{
+			name:        "visibility extended while the payment is processed",
+			interval:    10 * time.Millisecond,
+			max:         time.Minute,
+			wantTimeout: 20 * time.Millisecond,
+			wantMin:     2,
+			wantMax:     10,
+		},
+		{
+			name:        "visibility extended by the visibility timeout of the queue when it's longer",
+			interval:    10 * time.Millisecond,
+			max:         time.Minute,
+			visibility:  5 * time.Minute,
+			wantTimeout: 5 * time.Minute,
+			wantMin:     2,
+			wantMax:     10,
+		},
+		{
+			name:        "visibility extended by two intervals when the visibility timeout of the queue is shorter",
+			interval:    10 * time.Millisecond,
+			max:         time.Minute,
+			visibility:  time.Millisecond,
+			wantTimeout: 20 * time.Millisecond,
+			wantMin:     2,
+			wantMax:     10,
+		},
+		{
+			name:        "visibility extended until the ceiling",
+			interval:    10 * time.Millisecond,
+			max:         15 * time.Millisecond,
+			wantTimeout: 20 * time.Millisecond,
+			wantMin:     1,
+			wantMax:     2,
+		},
+		{
+			name:          "visibility not extended without the visibility timeout of the queue",
+			interval:      10 * time.Millisecond,
+			max:           time.Minute,
+			visibilityErr: errors.New("access denied"),
+			wantMin:       0,
+			wantMax:       0,
+		},
+		{
+			name:    "heartbeat disabled",
+			max:     time.Minute,
+			wantMin: 0,
+			wantMax: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l := log.New()
+			l.Out = ioutil.Discard
+
+			providerMock := new(provider.MockProvider)
+			providerMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).
+				Return(provider.ProcessResult{}, nil).After(80 * time.Millisecond)
+
+			providersMock := new(provider.MockProviderList)
+			providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerMock)
+
+			mockAdapter := new(message.MockAdapter)
+			mockAdapter.On("GetMessages", mock.Anything).
+				Return(message.Messages{{Id: &messageID, Provider: "Example"}}, []message.Quarantined(nil), nil).Once()
+			mockAdapter.On("GetMessages", mock.Anything).Return(message.Messages{}, []message.Quarantined(nil), nil)
+			mockAdapter.On("DeleteBatch", mock.Anything, mock.Anything).Return([]error{nil})
+			mockAdapter.On("ChangeVisibility", mock.Anything, &messageID, tc.wantTimeout).Return(nil)
+			mockAdapter.On("VisibilityTimeout", mock.Anything).Return(tc.visibility, tc.visibilityErr)
+
+			mockValidator := new(validation.MockValidator)
+			mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+			c := &config.Config{
+				VisibilityHeartbeatInterval: tc.interval,
+				VisibilityHeartbeatMax:      tc.max,
+			}
+			h := handler.NewHandler(c, l, providersMock, mockAdapter, mockValidator, newMockStore(nil, nil))
+			_, err := h.Handler(context.TODO(), handler.Event{})
+			assert.Nil(t, err)
+
+			extensions := countCalls(mockAdapter, "ChangeVisibility")
+			assert.True(t, extensions >= tc.wantMin && extensions <= tc.wantMax, "%d extensions", extensions)
+
+			// The heartbeat is stopped with the processing round
+			time.Sleep(3 * tc.interval)
+			assert.Equal(t, extensions, countCalls(mockAdapter, "ChangeVisibility"))
+		})
+	}
+}
+
+// countCalls returns the number of calls of the mocked method
+func countCalls(m *message.MockAdapter, method string) int {
+	n := 0
+	for _, call := range m.Calls {
+		if call.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSQSHandler(t *testing.T) {
+	records := []events.SQSMessage{
+		{
+			MessageId:     "message-1",
+			ReceiptHandle: "receipt-1",
+			Body:          `{"provider":"Example"}`,
+		},
+	}
+
+	tests := []struct {
+		name                   string
+		records                []events.SQSMessage
+		adapterMoveDLQError    error
+		adapterQuarantineError error
+		validationError        error
+		storeRecord            *idempotency.Record
+		storeError             error
+		processResult          provider.ProcessResult
+		processError           error
+		providerEmpty          bool
+		wantResponse           events.SQSEventResponse
+	}{
+		{
+			name: "messages processed successful",
+			records: []events.SQSMessage{
+				records[0],
+				{
+					MessageId:     "message-2",
+					ReceiptHandle: "receipt-2",
+					Body:          `{"provider":"Example"}`,
+				},
+			},
+			wantResponse: events.SQSEventResponse{
+				BatchItemFailures: []events.SQSBatchItemFailure{},
+			},
+		},
+		{
+			name: "message with invalid body quarantined",
+			records: []events.SQSMessage{
+				records[0],
+				{
+					MessageId:     "message-2",
+					ReceiptHandle: "receipt-2",
+					Body:          `this is not a valid json body`,
+				},
+			},
+			wantResponse: events.SQSEventResponse{
+				BatchItemFailures: []events.SQSBatchItemFailure{},
+			},
+		},
+		{
+			name: "message with invalid body reported as failure when the quarantine fails",
+			records: []events.SQSMessage{
+				records[0],
+				{
+					MessageId:     "message-2",
+					ReceiptHandle: "receipt-2",
+					Body:          `this is not a valid json body`,
+				},
+			},
+			adapterQuarantineError: errors.New("test"),
+			wantResponse: events.SQSEventResponse{
+				BatchItemFailures: []events.SQSBatchItemFailure{
+					{ItemIdentifier: "message-2"},
+				},
+			},
+		},
+		{
+			name:         "messages processed with error",
+			records:      records,
+			processError: errors.New("test"),
+			wantResponse: events.SQSEventResponse{
+				BatchItemFailures: []events.SQSBatchItemFailure{
+					{ItemIdentifier: "message-1"},
+				},
+			},
+		},
+		{
+			name:         "messages released by an open circuit breaker",
+			records:      records,
+			processError: perrors.NewReleaseError(perrors.ReleaseCircuitOpen, time.Second, errors.New("test")),
+			wantResponse: events.SQSEventResponse{
+				BatchItemFailures: []events.SQSBatchItemFailure{
+					{ItemIdentifier: "message-1"},
+				},
+			},
+		},
+		{
+			name:         "messages released by the rate limit of the provider",
+			records:      records,
+			processError: perrors.NewReleaseError(perrors.ReleaseRateLimited, time.Second, errors.New("test")),
+			wantResponse: events.SQSEventResponse{
+				BatchItemFailures: []events.SQSBatchItemFailure{
+					{ItemIdentifier: "message-1"},
+				},
+			},
+		},
+		{
+			name:          "messages processed with error by non existent provider",
+			records:       records,
+			providerEmpty: true,
+			wantResponse: events.SQSEventResponse{
+				BatchItemFailures: []events.SQSBatchItemFailure{
+					{ItemIdentifier: "message-1"},
+				},
+			},
+		},
+		{
+			name:         "messages processed with critical error",
+			records:      records,
+			processError: perrors.NewCriticalError("test"),
+			wantResponse: events.SQSEventResponse{
+				BatchItemFailures: []events.SQSBatchItemFailure{},
+			},
+		},
+		{
+			name:            "messages processed with validation error",
+			records:         records,
+			validationError: perrors.NewValidationError([]perrors.FieldError{{Field: "order.id", Message: "is required"}}),
+			wantResponse: events.SQSEventResponse{
+				BatchItemFailures: []events.SQSBatchItemFailure{},
+			},
+		},
+		{
+			name:                "messages processed with DLQ error",
+			records:             records,
+			processError:        perrors.NewCriticalError("test"),
+			adapterMoveDLQError: errors.New("test"),
+			wantResponse: events.SQSEventResponse{
+				BatchItemFailures: []events.SQSBatchItemFailure{
+					{ItemIdentifier: "message-1"},
+				},
+			},
+		},
+	}
+
+	ctx := context.TODO()
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			l := log.New()
+			l.Out = ioutil.Discard
+
+			providerMock := new(provider.MockProvider)
+			providerMock.On("Process", mock.Anything, mock.AnythingOfType("message.Message")).Return(tc.processResult, tc.processError)
+
+			providerReturn := providerMock
+			if tc.providerEmpty {
+				providerReturn = nil
+			}
+
+			providersMock := new(provider.MockProviderList)
+			providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerReturn)
+
+			mockAdapter := new(message.MockAdapter)
+			mockAdapter.On("MoveToFailedBatch", mock.Anything, mock.Anything).Return([]error{tc.adapterMoveDLQError})
+			mockAdapter.On("Quarantine", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(tc.adapterQuarantineError)
+			mockAdapter.On("ChangeVisibility", mock.Anything, mock.Anything, mock.AnythingOfType("time.Duration")).Return(nil)
+
+			mockValidator := new(validation.MockValidator)
+			mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(tc.validationError)
+
+			mockStore := newMockStore(tc.storeRecord, tc.storeError)
+
+			h := handler.NewHandler(&config.Config{}, l, providersMock, mockAdapter, mockValidator, mockStore)
+			resp, err := h.SQSHandler(ctx, events.SQSEvent{Records: tc.records})
+
+			assert.Equal(t, tc.wantResponse, resp)
+			assert.Nil(t, err)
+			mockAdapter.AssertNotCalled(t, "DeleteBatch", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestSQSHandler_FIFOGroups(t *testing.T) {
+	newRecord := func(id, group, order string) events.SQSMessage {
+		r := events.SQSMessage{
+			MessageId:     id,
+			ReceiptHandle: "receipt-" + id,
+			Body:          `{"provider":"Example","order":{"id":"` + order + `"}}`,
+		}
+		if group != "" {
+			r.Attributes = map[string]string{"MessageGroupId": group}
+		}
+		return r
+	}
+	records := []events.SQSMessage{
+		newRecord("1", "group-1", "fail"),
+		newRecord("2", "group-2", "order-2"),
+		newRecord("3", "group-1", "order-3"),
+		newRecord("4", "group-2", "order-4"),
+		newRecord("5", "", "fail"),
+		newRecord("6", "", "order-6"),
+	}
+
+	l := log.New()
+	l.Out = ioutil.Discard
+
+	var mu sync.Mutex
+	processed := []string{}
+	record := func(args mock.Arguments) {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, args.Get(1).(message.Message).Order.Id)
+	}
+	failed := func(m message.Message) bool { return m.Order.Id == "fail" }
+	providerMock := new(provider.MockProvider)
+	providerMock.On("Process", mock.Anything, mock.MatchedBy(failed)).Run(record).
+		Return(provider.ProcessResult{}, errors.New("test"))
+	providerMock.On("Process", mock.Anything, mock.MatchedBy(func(m message.Message) bool { return !failed(m) })).Run(record).
+		Return(provider.ProcessResult{}, nil)
+
+	providersMock := new(provider.MockProviderList)
+	providersMock.On("GetByMessage", mock.AnythingOfType("message.Message")).Return(providerMock)
+
+	mockAdapter := new(message.MockAdapter)
+	mockValidator := new(validation.MockValidator)
+	mockValidator.On("Validate", mock.AnythingOfType("message.Message")).Return(nil)
+
+	h := handler.NewHandler(&config.Config{}, l, providersMock, mockAdapter, mockValidator, newMockStore(nil, nil))
+	resp, err := h.SQSHandler(context.TODO(), events.SQSEvent{Records: records})
+
+	assert.Nil(t, err)
+	// The failed message of group-1 blocks the next one of its group, the other groups and the messages without group
+	// aren't affected
+	assert.Equal(t, events.SQSEventResponse{
+		BatchItemFailures: []events.SQSBatchItemFailure{
+			{ItemIdentifier: "1"},
+			{ItemIdentifier: "5"},
+			{ItemIdentifier: "3"},
+		},
+	}, resp)
+	assert.NotContains(t, processed, "order-3")
+	assert.Len(t, processed, 5)
+	// The messages of a group are processed one after the other
+	assert.Equal(t, "order-4", processed[len(processed)-1])
+}
+
+// newMockStore creates a mocked idempotency store returning the record on Begin
+func newMockStore(record *idempotency.Record, err error) *idempotency.MockStore {
+	mockStore := new(idempotency.MockStore)
+	mockStore.On("Begin", mock.Anything, mock.AnythingOfType("string")).Return(record, err)
+	mockStore.On("Complete", mock.Anything, mock.AnythingOfType("string"), mock.Anything).Return(nil)
+	mockStore.On("Release", mock.Anything, mock.AnythingOfType("string")).Return(nil)
+	return mockStore
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+)
+
+// heartbeat extends the visibility of the messages of a processing round while they are processed, so a slow
+// provider doesn't let them be delivered again to another consumer
+type heartbeat struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startHeartbeat extends the visibility of the messages every configured interval, until the heartbeat is stopped or
+// the configured ceiling is reached
+// Each extension hides the messages for two intervals, so a late extension doesn't expose them, or for the visibility
+// timeout of the queue when it's longer, so the heartbeat never shortens the visibility of the receive. Without the
+// visibility timeout of the queue the messages aren't extended
+func (h *Handler) startHeartbeat(ctx context.Context, messages message.Messages) *heartbeat {
+	hb := &heartbeat{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	interval := h.config.VisibilityHeartbeatInterval
+	if interval <= 0 || len(messages) == 0 {
+		close(hb.done)
+		return hb
+	}
+
+	visibility, err := h.adapter.VisibilityTimeout(ctx)
+	if err != nil {
+		h.logger(ctx).WithError(err).Info("problem to read the visibility timeout, the visibility of the messages isn't extended")
+		close(hb.done)
+		return hb
+	}
+	timeout := 2 * interval
+	if visibility > timeout {
+		timeout = visibility
+	}
+
+	go func() {
+		defer close(hb.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ceiling := time.Now().Add(h.config.VisibilityHeartbeatMax)
+		for {
+			select {
+			case <-hb.stop:
+				return
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if h.config.VisibilityHeartbeatMax > 0 && now.After(ceiling) {
+					h.logger(ctx).WithField("messages", len(messages)).Info("visibility heartbeat ceiling reached")
+					return
+				}
+				for _, m := range messages {
+					if err := h.adapter.ChangeVisibility(ctx, m.Id, timeout); err != nil {
+						h.logger(ctx).WithError(err).WithField("message", m).Info("problem to extend the message visibility")
+					}
+				}
+			}
+		}
+	}()
+
+	return hb
+}
+
+// Stop stops the heartbeat and waits for the extensions in progress, so they don't override a later visibility change
+func (hb *heartbeat) Stop() {
+	close(hb.stop)
+	<-hb.done
+}
@@ -0,0 +1,179 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/pkg/errors"
+)
+
+// Attributes of the DynamoDB items
+const (
+	attributeKey       = "key"
+	attributeStatus    = "status"
+	attributeResult    = "result"
+	attributeUpdatedAt = "updated_at"
+)
+
+// DynamoDBManager specifies a DynamoDB manager interface, satisfied by the DynamoDB client and by any
+// DynamoDB compatible stand-in
+type DynamoDBManager interface {
+	GetItemWithContext(aws.Context, *dynamodb.GetItemInput, ...request.Option) (*dynamodb.GetItemOutput, error)
+	PutItemWithContext(aws.Context, *dynamodb.PutItemInput, ...request.Option) (*dynamodb.PutItemOutput, error)
+	DeleteItemWithContext(aws.Context, *dynamodb.DeleteItemInput, ...request.Option) (*dynamodb.DeleteItemOutput, error)
+}
+
+// DynamoDBStore represents a store that keeps the records in a DynamoDB table, with "key" as the hash key
+type DynamoDBStore struct {
+	config   *config.Config
+	dynamodb DynamoDBManager
+}
+
+// NewDynamoDBStore creates a new DynamoDB store
+func NewDynamoDBStore(c *config.Config, db DynamoDBManager) *DynamoDBStore {
+	s := &DynamoDBStore{
+		config:   c,
+		dynamodb: db,
+	}
+	return s
+}
+
+// Begin creates an in progress record or returns the existing one
+func (s *DynamoDBStore) Begin(ctx context.Context, key string) (*Record, error) {
+	item, err := s.item(Record{Key: key, Status: StatusInProgress, UpdatedAt: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.dynamodb.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(s.config.IdempotencyDynamoDBTable),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#key)"),
+		ExpressionAttributeNames: map[string]*string{"#key": aws.String(attributeKey)},
+	})
+	if err == nil {
+		return nil, nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil, errors.Wrap(err, "failed to create the idempotency record")
+	}
+
+	// There is a record already
+	out, err := s.dynamodb.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.config.IdempotencyDynamoDBTable),
+		Key:            s.key(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the idempotency record")
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrRecordNotFound
+	}
+	r, err := s.record(out.Item)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Complete records the result of the payment
+func (s *DynamoDBStore) Complete(ctx context.Context, key string, result provider.ProcessResult) error {
+	item, err := s.item(Record{Key: key, Status: StatusCompleted, Result: result, UpdatedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.dynamodb.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.config.IdempotencyDynamoDBTable),
+		Item:      item,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to complete the idempotency record")
+	}
+	return nil
+}
+
+// Release removes the record when it's in progress
+// The delete is conditional, so a record completed meanwhile by another attempt is kept
+func (s *DynamoDBStore) Release(ctx context.Context, key string) error {
+	_, err := s.dynamodb.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(s.config.IdempotencyDynamoDBTable),
+		Key:                       s.key(key),
+		ConditionExpression:       aws.String("#status = :in_progress"),
+		ExpressionAttributeNames:  map[string]*string{"#status": aws.String(attributeStatus)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":in_progress": {S: aws.String(StatusInProgress)}},
+	})
+	if err == nil {
+		return nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != dynamodb.ErrCodeConditionalCheckFailedException {
+		return errors.Wrap(err, "failed to release the idempotency record")
+	}
+
+	// The condition also fails when there is no record
+	out, err := s.dynamodb.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.config.IdempotencyDynamoDBTable),
+		Key:            s.key(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to read the idempotency record")
+	}
+	if len(out.Item) == 0 {
+		return ErrRecordNotFound
+	}
+	return ErrRecordCompleted
+}
+
+// key returns the DynamoDB key of a record
+func (s *DynamoDBStore) key(key string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		attributeKey: {S: aws.String(key)},
+	}
+}
+
+// item converts a record to a DynamoDB item, the result is kept as a JSON document
+func (s *DynamoDBStore) item(r Record) (map[string]*dynamodb.AttributeValue, error) {
+	result, err := json.Marshal(r.Result)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode the idempotency record")
+	}
+	return map[string]*dynamodb.AttributeValue{
+		attributeKey:       {S: aws.String(r.Key)},
+		attributeStatus:    {S: aws.String(r.Status)},
+		attributeResult:    {S: aws.String(string(result))},
+		attributeUpdatedAt: {S: aws.String(r.UpdatedAt.UTC().Format(time.RFC3339Nano))},
+	}, nil
+}
+
+// record converts a DynamoDB item to a record
+func (s *DynamoDBStore) record(item map[string]*dynamodb.AttributeValue) (Record, error) {
+	r := Record{}
+	if v, ok := item[attributeKey]; ok {
+		r.Key = aws.StringValue(v.S)
+	}
+	if v, ok := item[attributeStatus]; ok {
+		r.Status = aws.StringValue(v.S)
+	}
+	if v, ok := item[attributeResult]; ok && aws.StringValue(v.S) != "" {
+		if err := json.Unmarshal([]byte(aws.StringValue(v.S)), &r.Result); err != nil {
+			return Record{}, errors.Wrap(err, "failed to decode the idempotency record")
+		}
+	}
+	if v, ok := item[attributeUpdatedAt]; ok {
+		t, err := time.Parse(time.RFC3339Nano, aws.StringValue(v.S))
+		if err != nil {
+			return Record{}, errors.Wrap(err, "failed to decode the idempotency record")
+		}
+		r.UpdatedAt = t
+	}
+	return r, nil
+}
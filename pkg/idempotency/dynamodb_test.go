@@ -0,0 +1,127 @@
+package idempotency_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/idempotency"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// localDynamoDB is a local stand-in of a DynamoDB table with "key" as the hash key, it only supports the
+// conditions used by the store: attribute_not_exists on put and the in progress status on delete
+type localDynamoDB struct {
+	mu    sync.Mutex
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newLocalDynamoDB() *localDynamoDB {
+	return &localDynamoDB{items: make(map[string]map[string]*dynamodb.AttributeValue)}
+}
+
+func (l *localDynamoDB) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &dynamodb.GetItemOutput{Item: l.items[aws.StringValue(in.Key["key"].S)]}, nil
+}
+
+func (l *localDynamoDB) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := aws.StringValue(in.Item["key"].S)
+	if _, ok := l.items[key]; ok && in.ConditionExpression != nil {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "the conditional request failed", nil)
+	}
+	l.items[key] = in.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (l *localDynamoDB) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := aws.StringValue(in.Key["key"].S)
+	if item, ok := l.items[key]; in.ConditionExpression != nil &&
+		(!ok || aws.StringValue(item["status"].S) != aws.StringValue(in.ExpressionAttributeValues[":in_progress"].S)) {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "the conditional request failed", nil)
+	}
+	delete(l.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func TestDynamoDBStore_Errors(t *testing.T) {
+	conditionalErr := awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "test", nil)
+
+	tests := []struct {
+		name        string
+		putError    error
+		getOutput   *dynamodb.GetItemOutput
+		getError    error
+		deleteError error
+		wantBegin   bool
+		wantRelease bool
+	}{
+		{
+			name:      "failed to create the record",
+			putError:  errors.New("test"),
+			getOutput: &dynamodb.GetItemOutput{},
+			wantBegin: true,
+		},
+		{
+			name:      "failed to read the existing record",
+			putError:  conditionalErr,
+			getOutput: &dynamodb.GetItemOutput{},
+			getError:  errors.New("test"),
+			wantBegin: true,
+		},
+		{
+			name:      "existing record removed meanwhile",
+			putError:  conditionalErr,
+			getOutput: &dynamodb.GetItemOutput{},
+			wantBegin: true,
+		},
+		{
+			name:        "failed to release the record",
+			getOutput:   &dynamodb.GetItemOutput{},
+			deleteError: errors.New("test"),
+			wantRelease: true,
+		},
+		{
+			name:        "failed to read the record that wasn't released",
+			getOutput:   &dynamodb.GetItemOutput{},
+			getError:    errors.New("test"),
+			deleteError: conditionalErr,
+			wantBegin:   false,
+			wantRelease: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockDB := new(idempotency.MockDynamoDB)
+			mockDB.On("PutItemWithContext", mock.Anything, mock.AnythingOfType("*dynamodb.PutItemInput")).
+				Return(nil, tc.putError)
+			mockDB.On("GetItemWithContext", mock.Anything, mock.AnythingOfType("*dynamodb.GetItemInput")).
+				Return(tc.getOutput, tc.getError)
+			mockDB.On("DeleteItemWithContext", mock.Anything, mock.AnythingOfType("*dynamodb.DeleteItemInput")).
+				Return(nil, tc.deleteError)
+
+			s := idempotency.NewDynamoDBStore(&config.Config{IdempotencyDynamoDBTable: "table"}, mockDB)
+
+			_, err := s.Begin(context.TODO(), "Example:order-1")
+			assert.Equal(t, tc.wantBegin, err != nil)
+			err = s.Release(context.TODO(), "Example:order-1")
+			assert.Equal(t, tc.wantRelease, err != nil)
+			err = s.Complete(context.TODO(), "Example:order-1", provider.ProcessResult{})
+			assert.Equal(t, tc.putError != nil, err != nil)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/pkg/errors"
+)
+
+// FileStore represents a store that keeps the records in a local JSON file, used for local runs
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileStore creates a new file store
+func NewFileStore(path string) *FileStore {
+	s := &FileStore{
+		path: path,
+	}
+	return s
+}
+
+// Begin creates an in progress record or returns the existing one
+func (s *FileStore) Begin(ctx context.Context, key string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := records[key]; ok {
+		return &r, nil
+	}
+	records[key] = Record{Key: key, Status: StatusInProgress, UpdatedAt: time.Now()}
+	return nil, s.save(records)
+}
+
+// Complete records the result of the payment
+func (s *FileStore) Complete(ctx context.Context, key string, result provider.ProcessResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	records[key] = Record{Key: key, Status: StatusCompleted, Result: result, UpdatedAt: time.Now()}
+	return s.save(records)
+}
+
+// Release removes the in progress record
+func (s *FileStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	r, ok := records[key]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	if r.Status != StatusInProgress {
+		return ErrRecordCompleted
+	}
+	delete(records, key)
+	return s.save(records)
+}
+
+// load reads all the records from the file, a missing file has no records
+func (s *FileStore) load() (map[string]Record, error) {
+	records := make(map[string]Record)
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the idempotency file")
+	}
+	if len(b) == 0 {
+		return records, nil
+	}
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, errors.Wrap(err, "failed to decode the idempotency file")
+	}
+	return records, nil
+}
+
+// save writes all the records to the file, replacing it atomically
+func (s *FileStore) save(records map[string]Record) error {
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the idempotency file")
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "failed to write the idempotency file")
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return errors.Wrap(err, "failed to write the idempotency file")
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+)
+
+// MemoryStore represents a store that keeps the records in memory, only shared by the invocations of the same
+// Lambda container
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+// NewMemoryStore creates a new memory store
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		records: make(map[string]Record),
+	}
+	return s
+}
+
+// Begin creates an in progress record or returns the existing one
+func (s *MemoryStore) Begin(ctx context.Context, key string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.records[key]; ok {
+		return &r, nil
+	}
+	s.records[key] = Record{Key: key, Status: StatusInProgress, UpdatedAt: time.Now()}
+	return nil, nil
+}
+
+// Complete records the result of the payment
+func (s *MemoryStore) Complete(ctx context.Context, key string, result provider.ProcessResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[key] = Record{Key: key, Status: StatusCompleted, Result: result, UpdatedAt: time.Now()}
+	return nil
+}
+
+// Release removes the in progress record
+func (s *MemoryStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[key]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	if r.Status != StatusInProgress {
+		return ErrRecordCompleted
+	}
+	delete(s.records, key)
+	return nil
+}
@@ -0,0 +1,56 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+)
+
+// Available stores
+const (
+	StoreMemory   = "memory"
+	StoreFile     = "file"
+	StoreDynamoDB = "dynamodb"
+)
+
+// Record statuses
+const (
+	StatusInProgress = "in_progress"
+	StatusCompleted  = "completed"
+)
+
+// List of errors
+var (
+	ErrRecordNotFound  = errors.New("idempotency record not found")
+	ErrRecordCompleted = errors.New("idempotency record is completed, the payment was processed")
+)
+
+// Record represents the processing state of a payment
+type Record struct {
+	Key       string                 `json:"key"`
+	Status    string                 `json:"status"`
+	Result    provider.ProcessResult `json:"result"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+// Store represents a store of the payments already sent to a provider, used to not charge a customer twice when
+// a message is delivered again
+type Store interface {
+	// Begin atomically creates an in progress record for the key, or returns the existing record when there is one
+	Begin(ctx context.Context, key string) (*Record, error)
+	// Complete records the result of the payment
+	Complete(ctx context.Context, key string, result provider.ProcessResult) error
+	// Release removes the in progress record, allowing the payment to be processed again
+	// A completed record is kept and ErrRecordCompleted is returned, so a processed payment is never charged again
+	Release(ctx context.Context, key string) error
+}
+
+// Key returns the idempotency key of a message: the same order sent to the same provider
+// It's the provider requested by the message (e.g. auto) and not the one chosen by the routing rules, so a change of
+// the rules between two deliveries of the message doesn't charge the order again on another provider
+func Key(m message.Message) string {
+	return m.Provider + ":" + m.Order.Id
+}
@@ -0,0 +1,58 @@
+package idempotency
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockStore represents a mocked idempotency store
+type MockStore struct {
+	mock.Mock
+}
+
+// Begin mocks the creation of an in progress record
+func (ms *MockStore) Begin(ctx context.Context, key string) (*Record, error) {
+	args := ms.Called(ctx, key)
+	r, _ := args.Get(0).(*Record)
+	return r, args.Error(1)
+}
+
+// Complete mocks the record of the payment result
+func (ms *MockStore) Complete(ctx context.Context, key string, result provider.ProcessResult) error {
+	args := ms.Called(ctx, key, result)
+	return args.Error(0)
+}
+
+// Release mocks the removal of the record
+func (ms *MockStore) Release(ctx context.Context, key string) error {
+	args := ms.Called(ctx, key)
+	return args.Error(0)
+}
+
+// MockDynamoDB represents a mocked DynamoDB manager
+type MockDynamoDB struct {
+	mock.Mock
+}
+
+// GetItemWithContext mocks the get item
+func (md *MockDynamoDB) GetItemWithContext(ctx aws.Context, gii *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	args := md.Called(ctx, gii)
+	return args.Get(0).(*dynamodb.GetItemOutput), args.Error(1)
+}
+
+// PutItemWithContext mocks the put item
+func (md *MockDynamoDB) PutItemWithContext(ctx aws.Context, pii *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	args := md.Called(ctx, pii)
+	return nil, args.Error(1)
+}
+
+// DeleteItemWithContext mocks the delete item
+func (md *MockDynamoDB) DeleteItemWithContext(ctx aws.Context, dii *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	args := md.Called(ctx, dii)
+	return nil, args.Error(1)
+}
@@ -0,0 +1,106 @@
+package idempotency_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/idempotency"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKey(t *testing.T) {
+	m := message.Message{Provider: "Example", Order: message.Order{Id: "order-1"}}
+	assert.Equal(t, "Example:order-1", idempotency.Key(m))
+
+	// The key of a routed message is the requested provider, whatever the provider chosen by the routing rules
+	m = message.Message{Provider: "auto", Order: message.Order{Id: "order-1"}, Metadata: message.Metadata{RoutedProvider: "Example"}}
+	assert.Equal(t, "auto:order-1", idempotency.Key(m))
+}
+
+// TestStores checks that all the stores follow the same contract
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idempotency")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	stores := map[string]idempotency.Store{
+		idempotency.StoreMemory: idempotency.NewMemoryStore(),
+		idempotency.StoreFile:   idempotency.NewFileStore(filepath.Join(dir, "idempotency.json")),
+		idempotency.StoreDynamoDB: idempotency.NewDynamoDBStore(
+			&config.Config{IdempotencyDynamoDBTable: "payments-idempotency"},
+			newLocalDynamoDB(),
+		),
+	}
+
+	ctx := context.TODO()
+	result := provider.ProcessResult{
+		TransactionID:  "tx-1",
+		Status:         provider.PaymentStatusApproved,
+		AmountCaptured: message.NewMoney(1000, "BRL"),
+	}
+
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			// First attempt creates the in progress record
+			r, err := s.Begin(ctx, "Example:order-1")
+			assert.Nil(t, err)
+			assert.Nil(t, r)
+
+			// A concurrent attempt sees the in progress record
+			r, err = s.Begin(ctx, "Example:order-1")
+			assert.Nil(t, err)
+			assert.Equal(t, idempotency.StatusInProgress, r.Status)
+			assert.Equal(t, "Example:order-1", r.Key)
+
+			// Releasing allows a new attempt
+			assert.Nil(t, s.Release(ctx, "Example:order-1"))
+			r, err = s.Begin(ctx, "Example:order-1")
+			assert.Nil(t, err)
+			assert.Nil(t, r)
+
+			// A redelivery after the completion sees the payment result
+			assert.Nil(t, s.Complete(ctx, "Example:order-1", result))
+			r, err = s.Begin(ctx, "Example:order-1")
+			assert.Nil(t, err)
+			assert.Equal(t, idempotency.StatusCompleted, r.Status)
+			assert.Equal(t, result, r.Result)
+
+			// A completed record is never released
+			assert.Equal(t, idempotency.ErrRecordCompleted, s.Release(ctx, "Example:order-1"))
+			r, err = s.Begin(ctx, "Example:order-1")
+			assert.Nil(t, err)
+			assert.Equal(t, idempotency.StatusCompleted, r.Status)
+
+			// Releasing an unknown record fails
+			assert.Equal(t, idempotency.ErrRecordNotFound, s.Release(ctx, "Example:unknown"))
+
+			// Other keys are independent
+			r, err = s.Begin(ctx, "Example:order-2")
+			assert.Nil(t, err)
+			assert.Nil(t, r)
+		})
+	}
+}
+
+func TestMemoryStore_Release(t *testing.T) {
+	s := idempotency.NewMemoryStore()
+	assert.Equal(t, idempotency.ErrRecordNotFound, s.Release(context.TODO(), "unknown"))
+}
+
+func TestFileStore_InvalidFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "idempotency")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, _ = f.WriteString("this is not a valid json file")
+	_ = f.Close()
+
+	s := idempotency.NewFileStore(f.Name())
+	_, err = s.Begin(context.TODO(), "Example:order-1")
+	assert.NotNil(t, err)
+}
@@ -1,8 +1,27 @@
 package message
 
+import (
+	"context"
+	"time"
+)
+
 // Adapter represents an adapter to handle the messages
+// Messages that can't be decoded aren't returned by GetMessages, they are quarantined and reported apart
+// The batch operations return the error of each message in the same order of the input, nil when it succeeded
+// The context carries the cancellation, the deadline and the request scoped values of the invocation
 type Adapter interface {
-	GetMessages() (Messages, error)
-	Delete(id *string) error
-	MoveToFailed(m Message) error
+	GetMessages(ctx context.Context) (Messages, []Quarantined, error)
+	Delete(ctx context.Context, id *string) error
+	DeleteBatch(ctx context.Context, ids []*string) []error
+	MoveToFailed(ctx context.Context, m Message, reason error) error
+	MoveToFailedBatch(ctx context.Context, failed []Failed) []error
+	Quarantine(ctx context.Context, m Message, body string, reason error) error
+	ChangeVisibility(ctx context.Context, id *string, timeout time.Duration) error
+	VisibilityTimeout(ctx context.Context) (time.Duration, error)
+}
+
+// Failed represents a message to be moved to the list of failed messages and the reason of the failure
+type Failed struct {
+	Message Message
+	Reason  error
 }
@@ -0,0 +1,189 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// Files of the local queue directory, with one JSON message per line
+const (
+	FileQueue = "queue.jsonl"
+	FileDLQ   = "dlq.jsonl"
+)
+
+// fileStore represents a store that keeps the state of a local queue in a directory, used for local runs
+// The queue and the DLQ are JSON lines files, read and replaced atomically on each change
+type fileStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewFileAdapter creates a new local adapter that keeps the queue and the DLQ in the files of a directory
+func NewFileAdapter(c *config.Config, dir string) *LocalAdapter {
+	return newLocalAdapter(c, &fileStore{dir: dir})
+}
+
+// view reads the state from the files
+func (s *fileStore) view(fn func(q *localQueue)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, err := s.load()
+	if err != nil {
+		return err
+	}
+	fn(q)
+	return nil
+}
+
+// update changes the state and writes it to the files, nothing is written when the change fails
+func (s *fileStore) update(fn func(q *localQueue) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, err := s.load()
+	if err != nil {
+		return err
+	}
+	previous := append([]DeadLetter(nil), q.deadLetters...)
+	if err := fn(q); err != nil {
+		return err
+	}
+	return s.save(q, previous)
+}
+
+// load reads the queue and the DLQ, a missing file has no messages
+func (s *fileStore) load() (*localQueue, error) {
+	q := &localQueue{}
+	err := readLines(filepath.Join(s.dir, FileQueue), func(line []byte) error {
+		var sm StoredMessage
+		if err := json.Unmarshal(line, &sm); err != nil {
+			return err
+		}
+		q.messages = append(q.messages, sm)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the queue file")
+	}
+	err = readLines(filepath.Join(s.dir, FileDLQ), func(line []byte) error {
+		var dl DeadLetter
+		if err := json.Unmarshal(line, &dl); err != nil {
+			return err
+		}
+		q.deadLetters = append(q.deadLetters, dl)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the DLQ file")
+	}
+	return q, nil
+}
+
+// save writes the queue and the DLQ
+// Both files are written before any of them is replaced, and the DLQ is replaced first, so a message moved to the DLQ
+// is never lost. When the queue can't be replaced the previous dead letters are written back
+func (s *fileStore) save(q *localQueue, previous []DeadLetter) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create the queue directory")
+	}
+	queuePath := filepath.Join(s.dir, FileQueue)
+	dlqPath := filepath.Join(s.dir, FileDLQ)
+
+	var messages []interface{}
+	for _, sm := range q.messages {
+		messages = append(messages, sm)
+	}
+	queueTmp, err := writeTemp(queuePath, messages)
+	if err != nil {
+		return errors.Wrap(err, "failed to write the queue file")
+	}
+	defer os.Remove(queueTmp)
+	dlqTmp, err := writeTemp(dlqPath, deadLetterLines(q.deadLetters))
+	if err != nil {
+		return errors.Wrap(err, "failed to write the DLQ file")
+	}
+	defer os.Remove(dlqTmp)
+
+	if err := os.Rename(dlqTmp, dlqPath); err != nil {
+		return errors.Wrap(err, "failed to write the DLQ file")
+	}
+	if err := os.Rename(queueTmp, queuePath); err != nil {
+		// The moved messages are still in the queue, so the previous DLQ doesn't lose any of them
+		_ = writeLines(dlqPath, deadLetterLines(previous))
+		return errors.Wrap(err, "failed to write the queue file")
+	}
+	return nil
+}
+
+// deadLetterLines returns the values of the DLQ lines
+func deadLetterLines(deadLetters []DeadLetter) []interface{} {
+	var lines []interface{}
+	for _, dl := range deadLetters {
+		lines = append(lines, dl)
+	}
+	return lines
+}
+
+// readLines calls fn with each non empty line of a file, a missing file has no lines
+func readLines(path string, fn func(line []byte) error) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	// A line has a whole message, which may be bigger than the default limit of the scanner
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), len(b)+1)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return errors.Wrapf(err, "invalid line %d", n)
+		}
+	}
+	return scanner.Err()
+}
+
+// writeLines writes each value as a JSON line, replacing the file atomically
+func writeLines(path string, values []interface{}) error {
+	tmp, err := writeTemp(path, values)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeTemp writes each value as a JSON line to a temporary file next to the file, that replaces it when renamed
+func writeTemp(path string, values []interface{}) (string, error) {
+	var buf bytes.Buffer
+	for _, v := range values {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	return tmp, nil
+}
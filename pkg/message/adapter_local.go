@@ -0,0 +1,315 @@
+package message
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+)
+
+// DefaultVisibilityTimeout is the visibility timeout of the local queues when SQS_VISIBILITY_TIMEOUT is not set,
+// the same default of SQS
+const DefaultVisibilityTimeout = 30 * time.Second
+
+// List of errors
+var (
+	ErrInvalidReceiptHandle = errors.New("the receipt handle is invalid or the message was received again")
+)
+
+// StoredMessage represents a message kept in a local queue
+// VisibleAt is when the message can be received again, the receipt handle of the last receive is the id of the
+// message returned by GetMessages
+type StoredMessage struct {
+	MessageID         string            `json:"message_id"`
+	Body              string            `json:"body"`
+	MessageAttributes map[string]string `json:"message_attributes,omitempty"`
+	SentAt            time.Time         `json:"sent_at"`
+	FirstReceivedAt   time.Time         `json:"first_received_at"`
+	ReceiveCount      int               `json:"receive_count"`
+	ReceiptHandle     string            `json:"receipt_handle,omitempty"`
+	VisibleAt         time.Time         `json:"visible_at"`
+}
+
+// DeadLetter represents a message moved to the DLQ of a local queue, with the same failure attributes attached to
+// the messages moved to the SQS DLQ (see AttributeError)
+type DeadLetter struct {
+	MessageID  string            `json:"message_id"`
+	Body       string            `json:"body"`
+	Attributes map[string]string `json:"attributes"`
+	MovedAt    time.Time         `json:"moved_at"`
+}
+
+// localQueue represents the state of a local queue and its DLQ
+type localQueue struct {
+	messages    []StoredMessage
+	deadLetters []DeadLetter
+}
+
+// localStore represents where the state of a local queue is kept
+// update applies a change to the state atomically, the state is not changed when the change fails
+type localStore interface {
+	view(fn func(q *localQueue)) error
+	update(fn func(q *localQueue) error) error
+}
+
+// LocalAdapter represents an adapter that keeps the queue and the DLQ in memory or in local files, used to run the
+// handler without AWS
+// It follows the contract of SQS: a received message is hidden for the visibility timeout and received again, with a
+// new receipt handle, when it's not deleted
+type LocalAdapter struct {
+	config *config.Config
+	codec  *Codec
+	store  localStore
+}
+
+// newLocalAdapter creates a new local adapter with the store of the state
+func newLocalAdapter(c *config.Config, s localStore) *LocalAdapter {
+	a := &LocalAdapter{
+		config: c,
+		codec:  NewCodec(c),
+		store:  s,
+	}
+	return a
+}
+
+// Send sends a message body to the queue and returns the id of the message
+func (a *LocalAdapter) Send(ctx context.Context, body string, attributes map[string]string) (string, error) {
+	now := time.Now()
+	sm := StoredMessage{
+		MessageID:         uuid.NewV4().String(),
+		Body:              body,
+		MessageAttributes: attributes,
+		SentAt:            now,
+		VisibleAt:         now,
+	}
+	err := a.store.update(func(q *localQueue) error {
+		q.messages = append(q.messages, sm)
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to send the message to the local queue")
+	}
+	return sm.MessageID, nil
+}
+
+// Messages returns all the messages of the queue, including the ones that are not visible
+func (a *LocalAdapter) Messages(ctx context.Context) ([]StoredMessage, error) {
+	var messages []StoredMessage
+	err := a.store.view(func(q *localQueue) {
+		messages = append(messages, q.messages...)
+	})
+	return messages, err
+}
+
+// DeadLetters returns all the messages of the DLQ
+func (a *LocalAdapter) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	var deadLetters []DeadLetter
+	err := a.store.view(func(q *localQueue) {
+		deadLetters = append(deadLetters, q.deadLetters...)
+	})
+	return deadLetters, err
+}
+
+// GetMessages returns the visible messages of the queue, up to SqsMaxNumberOfMessages, hiding them for the visibility
+// timeout
+// A message that can't be decoded is quarantined on the DLQ, without affecting the other messages of the batch
+func (a *LocalAdapter) GetMessages(ctx context.Context) (Messages, []Quarantined, error) {
+	var received []StoredMessage
+	err := a.store.update(func(q *localQueue) error {
+		now := time.Now()
+		for i := range q.messages {
+			if len(received) == a.maxNumberOfMessages() {
+				break
+			}
+			sm := &q.messages[i]
+			if sm.VisibleAt.After(now) {
+				continue
+			}
+			sm.ReceiveCount++
+			if sm.FirstReceivedAt.IsZero() {
+				sm.FirstReceivedAt = now
+			}
+			sm.ReceiptHandle = uuid.NewV4().String()
+			sm.VisibleAt = now.Add(a.visibilityTimeout())
+			received = append(received, *sm)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read messages from the local queue")
+	}
+
+	messages := Messages{}
+	var quarantined []Quarantined
+	for _, sm := range received {
+		receiptHandle := sm.ReceiptHandle
+		m := Message{
+			Id:       &receiptHandle,
+			Metadata: sm.metadata(),
+		}
+		d, err := a.codec.Decode([]byte(sm.Body))
+		if err != nil {
+			q := Quarantined{Id: m.Id, Error: err.Error()}
+			if errQ := a.Quarantine(ctx, m, sm.Body, err); errQ != nil {
+				q.Error = errQ.Error()
+			}
+			quarantined = append(quarantined, q)
+			continue
+		}
+		d.Id = m.Id
+		d.Metadata = m.Metadata
+		messages = append(messages, d)
+	}
+
+	return messages, quarantined, nil
+}
+
+// Delete deletes a message from the queue
+// A failure is a critical error, as with SQS, the message is received again and its payment may have been processed
+func (a *LocalAdapter) Delete(ctx context.Context, id *string) error {
+	err := a.store.update(func(q *localQueue) error {
+		i, err := q.index(id)
+		if err != nil {
+			return err
+		}
+		q.messages = append(q.messages[:i], q.messages[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		return perrors.NewCriticalError("failed to delete the message from the local queue: " + err.Error())
+	}
+	return nil
+}
+
+// DeleteBatch deletes a list of messages from the queue
+func (a *LocalAdapter) DeleteBatch(ctx context.Context, ids []*string) []error {
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		errs[i] = a.Delete(ctx, id)
+	}
+	return errs
+}
+
+// ChangeVisibility changes the time until the message can be received again, limited to MaxVisibilityTimeout
+func (a *LocalAdapter) ChangeVisibility(ctx context.Context, id *string, timeout time.Duration) error {
+	if timeout < 0 {
+		timeout = 0
+	}
+	if timeout > MaxVisibilityTimeout {
+		timeout = MaxVisibilityTimeout
+	}
+
+	err := a.store.update(func(q *localQueue) error {
+		i, err := q.index(id)
+		if err != nil {
+			return err
+		}
+		q.messages[i].VisibleAt = time.Now().Add(timeout)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to change the message visibility")
+	}
+	return nil
+}
+
+// MoveToFailed moves the message to the DLQ, with the same body and attributes of the SQS DLQ
+func (a *LocalAdapter) MoveToFailed(ctx context.Context, m Message, reason error) error {
+	body, attributes, err := failedMessage(m, reason)
+	if err != nil {
+		return err
+	}
+	return a.moveToDLQ(m, body, messageAttributes(attributes))
+}
+
+// MoveToFailedBatch moves a list of messages to the DLQ
+func (a *LocalAdapter) MoveToFailedBatch(ctx context.Context, failed []Failed) []error {
+	errs := make([]error, len(failed))
+	for i, f := range failed {
+		errs[i] = a.MoveToFailed(ctx, f.Message, f.Reason)
+	}
+	return errs
+}
+
+// Quarantine moves a message that can't be decoded to the DLQ, keeping the original body
+func (a *LocalAdapter) Quarantine(ctx context.Context, m Message, body string, reason error) error {
+	if err := a.moveToDLQ(m, body, messageAttributes(quarantineAttributes(m, reason))); err != nil {
+		return errors.Wrap(err, "failed to quarantine the message")
+	}
+	return nil
+}
+
+// moveToDLQ adds a message to the DLQ and removes it from the queue
+func (a *LocalAdapter) moveToDLQ(m Message, body string, attributes map[string]string) error {
+	err := a.store.update(func(q *localQueue) error {
+		i, err := q.index(m.Id)
+		if err != nil {
+			return err
+		}
+		q.deadLetters = append(q.deadLetters, DeadLetter{
+			MessageID:  uuid.NewV4().String(),
+			Body:       body,
+			Attributes: attributes,
+			MovedAt:    time.Now(),
+		})
+		q.messages = append(q.messages[:i], q.messages[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to move the message to the local DLQ")
+	}
+	return nil
+}
+
+// maxNumberOfMessages returns how many messages are received at once, from 1 to MaxBatchSize like SQS
+func (a *LocalAdapter) maxNumberOfMessages() int {
+	n := int(a.config.SqsMaxNumberOfMessages)
+	if n < 1 {
+		return 1
+	}
+	if n > MaxBatchSize {
+		return MaxBatchSize
+	}
+	return n
+}
+
+// VisibilityTimeout returns how long the received messages are hidden
+func (a *LocalAdapter) VisibilityTimeout(ctx context.Context) (time.Duration, error) {
+	return a.visibilityTimeout(), nil
+}
+
+// visibilityTimeout returns how long a received message is hidden
+func (a *LocalAdapter) visibilityTimeout() time.Duration {
+	if a.config.SqsVisibilityTimeout > 0 {
+		return time.Duration(a.config.SqsVisibilityTimeout) * time.Second
+	}
+	return DefaultVisibilityTimeout
+}
+
+// index returns the position of the message received with the receipt handle
+func (q *localQueue) index(id *string) (int, error) {
+	if id == nil {
+		return 0, ErrInvalidReceiptHandle
+	}
+	for i, sm := range q.messages {
+		if sm.ReceiptHandle != "" && sm.ReceiptHandle == *id {
+			return i, nil
+		}
+	}
+	return 0, ErrInvalidReceiptHandle
+}
+
+// metadata returns the metadata of a received message, with the system attributes that SQS would return
+func (sm StoredMessage) metadata() Metadata {
+	attributes := map[string]string{
+		sqs.MessageSystemAttributeNameSentTimestamp:                    formatTimestamp(sm.SentAt),
+		sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp: formatTimestamp(sm.FirstReceivedAt),
+		sqs.MessageSystemAttributeNameApproximateReceiveCount:          strconv.Itoa(sm.ReceiveCount),
+	}
+	return NewMetadata(sm.MessageID, attributes, sm.MessageAttributes)
+}
@@ -0,0 +1,261 @@
+package message_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// newLocalAdapters creates the local adapters that must follow the same contract
+func newLocalAdapters(t *testing.T, c *config.Config) (map[string]*message.LocalAdapter, func()) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	adapters := map[string]*message.LocalAdapter{
+		"memory": message.NewMemoryAdapter(c),
+		"file":   message.NewFileAdapter(c, filepath.Join(dir, "queue")),
+	}
+	return adapters, func() { _ = os.RemoveAll(dir) }
+}
+
+// TestLocalAdapters checks that the local adapters follow the contract of SQS
+func TestLocalAdapters(t *testing.T) {
+	adapters, cleanup := newLocalAdapters(t, &config.Config{SqsMaxNumberOfMessages: 10})
+	defer cleanup()
+
+	ctx := context.TODO()
+
+	for name, a := range adapters {
+		t.Run(name, func(t *testing.T) {
+			var _ message.Adapter = a
+
+			id, err := a.Send(ctx, `{"provider":"Example","order":{"id":"1"}}`, map[string]string{"TraceId": "trace-1"})
+			assert.Nil(t, err)
+			_, err = a.Send(ctx, `{"provider":"Example","order":{"id":"2"}}`, nil)
+			assert.Nil(t, err)
+
+			// The received messages are hidden for the visibility timeout
+			messages, quarantined, err := a.GetMessages(ctx)
+			assert.Nil(t, err)
+			assert.Nil(t, quarantined)
+			if !assert.Len(t, messages, 2) {
+				return
+			}
+			first, second := messages[0], messages[1]
+			assert.Equal(t, "1", first.Order.Id)
+			assert.Equal(t, "2", second.Order.Id)
+			assert.Equal(t, id, first.Metadata.MessageID)
+			assert.Equal(t, 1, first.Metadata.ReceiveCount)
+			assert.Equal(t, map[string]string{"TraceId": "trace-1"}, first.Metadata.MessageAttributes)
+			assert.False(t, first.Metadata.SentAt.IsZero())
+			assert.False(t, first.Metadata.FirstReceivedAt.IsZero())
+
+			messages, _, err = a.GetMessages(ctx)
+			assert.Nil(t, err)
+			assert.Empty(t, messages)
+
+			// A visible message is received again with a new receipt handle
+			assert.Nil(t, a.ChangeVisibility(ctx, first.Id, 0))
+			messages, _, err = a.GetMessages(ctx)
+			assert.Nil(t, err)
+			if !assert.Len(t, messages, 1) {
+				return
+			}
+			again := messages[0]
+			assert.Equal(t, id, again.Metadata.MessageID)
+			assert.Equal(t, 2, again.Metadata.ReceiveCount)
+			assert.NotEqual(t, *first.Id, *again.Id)
+			err = a.Delete(ctx, first.Id)
+			assert.IsType(t, &perrors.CriticalError{}, err)
+			assert.Contains(t, err.Error(), message.ErrInvalidReceiptHandle.Error())
+			assert.Equal(t, message.ErrInvalidReceiptHandle, errors.Cause(a.ChangeVisibility(ctx, first.Id, 0)))
+
+			// The acknowledged messages leave the queue
+			assert.Equal(t, []error{nil}, a.DeleteBatch(ctx, []*string{again.Id}))
+			stored, err := a.Messages(ctx)
+			assert.Nil(t, err)
+			if assert.Len(t, stored, 1) {
+				assert.Equal(t, 1, stored[0].ReceiveCount)
+			}
+
+			// The failed messages are moved to the DLQ with the failure attributes
+			errs := a.MoveToFailedBatch(ctx, []message.Failed{
+				{Message: second, Reason: perrors.NewCriticalError("test")},
+				{Message: first, Reason: perrors.NewCriticalError("test")},
+			})
+			assert.Nil(t, errs[0])
+			assert.Equal(t, message.ErrInvalidReceiptHandle, errors.Cause(errs[1]))
+			stored, err = a.Messages(ctx)
+			assert.Nil(t, err)
+			assert.Empty(t, stored)
+
+			deadLetters, err := a.DeadLetters(ctx)
+			assert.Nil(t, err)
+			if assert.Len(t, deadLetters, 1) {
+				dl := deadLetters[0]
+				assert.Contains(t, dl.Body, `"order":{"id":"2"`)
+				assert.Equal(t, "test", dl.Attributes[message.AttributeError])
+				assert.Equal(t, message.ErrorClassCritical, dl.Attributes[message.AttributeErrorClass])
+				assert.Equal(t, "Example", dl.Attributes[message.AttributeProvider])
+				assert.Equal(t, second.Metadata.MessageID, dl.Attributes[message.AttributeMessageID])
+				assert.Equal(t, "1", dl.Attributes[message.AttributeReceiveCount])
+				assert.False(t, dl.MovedAt.IsZero())
+			}
+		})
+	}
+}
+
+func TestLocalAdapters_Quarantine(t *testing.T) {
+	adapters, cleanup := newLocalAdapters(t, &config.Config{SqsMaxNumberOfMessages: 10, MessageStrictDecoding: true})
+	defer cleanup()
+
+	ctx := context.TODO()
+
+	for name, a := range adapters {
+		t.Run(name, func(t *testing.T) {
+			_, err := a.Send(ctx, `{"provider":"Example"}`, nil)
+			assert.Nil(t, err)
+			_, err = a.Send(ctx, `{"provider":"Example","gateway":"Other"}`, nil)
+			assert.Nil(t, err)
+
+			messages, quarantined, err := a.GetMessages(ctx)
+
+			assert.Nil(t, err)
+			assert.Len(t, messages, 1)
+			if assert.Len(t, quarantined, 1) {
+				assert.Contains(t, quarantined[0].Error, "failed to decode the message (unknown_field)")
+			}
+			stored, err := a.Messages(ctx)
+			assert.Nil(t, err)
+			assert.Len(t, stored, 1)
+
+			deadLetters, err := a.DeadLetters(ctx)
+			assert.Nil(t, err)
+			if assert.Len(t, deadLetters, 1) {
+				dl := deadLetters[0]
+				assert.Equal(t, `{"provider":"Example","gateway":"Other"}`, dl.Body)
+				assert.Equal(t, message.ErrorClassUndecodable, dl.Attributes[message.AttributeErrorClass])
+				assert.Equal(t, perrors.DecodeUnknownField, dl.Attributes[message.AttributeDecodeFailure])
+			}
+		})
+	}
+}
+
+func TestLocalAdapters_VisibilityTimeout(t *testing.T) {
+	adapters, cleanup := newLocalAdapters(t, &config.Config{SqsVisibilityTimeout: 1})
+	defer cleanup()
+
+	ctx := context.TODO()
+
+	for name, a := range adapters {
+		t.Run(name, func(t *testing.T) {
+			_, err := a.Send(ctx, `{"provider":"Example","order":{"id":"1"}}`, nil)
+			assert.Nil(t, err)
+			_, err = a.Send(ctx, `{"provider":"Example","order":{"id":"2"}}`, nil)
+			assert.Nil(t, err)
+
+			// A single message is received by default
+			messages, _, err := a.GetMessages(ctx)
+			assert.Nil(t, err)
+			if !assert.Len(t, messages, 1) {
+				return
+			}
+			assert.Equal(t, "1", messages[0].Order.Id)
+			assert.Nil(t, a.ChangeVisibility(ctx, messages[0].Id, time.Hour))
+
+			messages, _, err = a.GetMessages(ctx)
+			assert.Nil(t, err)
+			if !assert.Len(t, messages, 1) {
+				return
+			}
+			assert.Equal(t, "2", messages[0].Order.Id)
+
+			// The message not acknowledged is received again after the visibility timeout
+			time.Sleep(1100 * time.Millisecond)
+			messages, _, err = a.GetMessages(ctx)
+			assert.Nil(t, err)
+			if assert.Len(t, messages, 1) {
+				assert.Equal(t, "2", messages[0].Order.Id)
+				assert.Equal(t, 2, messages[0].Metadata.ReceiveCount)
+			}
+		})
+	}
+}
+
+func TestFileAdapter_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.TODO()
+	c := &config.Config{}
+
+	id, err := message.NewFileAdapter(c, dir).Send(ctx, `{"provider":"Example"}`, nil)
+	assert.Nil(t, err)
+
+	// Another adapter of the same directory, like a new local run, receives the message
+	messages, _, err := message.NewFileAdapter(c, dir).GetMessages(ctx)
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, id, messages[0].Metadata.MessageID)
+	}
+	_, err = os.Stat(filepath.Join(dir, message.FileQueue))
+	assert.Nil(t, err)
+}
+
+func TestFileAdapter_MoveToFailed_WriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.TODO()
+	a := message.NewFileAdapter(&config.Config{}, dir)
+	_, err = a.Send(ctx, `{"provider":"Example","order":{"id":"1"}}`, nil)
+	assert.Nil(t, err)
+	messages, _, err := a.GetMessages(ctx)
+	assert.Nil(t, err)
+	if !assert.Len(t, messages, 1) {
+		return
+	}
+
+	// The DLQ file can't be written, the message is kept in the queue
+	tmp := filepath.Join(dir, message.FileDLQ+".tmp")
+	assert.Nil(t, os.Mkdir(tmp, 0700))
+	assert.NotNil(t, a.MoveToFailed(ctx, messages[0], perrors.NewCriticalError("test")))
+	stored, err := a.Messages(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, stored, 1)
+	deadLetters, err := a.DeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, deadLetters)
+
+	assert.Nil(t, os.Remove(tmp))
+	assert.Nil(t, a.MoveToFailed(ctx, messages[0], perrors.NewCriticalError("test")))
+	stored, err = a.Messages(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, stored)
+	deadLetters, err = a.DeadLetters(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, deadLetters, 1)
+}
+
+func TestFileAdapter_InvalidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, message.FileQueue), []byte("this is not a valid json line\n"), 0600))
+
+	a := message.NewFileAdapter(&config.Config{}, dir)
+	_, _, err = a.GetMessages(context.TODO())
+	assert.NotNil(t, err)
+	_, err = a.Send(context.TODO(), `{"provider":"Example"}`, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,35 @@
+package message
+
+import (
+	"sync"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+)
+
+// memoryStore represents a store that keeps the state of a local queue in memory
+type memoryStore struct {
+	mu    sync.Mutex
+	queue localQueue
+}
+
+// NewMemoryAdapter creates a new local adapter that keeps the queue and the DLQ in memory
+func NewMemoryAdapter(c *config.Config) *LocalAdapter {
+	return newLocalAdapter(c, &memoryStore{})
+}
+
+// view reads the state
+func (s *memoryStore) view(fn func(q *localQueue)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(&s.queue)
+	return nil
+}
+
+// update changes the state, a change that fails returns before changing anything
+func (s *memoryStore) update(fn func(q *localQueue) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return fn(&s.queue)
+}
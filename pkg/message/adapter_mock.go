@@ -1,6 +1,11 @@
 package message
 
 import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/stretchr/testify/mock"
 )
@@ -11,42 +16,97 @@ type MockAdapter struct {
 }
 
 // GetMessages mocks the return of the messages
-func (ma *MockAdapter) GetMessages() (Messages, error) {
-	args := ma.Called()
-	return args.Get(0).(Messages), args.Error(1)
+func (ma *MockAdapter) GetMessages(ctx context.Context) (Messages, []Quarantined, error) {
+	args := ma.Called(ctx)
+	return args.Get(0).(Messages), args.Get(1).([]Quarantined), args.Error(2)
 }
 
 // Delete mocks the message deletion
-func (ma *MockAdapter) Delete(id *string) error {
-	args := ma.Called(id)
+func (ma *MockAdapter) Delete(ctx context.Context, id *string) error {
+	args := ma.Called(ctx, id)
 	return args.Error(0)
 }
 
+// DeleteBatch mocks the deletion of a list of messages
+func (ma *MockAdapter) DeleteBatch(ctx context.Context, ids []*string) []error {
+	args := ma.Called(ctx, ids)
+	return args.Get(0).([]error)
+}
+
 // MoveToFailed mocks the message being moved to failed
-func (ma *MockAdapter) MoveToFailed(m Message) error {
-	args := ma.Called(m)
+func (ma *MockAdapter) MoveToFailed(ctx context.Context, m Message, reason error) error {
+	args := ma.Called(ctx, m, reason)
+	return args.Error(0)
+}
+
+// MoveToFailedBatch mocks a list of messages being moved to failed
+func (ma *MockAdapter) MoveToFailedBatch(ctx context.Context, failed []Failed) []error {
+	args := ma.Called(ctx, failed)
+	return args.Get(0).([]error)
+}
+
+// Quarantine mocks the message being quarantined
+func (ma *MockAdapter) Quarantine(ctx context.Context, m Message, body string, reason error) error {
+	args := ma.Called(ctx, m, body, reason)
+	return args.Error(0)
+}
+
+// ChangeVisibility mocks the message visibility change
+func (ma *MockAdapter) ChangeVisibility(ctx context.Context, id *string, timeout time.Duration) error {
+	args := ma.Called(ctx, id, timeout)
 	return args.Error(0)
 }
 
+// VisibilityTimeout mocks the visibility timeout of the received messages
+func (ma *MockAdapter) VisibilityTimeout(ctx context.Context) (time.Duration, error) {
+	args := ma.Called(ctx)
+	return args.Get(0).(time.Duration), args.Error(1)
+}
+
 // MockSQS represents a mocked SQS manager
 type MockSQS struct {
 	mock.Mock
 }
 
-// ReceiveMessage mocks the receive message
-func (ms *MockSQS) ReceiveMessage(rmi *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
-	args := ms.Called(rmi)
+// ReceiveMessageWithContext mocks the receive message
+func (ms *MockSQS) ReceiveMessageWithContext(ctx aws.Context, rmi *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	args := ms.Called(ctx, rmi)
 	return args.Get(0).(*sqs.ReceiveMessageOutput), args.Error(1)
 }
 
-// DeleteMessage mocks the delete message
-func (ms *MockSQS) DeleteMessage(dmi *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
-	args := ms.Called(dmi)
+// DeleteMessageWithContext mocks the delete message
+func (ms *MockSQS) DeleteMessageWithContext(ctx aws.Context, dmi *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	args := ms.Called(ctx, dmi)
+	return nil, args.Error(1)
+}
+
+// SendMessageWithContext mocks the send message
+func (ms *MockSQS) SendMessageWithContext(ctx aws.Context, smi *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	args := ms.Called(ctx, smi)
 	return nil, args.Error(1)
 }
 
-// SendMessage mocks the send message
-func (ms *MockSQS) SendMessage(smi *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
-	args := ms.Called(smi)
+// ChangeMessageVisibilityWithContext mocks the change message visibility
+func (ms *MockSQS) ChangeMessageVisibilityWithContext(ctx aws.Context, cmvi *sqs.ChangeMessageVisibilityInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	args := ms.Called(ctx, cmvi)
 	return nil, args.Error(1)
 }
+
+// GetQueueAttributesWithContext mocks the read of the queue attributes
+func (ms *MockSQS) GetQueueAttributesWithContext(ctx aws.Context, gqai *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	args := ms.Called(ctx, gqai)
+	out, _ := args.Get(0).(*sqs.GetQueueAttributesOutput)
+	return out, args.Error(1)
+}
+
+// DeleteMessageBatchWithContext mocks the delete message batch
+func (ms *MockSQS) DeleteMessageBatchWithContext(ctx aws.Context, dmbi *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	args := ms.Called(ctx, dmbi)
+	return args.Get(0).(*sqs.DeleteMessageBatchOutput), args.Error(1)
+}
+
+// SendMessageBatchWithContext mocks the send message batch
+func (ms *MockSQS) SendMessageBatchWithContext(ctx aws.Context, smbi *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	args := ms.Called(ctx, smbi)
+	return args.Get(0).(*sqs.SendMessageBatchOutput), args.Error(1)
+}
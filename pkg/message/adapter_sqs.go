@@ -1,9 +1,17 @@
 package message
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
@@ -12,17 +20,64 @@ import (
 	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
 )
 
+// Limits of SQS
+const (
+	MaxVisibilityTimeout = 12 * time.Hour
+	MaxBatchSize         = 10
+	MaxBatchPayload      = 256 * 1024
+)
+
+// Message attributes attached to the messages moved to the DLQ
+// The timestamps are epoch milliseconds, like the SentTimestamp attribute of SQS
+const (
+	AttributeError            = "Error"
+	AttributeErrorClass       = "ErrorClass"
+	AttributeValidationErrors = "ValidationErrors"
+	AttributeDecodeFailure    = "DecodeFailure"
+	AttributeProvider         = "Provider"
+	AttributeReceiveCount     = "ReceiveCount"
+	AttributeMessageID        = "MessageId"
+	AttributeGroupID          = "MessageGroupId"
+	AttributeSentTimestamp    = "SentTimestamp"
+	AttributeMovedTimestamp   = "MovedTimestamp"
+)
+
+// requiredAttributeNames are the system attributes used by the handler
+var requiredAttributeNames = []string{
+	sqs.MessageSystemAttributeNameSentTimestamp,
+	sqs.MessageSystemAttributeNameApproximateReceiveCount,
+	sqs.MessageSystemAttributeNameMessageGroupId,
+	sqs.MessageSystemAttributeNameMessageDeduplicationId,
+}
+
+// Error classes of the messages moved to the DLQ
+const (
+	ErrorClassCritical    = "critical"
+	ErrorClassValidation  = "validation"
+	ErrorClassExhausted   = "exhausted"
+	ErrorClassUndecodable = "undecodable"
+	ErrorClassUnknown     = "unknown"
+)
+
 // SQSManager specifies a SQS manager interface
 type SQSManager interface {
-	ReceiveMessage(*sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error)
-	DeleteMessage(*sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error)
-	SendMessage(*sqs.SendMessageInput) (*sqs.SendMessageOutput, error)
+	ReceiveMessageWithContext(aws.Context, *sqs.ReceiveMessageInput, ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageWithContext(aws.Context, *sqs.DeleteMessageInput, ...request.Option) (*sqs.DeleteMessageOutput, error)
+	SendMessageWithContext(aws.Context, *sqs.SendMessageInput, ...request.Option) (*sqs.SendMessageOutput, error)
+	DeleteMessageBatchWithContext(aws.Context, *sqs.DeleteMessageBatchInput, ...request.Option) (*sqs.DeleteMessageBatchOutput, error)
+	SendMessageBatchWithContext(aws.Context, *sqs.SendMessageBatchInput, ...request.Option) (*sqs.SendMessageBatchOutput, error)
+	ChangeMessageVisibilityWithContext(aws.Context, *sqs.ChangeMessageVisibilityInput, ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error)
+	GetQueueAttributesWithContext(aws.Context, *sqs.GetQueueAttributesInput, ...request.Option) (*sqs.GetQueueAttributesOutput, error)
 }
 
 // SQSAdapter represents the SQS adapter
 type SQSAdapter struct {
 	config *config.Config
 	sqs    SQSManager
+	codec  *Codec
+
+	mu                sync.Mutex
+	visibilityTimeout time.Duration
 }
 
 // NewSQSAdapter creates a new SQS adapter
@@ -30,44 +85,82 @@ func NewSQSAdapter(c *config.Config, sqs SQSManager) *SQSAdapter {
 	a := &SQSAdapter{
 		config: c,
 		sqs:    sqs,
+		codec:  NewCodec(c),
 	}
 	return a
 }
 
 // GetMessages returns messages from SQS
-func (a *SQSAdapter) GetMessages() (Messages, error) {
-	result, err := a.sqs.ReceiveMessage(&sqs.ReceiveMessageInput{
-		AttributeNames: []*string{
-			aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
-		},
-		MessageAttributeNames: []*string{
-			aws.String(sqs.QueueAttributeNameAll),
-		},
-		QueueUrl:            &a.config.SqsQueueURL,
-		MaxNumberOfMessages: &a.config.SqsMaxNumberOfMessages,
-		WaitTimeSeconds:     aws.Int64(0),
-	})
+// A message that can't be decoded is quarantined on the DLQ, without affecting the other messages of the batch
+func (a *SQSAdapter) GetMessages(ctx context.Context) (Messages, []Quarantined, error) {
+	input := &sqs.ReceiveMessageInput{
+		AttributeNames:        aws.StringSlice(a.attributeNames()),
+		MessageAttributeNames: aws.StringSlice(a.config.SqsMessageAttributeNames),
+		QueueUrl:              &a.config.SqsQueueURL,
+		MaxNumberOfMessages:   &a.config.SqsMaxNumberOfMessages,
+		WaitTimeSeconds:       aws.Int64(a.config.SqsWaitTimeSeconds),
+	}
+	if a.config.SqsVisibilityTimeout > 0 {
+		input.VisibilityTimeout = aws.Int64(a.config.SqsVisibilityTimeout)
+	}
+	if a.config.SqsReceiveRequestAttemptID && IsFIFO(a.config.SqsQueueURL) {
+		// The SDK retries a failed receive with the same input, so the attempt id lets SQS return the same messages
+		input.ReceiveRequestAttemptId = aws.String(uuid.NewV4().String())
+	}
+	result, err := a.sqs.ReceiveMessageWithContext(ctx, input)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to read messages from SQS")
+		return nil, nil, errors.Wrap(err, "failed to read messages from SQS")
 	}
 
 	messages := Messages{}
+	var quarantined []Quarantined
 	for _, rm := range result.Messages {
-		m := Message{Id: rm.ReceiptHandle}
-		b := *rm.Body
-		if err := json.Unmarshal([]byte(b), &m); err != nil {
-			return nil, err
+		m := Message{
+			Id:       rm.ReceiptHandle,
+			Metadata: NewMetadata(aws.StringValue(rm.MessageId), aws.StringValueMap(rm.Attributes), messageAttributes(rm.MessageAttributes)),
 		}
-		messages = append(messages, m)
+		b := aws.StringValue(rm.Body)
+		d, err := a.codec.Decode([]byte(b))
+		if err != nil {
+			q := Quarantined{Id: rm.ReceiptHandle, Error: err.Error()}
+			if errQ := a.Quarantine(ctx, m, b, err); errQ != nil {
+				q.Error = errQ.Error()
+			}
+			quarantined = append(quarantined, q)
+			continue
+		}
+		// The receipt handle identifies the message, even when the body has an id (e.g. a message redriven from the DLQ)
+		d.Id = m.Id
+		d.Metadata = m.Metadata
+		messages = append(messages, d)
 	}
 
-	return messages, nil
+	return messages, quarantined, nil
+}
+
+// attributeNames returns the system attributes fetched with the messages, the ones used by the handler are always
+// fetched
+func (a *SQSAdapter) attributeNames() []string {
+	names := []string{}
+	seen := make(map[string]bool)
+	requested := make([]string, 0, len(a.config.SqsAttributeNames)+len(requiredAttributeNames))
+	requested = append(append(requested, a.config.SqsAttributeNames...), requiredAttributeNames...)
+	for _, n := range requested {
+		if n == sqs.QueueAttributeNameAll {
+			return []string{sqs.QueueAttributeNameAll}
+		}
+		if n != "" && !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	return names
 }
 
 // Delete message from SQS
-func (a *SQSAdapter) Delete(id *string) error {
-	_, err := a.sqs.DeleteMessage(&sqs.DeleteMessageInput{
+func (a *SQSAdapter) Delete(ctx context.Context, id *string) error {
+	_, err := a.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
 		QueueUrl:      &a.config.SqsQueueURL,
 		ReceiptHandle: id,
 	})
@@ -79,29 +172,378 @@ func (a *SQSAdapter) Delete(id *string) error {
 	return nil
 }
 
+// DeleteBatch deletes a list of messages from SQS, in batches of up to MaxBatchSize messages
+// The returned list has the error of each message in the same order of the ids, nil when the message was deleted
+func (a *SQSAdapter) DeleteBatch(ctx context.Context, ids []*string) []error {
+	errs := make([]error, len(ids))
+	for start := 0; start < len(ids); start += MaxBatchSize {
+		end := start + MaxBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		entries := make([]*sqs.DeleteMessageBatchRequestEntry, 0, end-start)
+		for i := start; i < end; i++ {
+			entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: ids[i],
+			})
+		}
+
+		result, err := a.sqs.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: &a.config.SqsQueueURL,
+			Entries:  entries,
+		})
+		if err != nil {
+			for i := start; i < end; i++ {
+				errs[i] = perrors.NewCriticalError("failed to delete messages from SQS")
+			}
+			continue
+		}
+		for _, f := range result.Failed {
+			if i, ok := batchIndex(f.Id, start, end); ok {
+				errs[i] = perrors.NewCriticalError("failed to delete messages from SQS")
+			}
+		}
+	}
+
+	return errs
+}
+
+// ChangeVisibility changes the time until the message is visible again in the main SQS
+// The timeout is truncated to seconds and limited to the maximum visibility timeout accepted by SQS
+func (a *SQSAdapter) ChangeVisibility(ctx context.Context, id *string, timeout time.Duration) error {
+	if timeout < 0 {
+		timeout = 0
+	}
+	if timeout > MaxVisibilityTimeout {
+		timeout = MaxVisibilityTimeout
+	}
+
+	_, err := a.sqs.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &a.config.SqsQueueURL,
+		ReceiptHandle:     id,
+		VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to change the message visibility")
+	}
+
+	return nil
+}
+
+// VisibilityTimeout returns how long the received messages are hidden: the configured visibility timeout or the
+// default one of the main SQS, which is read once
+func (a *SQSAdapter) VisibilityTimeout(ctx context.Context) (time.Duration, error) {
+	if a.config.SqsVisibilityTimeout > 0 {
+		return time.Duration(a.config.SqsVisibilityTimeout) * time.Second, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.visibilityTimeout > 0 {
+		return a.visibilityTimeout, nil
+	}
+
+	name := sqs.QueueAttributeNameVisibilityTimeout
+	out, err := a.sqs.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       &a.config.SqsQueueURL,
+		AttributeNames: []*string{aws.String(name)},
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read the visibility timeout of the queue")
+	}
+	seconds, err := strconv.Atoi(aws.StringValue(out.Attributes[name]))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read the visibility timeout of the queue")
+	}
+	a.visibilityTimeout = time.Duration(seconds) * time.Second
+	return a.visibilityTimeout, nil
+}
+
 // MoveToFailed moves the message directly to the list of failed messages (DLQ)
-func (a *SQSAdapter) MoveToFailed(m Message) error {
-	body, err := json.Marshal(m)
+// The reason, its class and the origin of the message are attached to the DLQ message, validation errors are attached
+// as a JSON list of the invalid fields
+func (a *SQSAdapter) MoveToFailed(ctx context.Context, m Message, reason error) error {
+	body, attributes, err := failedMessage(m, reason)
 	if err != nil {
-		return errors.Wrap(err, "failed to marshal message")
+		return err
 	}
+	return a.sendToFailed(ctx, m, body, attributes)
+}
 
-	// Send the message to the DLQ
-	id := string(uuid.NewV4().String())
-	_, err = a.sqs.SendMessage(&sqs.SendMessageInput{
-		MessageBody:            aws.String(string(body)),
-		QueueUrl:               aws.String(a.config.SqsDLQQueueURL),
-		MessageGroupId:         &id,
-		MessageDeduplicationId: &id,
+// MoveToFailedBatch moves a list of messages directly to the list of failed messages (DLQ), like MoveToFailed
+// The messages are sent to the DLQ in batches of up to MaxBatchSize messages and MaxBatchPayload bytes, then the sent
+// ones are deleted from the main SQS in batches
+// The returned list has the error of each message in the same order of the list, nil when the message was moved
+func (a *SQSAdapter) MoveToFailedBatch(ctx context.Context, failed []Failed) []error {
+	errs := make([]error, len(failed))
+	inputs := make([]*sqs.SendMessageInput, len(failed))
+	for i, f := range failed {
+		body, attributes, err := failedMessage(f.Message, f.Reason)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		inputs[i] = a.failedInput(f.Message, body, attributes)
+	}
+
+	// Send the messages to the DLQ, a chunk is sent when the next message doesn't fit in it
+	sent := []int{}
+	chunk := []int{}
+	size := 0
+	flush := func() {
+		if len(chunk) > 0 {
+			sent = append(sent, a.sendBatchToFailed(ctx, inputs, chunk, errs)...)
+		}
+		chunk = chunk[:0]
+		size = 0
+	}
+	for i, input := range inputs {
+		if input == nil {
+			continue
+		}
+		s := inputSize(input)
+		if len(chunk) == MaxBatchSize || (len(chunk) > 0 && size+s > MaxBatchPayload) {
+			flush()
+		}
+		chunk = append(chunk, i)
+		size += s
+	}
+	flush()
+
+	// Delete the sent messages from the main SQS
+	ids := make([]*string, len(sent))
+	for j, i := range sent {
+		ids[j] = failed[i].Message.Id
+	}
+	for j, err := range a.DeleteBatch(ctx, ids) {
+		if err != nil {
+			errs[sent[j]] = errors.Wrap(err, "failed to delete the message from the main SQS")
+		}
+	}
+
+	return errs
+}
+
+// sendBatchToFailed sends the inputs of the chunk to the DLQ in a single batch, setting the error of the messages that
+// were not sent. It returns the indexes of the sent messages
+func (a *SQSAdapter) sendBatchToFailed(ctx context.Context, inputs []*sqs.SendMessageInput, chunk []int, errs []error) []int {
+	entries := make([]*sqs.SendMessageBatchRequestEntry, 0, len(chunk))
+	for _, i := range chunk {
+		input := inputs[i]
+		entries = append(entries, &sqs.SendMessageBatchRequestEntry{
+			Id:                     aws.String(strconv.Itoa(i)),
+			MessageBody:            input.MessageBody,
+			MessageAttributes:      input.MessageAttributes,
+			MessageGroupId:         input.MessageGroupId,
+			MessageDeduplicationId: input.MessageDeduplicationId,
+		})
+	}
+
+	result, err := a.sqs.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(a.config.SqsDLQQueueURL),
+		Entries:  entries,
 	})
+	if err != nil {
+		for _, i := range chunk {
+			errs[i] = errors.Wrap(err, "failed to create the on the DLQ")
+		}
+		return nil
+	}
+
+	failed := make(map[int]bool)
+	for _, f := range result.Failed {
+		if i, ok := batchIndex(f.Id, chunk[0], chunk[len(chunk)-1]+1); ok {
+			failed[i] = true
+			errs[i] = errors.Errorf("failed to create the on the DLQ: %s: %s", aws.StringValue(f.Code), aws.StringValue(f.Message))
+		}
+	}
+	sent := []int{}
+	for _, i := range chunk {
+		if !failed[i] {
+			sent = append(sent, i)
+		}
+	}
+	return sent
+}
+
+// Quarantine moves a message that can't be decoded to the list of failed messages (DLQ)
+// The raw body is kept as the DLQ message body and the decode error is attached to it, the message only has the
+// values that come from the queue
+func (a *SQSAdapter) Quarantine(ctx context.Context, m Message, body string, reason error) error {
+	attributes := quarantineAttributes(m, reason)
+	if err := a.sendToFailed(ctx, m, body, attributes); err != nil {
+		return errors.Wrap(err, "failed to quarantine the message")
+	}
+	return nil
+}
+
+// sendToFailed sends a message body to the DLQ and deletes the original message from the main SQS
+// On a FIFO DLQ the message keeps its original group, so the failed messages of a group stay in order, and gets a
+// deduplication id derived from the original message, so a retried move doesn't duplicate it
+func (a *SQSAdapter) sendToFailed(ctx context.Context, m Message, body string, attributes map[string]*sqs.MessageAttributeValue) error {
+	// Send the message to the DLQ
+	_, err := a.sqs.SendMessageWithContext(ctx, a.failedInput(m, body, attributes))
 	if err != nil {
 		return errors.Wrap(err, "failed to create the on the DLQ")
 	}
 
 	// Delete the message from the main SQS
-	if err := a.Delete(m.Id); err != nil {
+	if err := a.Delete(ctx, m.Id); err != nil {
 		return errors.Wrap(err, "failed to delete the message from the main SQS")
 	}
 
 	return nil
 }
+
+// failedInput creates the input to send a message to the DLQ
+func (a *SQSAdapter) failedInput(m Message, body string, attributes map[string]*sqs.MessageAttributeValue) *sqs.SendMessageInput {
+	input := &sqs.SendMessageInput{
+		MessageBody:       aws.String(body),
+		MessageAttributes: attributes,
+		QueueUrl:          aws.String(a.config.SqsDLQQueueURL),
+	}
+	if IsFIFO(a.config.SqsDLQQueueURL) {
+		groupID := m.Metadata.GroupID
+		if groupID == "" {
+			groupID = uuid.NewV4().String()
+		}
+		input.MessageGroupId = aws.String(groupID)
+		input.MessageDeduplicationId = aws.String(failedDeduplicationID(m, body))
+	}
+	return input
+}
+
+// failedMessage returns the body and the attributes of a message moved to the DLQ because of the reason
+func failedMessage(m Message, reason error) (string, map[string]*sqs.MessageAttributeValue, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to marshal message")
+	}
+
+	attributes := failedAttributes(m, reason, errorClass(reason))
+	if p := m.ResolvedProvider(); p != "" {
+		attributes[AttributeProvider] = stringAttribute(p)
+	}
+	if verr, ok := reason.(*perrors.ValidationError); ok {
+		b, err := json.Marshal(verr.Errors)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "failed to marshal validation errors")
+		}
+		attributes[AttributeValidationErrors] = stringAttribute(string(b))
+	}
+
+	return string(body), attributes, nil
+}
+
+// inputSize returns the size of a message counted by SQS in the payload limit, the body and the attributes
+func inputSize(input *sqs.SendMessageInput) int {
+	size := len(aws.StringValue(input.MessageBody))
+	for name, a := range input.MessageAttributes {
+		size += len(name) + len(aws.StringValue(a.DataType)) + len(aws.StringValue(a.StringValue))
+	}
+	return size
+}
+
+// batchIndex returns the index of a batch entry id, which must be between start and end (exclusive)
+func batchIndex(id *string, start, end int) (int, bool) {
+	i, err := strconv.Atoi(aws.StringValue(id))
+	if err != nil || i < start || i >= end {
+		return 0, false
+	}
+	return i, true
+}
+
+// IsFIFO checks if the queue URL is of a FIFO queue, the names of the FIFO queues end with .fifo
+func IsFIFO(queueURL string) bool {
+	return strings.HasSuffix(queueURL, ".fifo")
+}
+
+// failedDeduplicationID returns the deduplication id of a message moved to the DLQ, derived from the original message
+// id and deduplication id, or from the body when both are unknown
+func failedDeduplicationID(m Message, body string) string {
+	source := m.Metadata.MessageID + ":" + m.Metadata.DeduplicationID
+	if m.Metadata.MessageID == "" && m.Metadata.DeduplicationID == "" {
+		source = body
+	}
+	sum := sha256.Sum256([]byte("failed:" + source))
+	return hex.EncodeToString(sum[:])
+}
+
+// errorClass returns the class of the error that moved a message to the DLQ
+func errorClass(err error) string {
+	switch err.(type) {
+	case *perrors.CriticalError:
+		return ErrorClassCritical
+	case *perrors.ValidationError:
+		return ErrorClassValidation
+	case *perrors.AttemptsExhaustedError:
+		return ErrorClassExhausted
+	case *perrors.DecodeError:
+		return ErrorClassUndecodable
+	}
+	return ErrorClassUnknown
+}
+
+// failedAttributes returns the attributes shared by all the messages sent to the DLQ, the values that are unknown
+// are not attached
+func failedAttributes(m Message, reason error, class string) map[string]*sqs.MessageAttributeValue {
+	attributes := map[string]*sqs.MessageAttributeValue{
+		AttributeErrorClass:     stringAttribute(class),
+		AttributeMovedTimestamp: numberAttribute(formatTimestamp(time.Now())),
+	}
+	if reason != nil {
+		attributes[AttributeError] = stringAttribute(reason.Error())
+	}
+	md := m.Metadata
+	if md.ReceiveCount > 0 {
+		attributes[AttributeReceiveCount] = numberAttribute(strconv.Itoa(md.ReceiveCount))
+	}
+	if md.MessageID != "" {
+		attributes[AttributeMessageID] = stringAttribute(md.MessageID)
+	}
+	if md.GroupID != "" {
+		attributes[AttributeGroupID] = stringAttribute(md.GroupID)
+	}
+	if !md.SentAt.IsZero() {
+		attributes[AttributeSentTimestamp] = numberAttribute(formatTimestamp(md.SentAt))
+	}
+	return attributes
+}
+
+// quarantineAttributes returns the attributes of a message that can't be decoded, moved to the DLQ
+func quarantineAttributes(m Message, reason error) map[string]*sqs.MessageAttributeValue {
+	attributes := failedAttributes(m, reason, ErrorClassUndecodable)
+	if derr, ok := reason.(*perrors.DecodeError); ok {
+		attributes[AttributeDecodeFailure] = stringAttribute(derr.Reason)
+	}
+	return attributes
+}
+
+// messageAttributes returns the values of the string and number message attributes
+func messageAttributes(attributes map[string]*sqs.MessageAttributeValue) map[string]string {
+	values := make(map[string]string)
+	for name, a := range attributes {
+		if a != nil && a.StringValue != nil {
+			values[name] = *a.StringValue
+		}
+	}
+	return values
+}
+
+// stringAttribute creates a SQS message attribute of the string type
+func stringAttribute(v string) *sqs.MessageAttributeValue {
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("String"),
+		StringValue: aws.String(v),
+	}
+}
+
+// numberAttribute creates a SQS message attribute of the number type
+func numberAttribute(v string) *sqs.MessageAttributeValue {
+	return &sqs.MessageAttributeValue{
+		DataType:    aws.String("Number"),
+		StringValue: aws.String(v),
+	}
+}
@@ -1,13 +1,17 @@
 package message_test
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -16,14 +20,16 @@ import (
 func TestSQSAdapter_GetMessages(t *testing.T) {
 
 	messageId := "123"
+	quarantinedId := "456"
 
 	tests := []struct {
 		name                 string
 		receiveMessageOutput *sqs.ReceiveMessageOutput
 		receiveMessageError  error
+		sendError            error
 		want                 message.Messages
+		wantQuarantined      []message.Quarantined
 		wantError            error
-		wantErrorType        interface{}
 	}{
 		{
 			name: "returned messages successfully",
@@ -38,9 +44,96 @@ func TestSQSAdapter_GetMessages(t *testing.T) {
 			},
 			want: message.Messages{
 				message.Message{
-					Id:       &messageId,
-					Provider: "test",
-					Order:    message.Order{},
+					SchemaVersion: 1,
+					Id:            &messageId,
+					Provider:      "test",
+					Order:         message.Order{},
+					Metadata:      message.Metadata{MessageID: "123"},
+				},
+			},
+		},
+		{
+			name: "returned messages with the queue values",
+			receiveMessageOutput: &sqs.ReceiveMessageOutput{
+				Messages: []*sqs.Message{
+					{
+						MessageId:     aws.String("123"),
+						ReceiptHandle: aws.String("123"),
+						Body:          aws.String(`{"provider":"test"}`),
+						Attributes: map[string]*string{
+							sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("3"),
+							sqs.MessageSystemAttributeNameSentTimestamp:           aws.String("1546300800123"),
+							sqs.MessageSystemAttributeNameMessageGroupId:          aws.String("group-1"),
+							sqs.MessageSystemAttributeNameMessageDeduplicationId:  aws.String("dedup-1"),
+						},
+					},
+				},
+			},
+			want: message.Messages{
+				message.Message{
+					SchemaVersion: 1,
+					Id:            &messageId,
+					Provider:      "test",
+					Metadata: message.Metadata{
+						MessageID:       "123",
+						GroupID:         "group-1",
+						DeduplicationID: "dedup-1",
+						SentAt:          time.Unix(1546300800, 123000000).UTC(),
+						ReceiveCount:    3,
+						Attributes: map[string]string{
+							sqs.MessageSystemAttributeNameApproximateReceiveCount: "3",
+							sqs.MessageSystemAttributeNameSentTimestamp:           "1546300800123",
+							sqs.MessageSystemAttributeNameMessageGroupId:          "group-1",
+							sqs.MessageSystemAttributeNameMessageDeduplicationId:  "dedup-1",
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "returned messages with the message attributes",
+			receiveMessageOutput: &sqs.ReceiveMessageOutput{
+				Messages: []*sqs.Message{
+					{
+						MessageId:     aws.String("123"),
+						ReceiptHandle: aws.String("123"),
+						Body:          aws.String(`{"provider":"test"}`),
+						MessageAttributes: map[string]*sqs.MessageAttributeValue{
+							"TraceId": {DataType: aws.String("String"), StringValue: aws.String("trace-1")},
+							"Image":   {DataType: aws.String("Binary"), BinaryValue: []byte("test")},
+						},
+					},
+				},
+			},
+			want: message.Messages{
+				message.Message{
+					SchemaVersion: 1,
+					Id:            &messageId,
+					Provider:      "test",
+					Metadata: message.Metadata{
+						MessageID:         "123",
+						MessageAttributes: map[string]string{"TraceId": "trace-1"},
+					},
+				},
+			},
+		},
+		{
+			name: "returned messages with the receipt handle over the body id",
+			receiveMessageOutput: &sqs.ReceiveMessageOutput{
+				Messages: []*sqs.Message{
+					{
+						MessageId:     aws.String("123"),
+						ReceiptHandle: aws.String("123"),
+						Body:          aws.String(`{"id":"old-receipt","provider":"test"}`),
+					},
+				},
+			},
+			want: message.Messages{
+				message.Message{
+					SchemaVersion: 1,
+					Id:            &messageId,
+					Provider:      "test",
+					Metadata:      message.Metadata{MessageID: "123"},
 				},
 			},
 		},
@@ -50,32 +143,173 @@ func TestSQSAdapter_GetMessages(t *testing.T) {
 			wantError:           errors.New("test"),
 		},
 		{
-			name: "failed by unmarshal message body",
+			name: "message with invalid body quarantined",
 			receiveMessageOutput: &sqs.ReceiveMessageOutput{
 				Messages: []*sqs.Message{
 					{
 						MessageId:     aws.String("123"),
 						ReceiptHandle: aws.String("123"),
+						Body:          aws.String(`{"provider":"test"}`),
+					},
+					{
+						MessageId:     aws.String("456"),
+						ReceiptHandle: aws.String("456"),
+						Body:          aws.String(`this is not a valid json body`),
+					},
+				},
+			},
+			want: message.Messages{
+				message.Message{
+					SchemaVersion: 1,
+					Id:            &messageId,
+					Provider:      "test",
+					Metadata:      message.Metadata{MessageID: "123"},
+				},
+			},
+			wantQuarantined: []message.Quarantined{
+				{Id: &quarantinedId, Error: "failed to decode the message (malformed): invalid character 'h' in literal true (expecting 'r')"},
+			},
+		},
+		{
+			name: "message with invalid body failed to be quarantined",
+			receiveMessageOutput: &sqs.ReceiveMessageOutput{
+				Messages: []*sqs.Message{
+					{
+						MessageId:     aws.String("456"),
+						ReceiptHandle: aws.String("456"),
 						Body:          aws.String(`this is not a valid json body`),
 					},
 				},
 			},
-			wantErrorType: &json.SyntaxError{},
+			sendError: errors.New("test"),
+			want:      message.Messages{},
+			wantQuarantined: []message.Quarantined{
+				{Id: &quarantinedId, Error: "failed to quarantine the message: failed to create the on the DLQ: test"},
+			},
 		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			mockSQS := new(message.MockSQS)
-			mockSQS.On("ReceiveMessage", mock.AnythingOfType("*sqs.ReceiveMessageInput")).
+			mockSQS.On("ReceiveMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.ReceiveMessageInput")).
 				Return(tc.receiveMessageOutput, tc.receiveMessageError)
+			mockSQS.On("SendMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.SendMessageInput")).
+				Return(nil, tc.sendError)
+			mockSQS.On("DeleteMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageInput")).
+				Return(nil, nil)
 
 			sa := message.NewSQSAdapter(&config.Config{}, mockSQS)
-			messages, err := sa.GetMessages()
+			messages, quarantined, err := sa.GetMessages(context.TODO())
 
 			assert.Equal(t, tc.want, messages)
-			if err != nil && tc.wantErrorType != nil {
-				assert.IsType(t, tc.wantErrorType, err)
+			assert.Equal(t, tc.wantQuarantined, quarantined)
+			if tc.wantError != nil {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestSQSAdapter_GetMessages_Input(t *testing.T) {
+
+	tests := []struct {
+		name                        string
+		config                      *config.Config
+		wantAttributeNames          []*string
+		wantMessageAttributeNames   []*string
+		wantWaitTimeSeconds         int64
+		wantVisibilityTimeout       *int64
+		wantReceiveRequestAttemptID bool
+	}{
+		{
+			name:   "default input",
+			config: &config.Config{SqsQueueURL: "http://sqs.host/payments"},
+			wantAttributeNames: aws.StringSlice([]string{
+				sqs.MessageSystemAttributeNameSentTimestamp,
+				sqs.MessageSystemAttributeNameApproximateReceiveCount,
+				sqs.MessageSystemAttributeNameMessageGroupId,
+				sqs.MessageSystemAttributeNameMessageDeduplicationId,
+			}),
+			wantMessageAttributeNames: []*string{},
+		},
+		{
+			name: "long polling with a visibility timeout override",
+			config: &config.Config{
+				SqsQueueURL:          "http://sqs.host/payments",
+				SqsWaitTimeSeconds:   20,
+				SqsVisibilityTimeout: 90,
+				SqsAttributeNames:    []string{"All"},
+			},
+			wantAttributeNames:        aws.StringSlice([]string{"All"}),
+			wantMessageAttributeNames: []*string{},
+			wantWaitTimeSeconds:       20,
+			wantVisibilityTimeout:     aws.Int64(90),
+		},
+		{
+			name: "selected attributes merged with the required ones",
+			config: &config.Config{
+				SqsQueueURL:              "http://sqs.host/payments",
+				SqsAttributeNames:        []string{"SenderId", "SentTimestamp"},
+				SqsMessageAttributeNames: []string{"TraceId"},
+			},
+			wantAttributeNames: aws.StringSlice([]string{
+				sqs.MessageSystemAttributeNameSenderId,
+				sqs.MessageSystemAttributeNameSentTimestamp,
+				sqs.MessageSystemAttributeNameApproximateReceiveCount,
+				sqs.MessageSystemAttributeNameMessageGroupId,
+				sqs.MessageSystemAttributeNameMessageDeduplicationId,
+			}),
+			wantMessageAttributeNames: aws.StringSlice([]string{"TraceId"}),
+		},
+		{
+			name: "receive request attempt id on a FIFO queue",
+			config: &config.Config{
+				SqsQueueURL:                "http://sqs.host/payments.fifo",
+				SqsReceiveRequestAttemptID: true,
+				SqsAttributeNames:          []string{"All"},
+				SqsMessageAttributeNames:   []string{"All"},
+			},
+			wantAttributeNames:          aws.StringSlice([]string{"All"}),
+			wantMessageAttributeNames:   aws.StringSlice([]string{"All"}),
+			wantReceiveRequestAttemptID: true,
+		},
+		{
+			name: "no receive request attempt id on a standard queue",
+			config: &config.Config{
+				SqsQueueURL:                "http://sqs.host/payments",
+				SqsReceiveRequestAttemptID: true,
+				SqsAttributeNames:          []string{"All"},
+				SqsMessageAttributeNames:   []string{"All"},
+			},
+			wantAttributeNames:        aws.StringSlice([]string{"All"}),
+			wantMessageAttributeNames: aws.StringSlice([]string{"All"}),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var input *sqs.ReceiveMessageInput
+			mockSQS := new(message.MockSQS)
+			mockSQS.On("ReceiveMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.ReceiveMessageInput")).
+				Run(func(args mock.Arguments) { input = args.Get(1).(*sqs.ReceiveMessageInput) }).
+				Return(&sqs.ReceiveMessageOutput{}, nil)
+
+			sa := message.NewSQSAdapter(tc.config, mockSQS)
+			_, _, err := sa.GetMessages(context.TODO())
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.config.SqsQueueURL, aws.StringValue(input.QueueUrl))
+			assert.Equal(t, tc.wantAttributeNames, input.AttributeNames)
+			assert.Equal(t, tc.wantMessageAttributeNames, input.MessageAttributeNames)
+			assert.Equal(t, tc.wantWaitTimeSeconds, aws.Int64Value(input.WaitTimeSeconds))
+			assert.Equal(t, tc.wantVisibilityTimeout, input.VisibilityTimeout)
+			if tc.wantReceiveRequestAttemptID {
+				assert.NotEmpty(t, aws.StringValue(input.ReceiveRequestAttemptId))
+			} else {
+				assert.Nil(t, input.ReceiveRequestAttemptId)
 			}
 		})
 	}
@@ -106,11 +340,11 @@ func TestSQSAdapter_Delete(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			mockSQS := new(message.MockSQS)
-			mockSQS.On("DeleteMessage", mock.AnythingOfType("*sqs.DeleteMessageInput")).
+			mockSQS.On("DeleteMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageInput")).
 				Return(nil, tc.deleteError)
 
 			sa := message.NewSQSAdapter(&config.Config{}, mockSQS)
-			err := sa.Delete(tc.messageId)
+			err := sa.Delete(context.TODO(), tc.messageId)
 
 			if tc.wantError {
 				assert.NotNil(t, err)
@@ -121,22 +355,390 @@ func TestSQSAdapter_Delete(t *testing.T) {
 	}
 }
 
-func TestSQSAdapter_MoveToFailed(t *testing.T) {
+func TestSQSAdapter_ChangeVisibility(t *testing.T) {
 
 	messageId := "123"
 
 	tests := []struct {
 		name        string
-		message     message.Message
-		sendError   error
-		deleteError error
+		timeout     time.Duration
+		changeError error
+		wantTimeout int64
 		wantError   bool
+	}{
+		{
+			name:        "visibility changed successfully",
+			timeout:     90*time.Second + 500*time.Millisecond,
+			wantTimeout: 90,
+		},
+		{
+			name:        "visibility limited to the SQS maximum",
+			timeout:     24 * time.Hour,
+			wantTimeout: 43200,
+		},
+		{
+			name:        "negative visibility",
+			timeout:     -time.Second,
+			wantTimeout: 0,
+		},
+		{
+			name:        "visibility change failed",
+			timeout:     time.Minute,
+			changeError: errors.New("test"),
+			wantTimeout: 60,
+			wantError:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockSQS := new(message.MockSQS)
+			mockSQS.On("ChangeMessageVisibilityWithContext", mock.Anything, mock.AnythingOfType("*sqs.ChangeMessageVisibilityInput")).
+				Return(nil, tc.changeError)
+
+			sa := message.NewSQSAdapter(&config.Config{SqsQueueURL: "http://sqs.host/"}, mockSQS)
+			err := sa.ChangeVisibility(context.TODO(), &messageId, tc.timeout)
+
+			cmvi := mockSQS.Calls[0].Arguments.Get(1).(*sqs.ChangeMessageVisibilityInput)
+			assert.Equal(t, "http://sqs.host/", *cmvi.QueueUrl)
+			assert.Equal(t, messageId, *cmvi.ReceiptHandle)
+			assert.Equal(t, tc.wantTimeout, *cmvi.VisibilityTimeout)
+			if tc.wantError {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestSQSAdapter_VisibilityTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		configured  int64
+		attributes  map[string]*string
+		readError   error
+		wantTimeout time.Duration
+		wantReads   int
+		wantError   bool
+	}{
+		{
+			name:        "configured visibility timeout",
+			configured:  300,
+			wantTimeout: 5 * time.Minute,
+			wantReads:   0,
+		},
+		{
+			name:        "visibility timeout of the queue read once",
+			attributes:  map[string]*string{"VisibilityTimeout": aws.String("900")},
+			wantTimeout: 15 * time.Minute,
+			wantReads:   1,
+		},
+		{
+			name:       "invalid visibility timeout of the queue",
+			attributes: map[string]*string{},
+			wantReads:  2,
+			wantError:  true,
+		},
+		{
+			name:      "failed to read the visibility timeout of the queue",
+			readError: errors.New("test"),
+			wantReads: 2,
+			wantError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockSQS := new(message.MockSQS)
+			mockSQS.On("GetQueueAttributesWithContext", mock.Anything, mock.AnythingOfType("*sqs.GetQueueAttributesInput")).
+				Return(&sqs.GetQueueAttributesOutput{Attributes: tc.attributes}, tc.readError)
+
+			c := &config.Config{SqsQueueURL: "http://sqs.host/", SqsVisibilityTimeout: tc.configured}
+			sa := message.NewSQSAdapter(c, mockSQS)
+
+			// The visibility timeout of the queue is cached after the first successful read
+			for i := 0; i < 2; i++ {
+				timeout, err := sa.VisibilityTimeout(context.TODO())
+				assert.Equal(t, tc.wantTimeout, timeout)
+				if tc.wantError {
+					assert.NotNil(t, err)
+				} else {
+					assert.Nil(t, err)
+				}
+			}
+
+			assert.Len(t, mockSQS.Calls, tc.wantReads)
+			if tc.wantReads > 0 {
+				gqai := mockSQS.Calls[0].Arguments.Get(1).(*sqs.GetQueueAttributesInput)
+				assert.Equal(t, "http://sqs.host/", *gqai.QueueUrl)
+				assert.Equal(t, []*string{aws.String("VisibilityTimeout")}, gqai.AttributeNames)
+			}
+		})
+	}
+}
+
+func TestSQSAdapter_DeleteBatch(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		size      int
+		failedIDs []string
+		callError error
+		wantCalls int
+		wantErrs  []int
+	}{
+		{
+			name:      "messages deleted in batches",
+			size:      25,
+			wantCalls: 3,
+		},
+		{
+			name:      "message failed in the batch",
+			size:      12,
+			failedIDs: []string{"1", "11"},
+			wantCalls: 2,
+			wantErrs:  []int{1, 11},
+		},
+		{
+			name:      "batch failed",
+			size:      3,
+			callError: errors.New("test"),
+			wantCalls: 1,
+			wantErrs:  []int{0, 1, 2},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			output := &sqs.DeleteMessageBatchOutput{}
+			for _, id := range tc.failedIDs {
+				output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{Id: aws.String(id), Code: aws.String("ReceiptHandleIsInvalid")})
+			}
+			mockSQS := new(message.MockSQS)
+			mockSQS.On("DeleteMessageBatchWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageBatchInput")).
+				Return(output, tc.callError)
+
+			ids := make([]*string, tc.size)
+			for i := range ids {
+				ids[i] = aws.String(strconv.Itoa(i))
+			}
+
+			sa := message.NewSQSAdapter(&config.Config{SqsQueueURL: "http://sqs.host/"}, mockSQS)
+			errs := sa.DeleteBatch(context.TODO(), ids)
+
+			assert.Len(t, errs, tc.size)
+			mockSQS.AssertNumberOfCalls(t, "DeleteMessageBatchWithContext", tc.wantCalls)
+			for _, call := range mockSQS.Calls {
+				assert.True(t, len(call.Arguments.Get(1).(*sqs.DeleteMessageBatchInput).Entries) <= message.MaxBatchSize)
+			}
+			wantErrs := make(map[int]bool)
+			for _, i := range tc.wantErrs {
+				wantErrs[i] = true
+			}
+			for i, err := range errs {
+				if wantErrs[i] {
+					assert.IsType(t, &perrors.CriticalError{}, err)
+				} else {
+					assert.Nil(t, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSQSAdapter_MoveToFailedBatch(t *testing.T) {
+
+	newFailed := func(n int, body string) []message.Failed {
+		failed := make([]message.Failed, n)
+		for i := range failed {
+			failed[i] = message.Failed{
+				Message: message.Message{Id: aws.String(strconv.Itoa(i)), Provider: body},
+				Reason:  perrors.NewCriticalError("test"),
+			}
+		}
+		return failed
+	}
+
+	tests := []struct {
+		name            string
+		failed          []message.Failed
+		sendFailedIDs   []string
+		sendError       error
+		deleteFailedIDs []string
+		wantSendCalls   int
+		wantDeleted     int
+		wantErrs        []int
+	}{
+		{
+			name:          "messages moved in batches",
+			failed:        newFailed(15, "Example"),
+			wantSendCalls: 2,
+			wantDeleted:   15,
+		},
+		{
+			name:          "messages moved in batches limited by the payload",
+			failed:        newFailed(3, strings.Repeat("x", 60*1024)),
+			wantSendCalls: 2,
+			wantDeleted:   3,
+		},
+		{
+			name:          "message failed to be sent",
+			failed:        newFailed(3, "Example"),
+			sendFailedIDs: []string{"1"},
+			wantSendCalls: 1,
+			wantDeleted:   2,
+			wantErrs:      []int{1},
+		},
+		{
+			name:          "batch failed to be sent",
+			failed:        newFailed(3, "Example"),
+			sendError:     errors.New("test"),
+			wantSendCalls: 1,
+			wantErrs:      []int{0, 1, 2},
+		},
+		{
+			name:            "message failed to be deleted",
+			failed:          newFailed(3, "Example"),
+			deleteFailedIDs: []string{"2"},
+			wantSendCalls:   1,
+			wantDeleted:     3,
+			wantErrs:        []int{2},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sendOutput := &sqs.SendMessageBatchOutput{}
+			for _, id := range tc.sendFailedIDs {
+				sendOutput.Failed = append(sendOutput.Failed, &sqs.BatchResultErrorEntry{Id: aws.String(id), Code: aws.String("InternalError")})
+			}
+			deleteOutput := &sqs.DeleteMessageBatchOutput{}
+			for _, id := range tc.deleteFailedIDs {
+				deleteOutput.Failed = append(deleteOutput.Failed, &sqs.BatchResultErrorEntry{Id: aws.String(id), Code: aws.String("InternalError")})
+			}
+			mockSQS := new(message.MockSQS)
+			mockSQS.On("SendMessageBatchWithContext", mock.Anything, mock.AnythingOfType("*sqs.SendMessageBatchInput")).
+				Return(sendOutput, tc.sendError)
+			mockSQS.On("DeleteMessageBatchWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageBatchInput")).
+				Return(deleteOutput, nil)
+
+			sa := message.NewSQSAdapter(&config.Config{SqsDLQQueueURL: "http://sqs.host/payments-dlq.fifo"}, mockSQS)
+			errs := sa.MoveToFailedBatch(context.TODO(), tc.failed)
+
+			assert.Len(t, errs, len(tc.failed))
+			mockSQS.AssertNumberOfCalls(t, "SendMessageBatchWithContext", tc.wantSendCalls)
+			deleted := 0
+			for _, call := range mockSQS.Calls {
+				switch input := call.Arguments.Get(1).(type) {
+				case *sqs.SendMessageBatchInput:
+					assert.True(t, len(input.Entries) <= message.MaxBatchSize)
+					for _, e := range input.Entries {
+						assert.NotNil(t, e.MessageGroupId)
+						assert.NotNil(t, e.MessageDeduplicationId)
+						assert.Equal(t, "critical", *e.MessageAttributes[message.AttributeErrorClass].StringValue)
+					}
+				case *sqs.DeleteMessageBatchInput:
+					deleted += len(input.Entries)
+				}
+			}
+			assert.Equal(t, tc.wantDeleted, deleted)
+			wantErrs := make(map[int]bool)
+			for _, i := range tc.wantErrs {
+				wantErrs[i] = true
+			}
+			for i, err := range errs {
+				if wantErrs[i] {
+					assert.NotNil(t, err)
+				} else {
+					assert.Nil(t, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSQSAdapter_MoveToFailed(t *testing.T) {
+
+	messageId := "123"
+
+	tests := []struct {
+		name           string
+		message        message.Message
+		reason         error
+		sendError      error
+		deleteError    error
+		wantAttributes map[string]*sqs.MessageAttributeValue
+		wantError      bool
 	}{
 		{
 			name: "message moved successfully",
 			message: message.Message{
 				Id: &messageId,
 			},
+			reason: perrors.NewCriticalError("test"),
+			wantAttributes: map[string]*sqs.MessageAttributeValue{
+				message.AttributeError:      {DataType: aws.String("String"), StringValue: aws.String("test")},
+				message.AttributeErrorClass: {DataType: aws.String("String"), StringValue: aws.String("critical")},
+			},
+		},
+		{
+			name: "message moved successfully with the origin of the message",
+			message: message.Message{
+				Id:       &messageId,
+				Provider: "Example",
+				Metadata: message.Metadata{
+					MessageID:    "sqs-123",
+					SentAt:       time.Unix(1546300800, 123000000),
+					ReceiveCount: 5,
+				},
+			},
+			reason: perrors.NewAttemptsExhaustedError(5, errors.New("test")),
+			wantAttributes: map[string]*sqs.MessageAttributeValue{
+				message.AttributeError: {
+					DataType:    aws.String("String"),
+					StringValue: aws.String("attempts exhausted after 5 receives: test"),
+				},
+				message.AttributeErrorClass:    {DataType: aws.String("String"), StringValue: aws.String("exhausted")},
+				message.AttributeProvider:      {DataType: aws.String("String"), StringValue: aws.String("Example")},
+				message.AttributeReceiveCount:  {DataType: aws.String("Number"), StringValue: aws.String("5")},
+				message.AttributeMessageID:     {DataType: aws.String("String"), StringValue: aws.String("sqs-123")},
+				message.AttributeSentTimestamp: {DataType: aws.String("Number"), StringValue: aws.String("1546300800123")},
+			},
+		},
+		{
+			name: "message moved successfully with the provider chosen by the routing rules",
+			message: message.Message{
+				Id:       &messageId,
+				Provider: "auto",
+				Metadata: message.Metadata{RoutedProvider: "Example"},
+			},
+			reason: perrors.NewCriticalError("test"),
+			wantAttributes: map[string]*sqs.MessageAttributeValue{
+				message.AttributeError:      {DataType: aws.String("String"), StringValue: aws.String("test")},
+				message.AttributeErrorClass: {DataType: aws.String("String"), StringValue: aws.String("critical")},
+				message.AttributeProvider:   {DataType: aws.String("String"), StringValue: aws.String("Example")},
+			},
+		},
+		{
+			name: "message moved successfully with validation errors",
+			message: message.Message{
+				Id: &messageId,
+			},
+			reason: perrors.NewValidationError([]perrors.FieldError{
+				{Field: "order.id", Message: "is required"},
+			}),
+			wantAttributes: map[string]*sqs.MessageAttributeValue{
+				message.AttributeError: {
+					DataType:    aws.String("String"),
+					StringValue: aws.String("invalid message: order.id: is required"),
+				},
+				message.AttributeErrorClass: {DataType: aws.String("String"), StringValue: aws.String("validation")},
+				message.AttributeValidationErrors: {
+					DataType:    aws.String("String"),
+					StringValue: aws.String(`[{"field":"order.id","message":"is required"}]`),
+				},
+			},
 		},
 		{
 			name: "message moved failed due the send error",
@@ -159,19 +761,163 @@ func TestSQSAdapter_MoveToFailed(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			mockSQS := new(message.MockSQS)
-			mockSQS.On("SendMessage", mock.AnythingOfType("*sqs.SendMessageInput")).
+			mockSQS.On("SendMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.SendMessageInput")).
 				Return(nil, tc.sendError)
-			mockSQS.On("DeleteMessage", mock.AnythingOfType("*sqs.DeleteMessageInput")).
+			mockSQS.On("DeleteMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageInput")).
 				Return(nil, tc.deleteError)
 
 			sa := message.NewSQSAdapter(&config.Config{}, mockSQS)
-			err := sa.MoveToFailed(tc.message)
+			before := time.Now()
+			err := sa.MoveToFailed(context.TODO(), tc.message, tc.reason)
 
 			if tc.wantError {
 				assert.NotNil(t, err)
 			} else {
 				assert.Nil(t, err)
+				smi := mockSQS.Calls[0].Arguments.Get(1).(*sqs.SendMessageInput)
+				assertMovedTimestamp(t, before, smi.MessageAttributes)
+				assert.Equal(t, tc.wantAttributes, smi.MessageAttributes)
+			}
+		})
+	}
+}
+
+func TestSQSAdapter_MoveToFailed_FIFO(t *testing.T) {
+
+	messageId := "123"
+
+	tests := []struct {
+		name          string
+		dlqURL        string
+		message       message.Message
+		wantGroupID   *string
+		wantRandomGID bool
+	}{
+		{
+			name:        "original group kept on a FIFO DLQ",
+			dlqURL:      "http://sqs.host/payments-dlq.fifo",
+			message:     message.Message{Id: &messageId, Metadata: message.Metadata{MessageID: "sqs-123", GroupID: "group-1", DeduplicationID: "dedup-1"}},
+			wantGroupID: aws.String("group-1"),
+		},
+		{
+			name:          "new group on a FIFO DLQ when the original is unknown",
+			dlqURL:        "http://sqs.host/payments-dlq.fifo",
+			message:       message.Message{Id: &messageId, Metadata: message.Metadata{MessageID: "sqs-123"}},
+			wantRandomGID: true,
+		},
+		{
+			name:    "FIFO fields left out on a standard DLQ",
+			dlqURL:  "http://sqs.host/payments-dlq",
+			message: message.Message{Id: &messageId, Metadata: message.Metadata{MessageID: "sqs-123", GroupID: "group-1", DeduplicationID: "dedup-1"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockSQS := new(message.MockSQS)
+			mockSQS.On("SendMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.SendMessageInput")).Return(nil, nil)
+			mockSQS.On("DeleteMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageInput")).Return(nil, nil)
+
+			sa := message.NewSQSAdapter(&config.Config{SqsDLQQueueURL: tc.dlqURL}, mockSQS)
+			// A retried move sends the same deduplication id
+			assert.Nil(t, sa.MoveToFailed(context.TODO(), tc.message, perrors.NewCriticalError("test")))
+			assert.Nil(t, sa.MoveToFailed(context.TODO(), tc.message, perrors.NewCriticalError("test")))
+
+			first := mockSQS.Calls[0].Arguments.Get(1).(*sqs.SendMessageInput)
+			second := mockSQS.Calls[2].Arguments.Get(1).(*sqs.SendMessageInput)
+			if !message.IsFIFO(tc.dlqURL) {
+				assert.Nil(t, first.MessageGroupId)
+				assert.Nil(t, first.MessageDeduplicationId)
+				assert.Equal(t, "group-1", *first.MessageAttributes[message.AttributeGroupID].StringValue)
+				return
 			}
+			if tc.wantRandomGID {
+				assert.NotEmpty(t, *first.MessageGroupId)
+			} else {
+				assert.Equal(t, tc.wantGroupID, first.MessageGroupId)
+			}
+			assert.NotEmpty(t, *first.MessageDeduplicationId)
+			assert.Equal(t, *first.MessageDeduplicationId, *second.MessageDeduplicationId)
 		})
 	}
 }
+
+func TestSQSAdapter_Quarantine(t *testing.T) {
+
+	messageId := "123"
+
+	tests := []struct {
+		name              string
+		reason            error
+		sendError         error
+		deleteError       error
+		wantDecodeFailure string
+		wantError         bool
+	}{
+		{
+			name:   "message quarantined successfully",
+			reason: errors.New("invalid json"),
+		},
+		{
+			name:              "message quarantined with the decode failure",
+			reason:            perrors.NewDecodeError(perrors.DecodeUnknownField, 1, errors.New("invalid json")),
+			wantDecodeFailure: "unknown_field",
+		},
+		{
+			name:      "message quarantine failed due the send error",
+			reason:    errors.New("invalid json"),
+			sendError: errors.New("test"),
+			wantError: true,
+		},
+		{
+			name:        "message quarantine failed due the delete error",
+			reason:      errors.New("invalid json"),
+			deleteError: errors.New("test"),
+			wantError:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockSQS := new(message.MockSQS)
+			mockSQS.On("SendMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.SendMessageInput")).
+				Return(nil, tc.sendError)
+			mockSQS.On("DeleteMessageWithContext", mock.Anything, mock.AnythingOfType("*sqs.DeleteMessageInput")).
+				Return(nil, tc.deleteError)
+
+			sa := message.NewSQSAdapter(&config.Config{}, mockSQS)
+			m := message.Message{Id: &messageId, Metadata: message.Metadata{MessageID: "sqs-123", ReceiveCount: 1}}
+			err := sa.Quarantine(context.TODO(), m, "this is not a valid json body", tc.reason)
+
+			if tc.wantError {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			smi := mockSQS.Calls[0].Arguments.Get(1).(*sqs.SendMessageInput)
+			assert.Equal(t, "this is not a valid json body", *smi.MessageBody)
+			assert.Equal(t, tc.reason.Error(), *smi.MessageAttributes[message.AttributeError].StringValue)
+			assert.Equal(t, "undecodable", *smi.MessageAttributes[message.AttributeErrorClass].StringValue)
+			if tc.wantDecodeFailure != "" {
+				assert.Equal(t, tc.wantDecodeFailure, *smi.MessageAttributes[message.AttributeDecodeFailure].StringValue)
+			} else {
+				assert.Nil(t, smi.MessageAttributes[message.AttributeDecodeFailure])
+			}
+			assert.Equal(t, "sqs-123", *smi.MessageAttributes[message.AttributeMessageID].StringValue)
+			assert.Equal(t, "1", *smi.MessageAttributes[message.AttributeReceiveCount].StringValue)
+		})
+	}
+}
+
+// assertMovedTimestamp asserts the moved timestamp attribute is the current time and removes it from the attributes
+func assertMovedTimestamp(t *testing.T, before time.Time, attributes map[string]*sqs.MessageAttributeValue) {
+	a, ok := attributes[message.AttributeMovedTimestamp]
+	if !assert.True(t, ok, "moved timestamp attribute missing") {
+		return
+	}
+	assert.Equal(t, "Number", *a.DataType)
+	ms, err := strconv.ParseInt(*a.StringValue, 10, 64)
+	assert.Nil(t, err)
+	assert.True(t, ms >= before.UnixNano()/int64(time.Millisecond) && ms <= time.Now().UnixNano()/int64(time.Millisecond))
+	delete(attributes, message.AttributeMovedTimestamp)
+}
@@ -0,0 +1,174 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/pkg/errors"
+)
+
+// Schema versions of the message body
+// A body without a schema version is decoded as the first version, the format of the messages sent before the
+// versioning
+const (
+	SchemaVersion1       = 1
+	CurrentSchemaVersion = SchemaVersion1
+)
+
+// Decoder decodes a message body of a schema version
+// The decoder of the current version returns a Message, the decoders of the previous versions return the value that
+// the upgrade of the next version receives
+type Decoder func(body []byte, strict bool) (interface{}, error)
+
+// Upgrade upgrades a value decoded from the previous schema version to its own version
+type Upgrade func(v interface{}) (interface{}, error)
+
+// Codec decodes and encodes the message bodies
+// Each schema version has its decoder, an old body is decoded by the decoder of its version and upgraded version by
+// version to the current model. In strict mode the fields that the model doesn't have are rejected
+type Codec struct {
+	strict   bool
+	current  int
+	decoders map[int]Decoder
+	upgrades map[int]Upgrade
+}
+
+// NewCodec creates a new codec with the decoders of the known schema versions
+func NewCodec(c *config.Config) *Codec {
+	codec := &Codec{
+		strict:   c.MessageStrictDecoding,
+		decoders: make(map[int]Decoder),
+		upgrades: make(map[int]Upgrade),
+	}
+	codec.Register(SchemaVersion1, decodeV1, nil)
+	return codec
+}
+
+// Register registers the decoder of a schema version and the upgrade from the previous version to it
+// The highest registered version is the current one, the upgrade of the first version is not used
+func (c *Codec) Register(version int, d Decoder, u Upgrade) {
+	c.decoders[version] = d
+	if u != nil {
+		c.upgrades[version] = u
+	}
+	if version > c.current {
+		c.current = version
+	}
+}
+
+// Version returns the current schema version
+func (c *Codec) Version() int {
+	return c.current
+}
+
+// Decode decodes a message body and upgrades it to the current schema version
+// The returned error is a *errors.DecodeError with the reason of the failure
+func (c *Codec) Decode(body []byte) (Message, error) {
+	var envelope struct {
+		SchemaVersion *int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return Message{}, perrors.NewDecodeError(perrors.DecodeMalformed, 0, err)
+	}
+	version := SchemaVersion1
+	if envelope.SchemaVersion != nil {
+		version = *envelope.SchemaVersion
+	}
+
+	d, ok := c.decoders[version]
+	if !ok {
+		return Message{}, perrors.NewDecodeError(
+			perrors.DecodeUnsupportedVersion,
+			version,
+			fmt.Errorf("schema version %d is not supported, the supported versions are %s", version, c.versions()),
+		)
+	}
+	v, err := d(body, c.strict)
+	if err != nil {
+		if de, ok := err.(*perrors.DecodeError); ok {
+			de.Version = version
+			return Message{}, de
+		}
+		return Message{}, perrors.NewDecodeError(perrors.DecodeMalformed, version, err)
+	}
+
+	for next := version + 1; next <= c.current; next++ {
+		u, ok := c.upgrades[next]
+		if !ok {
+			return Message{}, perrors.NewDecodeError(
+				perrors.DecodeUpgradeFailed,
+				version,
+				fmt.Errorf("there is no upgrade from schema version %d to %d", next-1, next),
+			)
+		}
+		if v, err = u(v); err != nil {
+			return Message{}, perrors.NewDecodeError(
+				perrors.DecodeUpgradeFailed,
+				version,
+				errors.Wrapf(err, "failed to upgrade from schema version %d to %d", next-1, next),
+			)
+		}
+	}
+
+	m, ok := v.(Message)
+	if !ok {
+		return Message{}, perrors.NewDecodeError(
+			perrors.DecodeUpgradeFailed,
+			version,
+			fmt.Errorf("schema version %d was decoded as %T instead of a message", c.current, v),
+		)
+	}
+	m.SchemaVersion = c.current
+	return m, nil
+}
+
+// Encode encodes a message body with the current schema version
+func (c *Codec) Encode(m Message) ([]byte, error) {
+	m.SchemaVersion = c.current
+	return json.Marshal(m)
+}
+
+// versions returns the registered schema versions
+func (c *Codec) versions() string {
+	var versions []int
+	for v := range c.decoders {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return strings.Trim(fmt.Sprint(versions), "[]")
+}
+
+// DecodeJSON decodes a JSON body into v, in strict mode the fields that v doesn't have are rejected
+// The returned error is a *errors.DecodeError, to be used by the decoders of the schema versions
+func DecodeJSON(body []byte, v interface{}, strict bool) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		if strings.HasPrefix(err.Error(), "json: unknown field ") {
+			return perrors.NewDecodeError(perrors.DecodeUnknownField, 0, err)
+		}
+		return perrors.NewDecodeError(perrors.DecodeMalformed, 0, err)
+	}
+	// The body must have a single JSON value, as json.Unmarshal requires
+	if _, err := dec.Token(); err != io.EOF {
+		return perrors.NewDecodeError(perrors.DecodeMalformed, 0, errors.New("invalid data after the message"))
+	}
+	return nil
+}
+
+// decodeV1 decodes a message body of the first schema version
+func decodeV1(body []byte, strict bool) (interface{}, error) {
+	var m Message
+	if err := DecodeJSON(body, &m, strict); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
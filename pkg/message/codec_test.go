@@ -0,0 +1,218 @@
+package message_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec_Decode(t *testing.T) {
+
+	messageId := "123"
+
+	tests := []struct {
+		name        string
+		strict      bool
+		body        string
+		want        message.Message
+		wantReason  string
+		wantVersion int
+	}{
+		{
+			name: "message without schema version decoded as the first version",
+			body: `{"provider":"Example","order":{"id":"1"}}`,
+			want: message.Message{SchemaVersion: 1, Provider: "Example", Order: message.Order{Id: "1"}},
+		},
+		{
+			name: "message with the current schema version",
+			body: `{"schema_version":1,"id":"123","provider":"Example"}`,
+			want: message.Message{SchemaVersion: 1, Id: &messageId, Provider: "Example"},
+		},
+		{
+			name: "unknown field ignored",
+			body: `{"schema_version":1,"provider":"Example","gateway":"Other"}`,
+			want: message.Message{SchemaVersion: 1, Provider: "Example"},
+		},
+		{
+			name:        "unknown field rejected in strict mode",
+			strict:      true,
+			body:        `{"schema_version":1,"provider":"Example","gateway":"Other"}`,
+			wantReason:  perrors.DecodeUnknownField,
+			wantVersion: 1,
+		},
+		{
+			name:        "unknown nested field rejected in strict mode",
+			strict:      true,
+			body:        `{"provider":"Example","order":{"id":"1","coupon":"FREE"}}`,
+			wantReason:  perrors.DecodeUnknownField,
+			wantVersion: 1,
+		},
+		{
+			name:   "known fields accepted in strict mode",
+			strict: true,
+			body:   `{"schema_version":1,"id":"123","provider":"Example"}`,
+			want:   message.Message{SchemaVersion: 1, Id: &messageId, Provider: "Example"},
+		},
+		{
+			name:       "invalid json",
+			body:       `this is not a valid json body`,
+			wantReason: perrors.DecodeMalformed,
+		},
+		{
+			name:       "invalid schema version",
+			body:       `{"schema_version":"1","provider":"Example"}`,
+			wantReason: perrors.DecodeMalformed,
+		},
+		{
+			name:        "invalid field value",
+			body:        `{"provider":10}`,
+			wantReason:  perrors.DecodeMalformed,
+			wantVersion: 1,
+		},
+		{
+			name:        "unsupported schema version",
+			body:        `{"schema_version":2,"provider":"Example"}`,
+			wantReason:  perrors.DecodeUnsupportedVersion,
+			wantVersion: 2,
+		},
+		{
+			name:       "zero schema version",
+			body:       `{"schema_version":0,"provider":"Example"}`,
+			wantReason: perrors.DecodeUnsupportedVersion,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			codec := message.NewCodec(&config.Config{MessageStrictDecoding: tc.strict})
+			m, err := codec.Decode([]byte(tc.body))
+
+			if tc.wantReason != "" {
+				if assert.IsType(t, &perrors.DecodeError{}, err) {
+					assert.Equal(t, tc.wantReason, err.(*perrors.DecodeError).Reason)
+					assert.Equal(t, tc.wantVersion, err.(*perrors.DecodeError).Version)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, m)
+		})
+	}
+}
+
+// versionTwo is a schema version where the provider was renamed to gateway
+type versionTwo struct {
+	SchemaVersion int           `json:"schema_version"`
+	Id            *string       `json:"id"`
+	Gateway       string        `json:"gateway"`
+	Order         message.Order `json:"order"`
+}
+
+func decodeVersionTwo(body []byte, strict bool) (interface{}, error) {
+	var v versionTwo
+	if err := message.DecodeJSON(body, &v, strict); err != nil {
+		return nil, err
+	}
+	return message.Message{Id: v.Id, Provider: v.Gateway, Order: v.Order}, nil
+}
+
+func TestCodec_Decode_Upgrade(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		upgrade    message.Upgrade
+		body       string
+		want       message.Message
+		wantReason string
+	}{
+		{
+			name: "current schema version decoded",
+			upgrade: func(v interface{}) (interface{}, error) {
+				return v, nil
+			},
+			body: `{"schema_version":2,"gateway":"Example"}`,
+			want: message.Message{SchemaVersion: 2, Provider: "Example"},
+		},
+		{
+			name: "previous schema version upgraded",
+			upgrade: func(v interface{}) (interface{}, error) {
+				m := v.(message.Message)
+				m.Order.PaymentMethod = "credit_card"
+				return m, nil
+			},
+			body: `{"provider":"Example"}`,
+			want: message.Message{SchemaVersion: 2, Provider: "Example", Order: message.Order{PaymentMethod: "credit_card"}},
+		},
+		{
+			name:       "previous schema version without upgrade",
+			body:       `{"provider":"Example"}`,
+			wantReason: perrors.DecodeUpgradeFailed,
+		},
+		{
+			name: "previous schema version upgrade failed",
+			upgrade: func(v interface{}) (interface{}, error) {
+				return nil, errors.New("test")
+			},
+			body:       `{"provider":"Example"}`,
+			wantReason: perrors.DecodeUpgradeFailed,
+		},
+		{
+			name: "previous schema version upgraded to an invalid value",
+			upgrade: func(v interface{}) (interface{}, error) {
+				return "test", nil
+			},
+			body:       `{"provider":"Example"}`,
+			wantReason: perrors.DecodeUpgradeFailed,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			codec := message.NewCodec(&config.Config{})
+			codec.Register(2, decodeVersionTwo, tc.upgrade)
+			assert.Equal(t, 2, codec.Version())
+
+			m, err := codec.Decode([]byte(tc.body))
+
+			if tc.wantReason != "" {
+				if assert.IsType(t, &perrors.DecodeError{}, err) {
+					assert.Equal(t, tc.wantReason, err.(*perrors.DecodeError).Reason)
+					assert.Equal(t, 1, err.(*perrors.DecodeError).Version)
+				}
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, m)
+		})
+	}
+}
+
+func TestCodec_Encode(t *testing.T) {
+	messageId := "123"
+	codec := message.NewCodec(&config.Config{MessageStrictDecoding: true})
+	m := message.Message{
+		Id:       &messageId,
+		Provider: "Example",
+		Metadata: message.Metadata{MessageID: "sqs-123"},
+	}
+
+	b, err := codec.Encode(m)
+	assert.Nil(t, err)
+
+	var body map[string]interface{}
+	assert.Nil(t, json.Unmarshal(b, &body))
+	assert.Equal(t, float64(message.CurrentSchemaVersion), body["schema_version"])
+	assert.NotContains(t, body, "Metadata")
+
+	decoded, err := codec.Decode(b)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, decoded.SchemaVersion)
+	assert.Equal(t, &messageId, decoded.Id)
+	assert.Equal(t, "Example", decoded.Provider)
+	assert.Equal(t, message.Metadata{}, decoded.Metadata)
+}
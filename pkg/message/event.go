@@ -0,0 +1,29 @@
+package message
+
+import (
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// NewMessageFromEvent creates a message from a record delivered by the SQS event source, decoding its body with the
+// codec
+// When the body can't be decoded, the returned message only has the values that come from the queue
+func NewMessageFromEvent(r events.SQSMessage, codec *Codec) (Message, error) {
+	receiptHandle := r.ReceiptHandle
+	messageAttributes := make(map[string]string)
+	for name, a := range r.MessageAttributes {
+		if a.StringValue != nil {
+			messageAttributes[name] = *a.StringValue
+		}
+	}
+	m := Message{
+		Id:       &receiptHandle,
+		Metadata: NewMetadata(r.MessageId, r.Attributes, messageAttributes),
+	}
+	d, err := codec.Decode([]byte(r.Body))
+	if err != nil {
+		return m, err
+	}
+	d.Id = m.Id
+	d.Metadata = m.Metadata
+	return d, nil
+}
@@ -0,0 +1,111 @@
+package message_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMessageFromEvent(t *testing.T) {
+
+	receiptHandle := "receipt-123"
+
+	tests := []struct {
+		name          string
+		record        events.SQSMessage
+		want          message.Message
+		wantErrorType interface{}
+	}{
+		{
+			name: "message created successfully",
+			record: events.SQSMessage{
+				MessageId:     "123",
+				ReceiptHandle: receiptHandle,
+				Body:          `{"provider":"test"}`,
+			},
+			want: message.Message{
+				SchemaVersion: 1,
+				Id:            &receiptHandle,
+				Provider:      "test",
+				Metadata:      message.Metadata{MessageID: "123"},
+			},
+		},
+		{
+			name: "message created with the queue values",
+			record: events.SQSMessage{
+				MessageId:     "123",
+				ReceiptHandle: receiptHandle,
+				Body:          `{"provider":"test"}`,
+				Attributes: map[string]string{
+					"ApproximateReceiveCount": "2",
+					"SentTimestamp":           "1546300800123",
+					"MessageGroupId":          "group-1",
+					"MessageDeduplicationId":  "dedup-1",
+				},
+			},
+			want: message.Message{
+				SchemaVersion: 1,
+				Id:            &receiptHandle,
+				Provider:      "test",
+				Metadata: message.Metadata{
+					MessageID:       "123",
+					GroupID:         "group-1",
+					DeduplicationID: "dedup-1",
+					SentAt:          time.Unix(1546300800, 123000000).UTC(),
+					ReceiveCount:    2,
+					Attributes: map[string]string{
+						"ApproximateReceiveCount": "2",
+						"SentTimestamp":           "1546300800123",
+						"MessageGroupId":          "group-1",
+						"MessageDeduplicationId":  "dedup-1",
+					},
+				},
+			},
+		},
+		{
+			name: "message created with the receipt handle over the body id",
+			record: events.SQSMessage{
+				MessageId:     "123",
+				ReceiptHandle: receiptHandle,
+				Body:          `{"id":"old-receipt","provider":"test"}`,
+			},
+			want: message.Message{
+				SchemaVersion: 1,
+				Id:            &receiptHandle,
+				Provider:      "test",
+				Metadata:      message.Metadata{MessageID: "123"},
+			},
+		},
+		{
+			name: "failed by unmarshal message body",
+			record: events.SQSMessage{
+				MessageId:     "123",
+				ReceiptHandle: receiptHandle,
+				Body:          `this is not a valid json body`,
+			},
+			want: message.Message{
+				Id:       &receiptHandle,
+				Metadata: message.Metadata{MessageID: "123"},
+			},
+			wantErrorType: &perrors.DecodeError{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := message.NewMessageFromEvent(tc.record, message.NewCodec(&config.Config{}))
+
+			assert.Equal(t, tc.want, m)
+			if tc.wantErrorType != nil {
+				assert.IsType(t, tc.wantErrorType, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
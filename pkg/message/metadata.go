@@ -0,0 +1,70 @@
+package message
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Metadata represents the values of a message that come from the queue and are not part of the message body
+// ReceiveCount is the number of times the message was received, including the current one. Attributes has all the
+// fetched system attributes and MessageAttributes the string and number message attributes. RoutedProvider is the
+// provider chosen for the message by the handler, see Message.ResolvedProvider
+type Metadata struct {
+	MessageID         string
+	GroupID           string
+	DeduplicationID   string
+	SequenceNumber    string
+	SenderID          string
+	SentAt            time.Time
+	FirstReceivedAt   time.Time
+	ReceiveCount      int
+	Attributes        map[string]string
+	MessageAttributes map[string]string
+	RoutedProvider    string
+}
+
+// NewMetadata creates the metadata of a message from its SQS message id, system attributes and message attributes
+func NewMetadata(messageID string, attributes, messageAttributes map[string]string) Metadata {
+	md := Metadata{
+		MessageID:       messageID,
+		GroupID:         attributes[sqs.MessageSystemAttributeNameMessageGroupId],
+		DeduplicationID: attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId],
+		SequenceNumber:  attributes[sqs.MessageSystemAttributeNameSequenceNumber],
+		SenderID:        attributes[sqs.MessageSystemAttributeNameSenderId],
+		SentAt:          parseTimestamp(attributes[sqs.MessageSystemAttributeNameSentTimestamp]),
+		FirstReceivedAt: parseTimestamp(attributes[sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp]),
+		ReceiveCount:    parseReceiveCount(attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]),
+	}
+	if len(attributes) > 0 {
+		md.Attributes = attributes
+	}
+	if len(messageAttributes) > 0 {
+		md.MessageAttributes = messageAttributes
+	}
+	return md
+}
+
+// parseReceiveCount parses the approximate receive count attribute of SQS, zero when it's unknown
+func parseReceiveCount(v string) int {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// parseTimestamp parses a timestamp attribute of SQS in epoch milliseconds, the zero time when it's unknown
+func parseTimestamp(v string) time.Time {
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// formatTimestamp formats a time as a timestamp attribute of SQS in epoch milliseconds
+func formatTimestamp(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+}
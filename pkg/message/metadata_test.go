@@ -0,0 +1,83 @@
+package message_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMetadata(t *testing.T) {
+
+	tests := []struct {
+		name              string
+		messageID         string
+		attributes        map[string]string
+		messageAttributes map[string]string
+		want              message.Metadata
+	}{
+		{
+			name:              "metadata without attributes",
+			messageID:         "123",
+			attributes:        map[string]string{},
+			messageAttributes: map[string]string{},
+			want:              message.Metadata{MessageID: "123"},
+		},
+		{
+			name:      "metadata with all the attributes",
+			messageID: "123",
+			attributes: map[string]string{
+				"MessageGroupId":                   "group-1",
+				"MessageDeduplicationId":           "dedup-1",
+				"SequenceNumber":                   "18849496460467696128",
+				"SenderId":                         "AIDASSYFHUBOBT7F4XT75",
+				"SentTimestamp":                    "1546300800123",
+				"ApproximateFirstReceiveTimestamp": "1546300801000",
+				"ApproximateReceiveCount":          "2",
+			},
+			messageAttributes: map[string]string{"TraceId": "trace-1"},
+			want: message.Metadata{
+				MessageID:       "123",
+				GroupID:         "group-1",
+				DeduplicationID: "dedup-1",
+				SequenceNumber:  "18849496460467696128",
+				SenderID:        "AIDASSYFHUBOBT7F4XT75",
+				SentAt:          time.Unix(1546300800, 123000000).UTC(),
+				FirstReceivedAt: time.Unix(1546300801, 0).UTC(),
+				ReceiveCount:    2,
+				Attributes: map[string]string{
+					"MessageGroupId":                   "group-1",
+					"MessageDeduplicationId":           "dedup-1",
+					"SequenceNumber":                   "18849496460467696128",
+					"SenderId":                         "AIDASSYFHUBOBT7F4XT75",
+					"SentTimestamp":                    "1546300800123",
+					"ApproximateFirstReceiveTimestamp": "1546300801000",
+					"ApproximateReceiveCount":          "2",
+				},
+				MessageAttributes: map[string]string{"TraceId": "trace-1"},
+			},
+		},
+		{
+			name:      "metadata with invalid values",
+			messageID: "123",
+			attributes: map[string]string{
+				"SentTimestamp":           "yesterday",
+				"ApproximateReceiveCount": "many",
+			},
+			want: message.Metadata{
+				MessageID: "123",
+				Attributes: map[string]string{
+					"SentTimestamp":           "yesterday",
+					"ApproximateReceiveCount": "many",
+				},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, message.NewMetadata(tc.messageID, tc.attributes, tc.messageAttributes))
+		})
+	}
+}
@@ -25,28 +25,48 @@ type Address struct {
 
 // OrderItem represents the item of the order
 type OrderItem struct {
-	Id        string  `json:"id"`
-	Name      string  `json:"name"`
-	UnitPrice float64 `json:"unit_price"`
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	UnitPrice Money  `json:"unit_price"`
 }
 
 // Order represents the purchased order
 type Order struct {
 	Id              string      `json:"id"`
 	PaymentMethod   string      `json:"payment_method"`
-	ShippingAmount  float64     `json:"shipping_amount"`
-	Total           float64     `json:"total"`
+	ShippingAmount  Money       `json:"shipping_amount"`
+	Total           Money       `json:"total"`
 	OrderItem       []OrderItem `json:"items"`
+	Customer        Customer    `json:"customer"`
 	BillingAddress  Address     `json:"billing_address"`
 	ShippingAddress Address     `json:"shipping_address"`
 }
 
 // Message represents the message
+// SchemaVersion is the version of the body format, see Codec. Metadata has the values that come from the queue, it's
+// not part of the message body
 type Message struct {
-	Id       *string `json:"id"`
-	Provider string  `json:"provider"`
-	Order    Order   `json:"order"`
+	SchemaVersion int      `json:"schema_version,omitempty"`
+	Id            *string  `json:"id"`
+	Provider      string   `json:"provider"`
+	Order         Order    `json:"order"`
+	Metadata      Metadata `json:"-"`
+}
+
+// ResolvedProvider returns the provider that processes the message, the one chosen by the routing rules when it's
+// known, otherwise the provider of the message
+func (m Message) ResolvedProvider() string {
+	if m.Metadata.RoutedProvider != "" {
+		return m.Metadata.RoutedProvider
+	}
+	return m.Provider
 }
 
 // Messages represents a list of messages
 type Messages []Message
+
+// Quarantined represents a message that couldn't be decoded and was isolated from the other messages
+type Quarantined struct {
+	Id    *string `json:"id"`
+	Error string  `json:"error"`
+}
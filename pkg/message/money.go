@@ -0,0 +1,173 @@
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCurrency is the currency assumed for the amounts received in the legacy float format
+const DefaultCurrency = "BRL"
+
+// List of errors
+var (
+	ErrCurrencyMismatch = errors.New("money currencies don't match")
+)
+
+// currencyExponents has the number of minor unit digits of each supported ISO-4217 currency
+var currencyExponents = map[string]int{
+	"ARS": 2,
+	"BHD": 3,
+	"BRL": 2,
+	"CLP": 0,
+	"COP": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"JPY": 0,
+	"KWD": 3,
+	"MXN": 2,
+	"PEN": 2,
+	"PYG": 0,
+	"USD": 2,
+	"UYU": 2,
+}
+
+// Money represents an amount of money in the minor units of its currency (e.g. 1999 BRL is R$ 19,99)
+// It's decoded from the legacy float format (19.99, assumed to be in the DefaultCurrency) as well as from
+// the object format {"amount": 1999, "currency": "BRL"}, and it's always encoded in the object format
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// NewMoney creates a new money from an amount in minor units
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// NewMoneyFromFloat creates a new money from an amount in major units, rounding it half away from zero to the
+// minor units of the currency
+func NewMoneyFromFloat(f float64, currency string) Money {
+	m, _ := newMoneyFromDecimal(strconv.FormatFloat(f, 'f', -1, 64), currency)
+	return m
+}
+
+// CurrencyExponent returns the number of minor unit digits of a currency and whether the currency is supported
+func CurrencyExponent(currency string) (int, bool) {
+	exp, ok := currencyExponents[currency]
+	return exp, ok
+}
+
+// newMoneyFromDecimal creates a new money from a decimal string in major units without losing precision
+func newMoneyFromDecimal(s string, currency string) (Money, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Money{}, fmt.Errorf("invalid money amount %s", s)
+	}
+
+	r.Mul(r, new(big.Rat).SetInt(pow10(exponent(currency))))
+
+	// Round half away from zero
+	q, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(r.Denom()) >= 0 {
+		q.Add(q, big.NewInt(int64(r.Sign())))
+	}
+	if !q.IsInt64() {
+		return Money{}, fmt.Errorf("money amount %s out of range", s)
+	}
+
+	return NewMoney(q.Int64(), currency), nil
+}
+
+// exponent returns the number of minor unit digits of a currency, unknown currencies use two digits
+func exponent(currency string) int {
+	if exp, ok := CurrencyExponent(currency); ok {
+		return exp
+	}
+	return 2
+}
+
+// pow10 returns 10^n
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// Float64 returns the amount in major units, it should only be used for display purposes
+func (m Money) Float64() float64 {
+	f, _ := new(big.Rat).SetFrac(big.NewInt(m.Amount), pow10(exponent(m.Currency))).Float64()
+	return f
+}
+
+// String returns the amount in major units followed by the currency (e.g. 19.99 BRL)
+func (m Money) String() string {
+	return fmt.Sprintf(
+		"%s %s",
+		new(big.Rat).SetFrac(big.NewInt(m.Amount), pow10(exponent(m.Currency))).FloatString(exponent(m.Currency)),
+		m.Currency,
+	)
+}
+
+// IsZero checks if the amount is zero
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Equal checks if both amount and currency are the same
+func (m Money) Equal(o Money) bool {
+	return m.Amount == o.Amount && m.Currency == o.Currency
+}
+
+// Add returns the sum of two amounts of the same currency
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return NewMoney(m.Amount+o.Amount, m.Currency), nil
+}
+
+// Sub returns the difference of two amounts of the same currency
+func (m Money) Sub(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return NewMoney(m.Amount-o.Amount, m.Currency), nil
+}
+
+// Multiply returns the amount multiplied by a quantity
+func (m Money) Multiply(n int64) Money {
+	return NewMoney(m.Amount*n, m.Currency)
+}
+
+// UnmarshalJSON decodes the money from the legacy float format or from the object format
+func (m *Money) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	// Legacy format: an amount in major units of the default currency
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err == nil {
+		money, err := newMoneyFromDecimal(n.String(), DefaultCurrency)
+		if err != nil {
+			return err
+		}
+		*m = money
+		return nil
+	}
+
+	// Object format: an amount in minor units and its currency
+	type money Money
+	var v money
+	if err := json.Unmarshal(b, &v); err != nil {
+		return errors.Wrap(err, "invalid money")
+	}
+	if v.Currency == "" {
+		v.Currency = DefaultCurrency
+	}
+	*m = Money(v)
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package message_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMoneyFromFloat(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   float64
+		currency string
+		want     message.Money
+	}{
+		{
+			name:     "amount with cents",
+			amount:   19.99,
+			currency: "BRL",
+			want:     message.NewMoney(1999, "BRL"),
+		},
+		{
+			name:     "amount rounded half away from zero",
+			amount:   0.125,
+			currency: "USD",
+			want:     message.NewMoney(13, "USD"),
+		},
+		{
+			name:     "negative amount rounded half away from zero",
+			amount:   -0.125,
+			currency: "USD",
+			want:     message.NewMoney(-13, "USD"),
+		},
+		{
+			name:     "currency without minor units",
+			amount:   1999.5,
+			currency: "JPY",
+			want:     message.NewMoney(2000, "JPY"),
+		},
+		{
+			name:     "currency with three minor unit digits",
+			amount:   1.2345,
+			currency: "KWD",
+			want:     message.NewMoney(1235, "KWD"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, message.NewMoneyFromFloat(tc.amount, tc.currency))
+		})
+	}
+}
+
+func TestMoney_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    message.Money
+		wantErr bool
+	}{
+		{
+			name: "legacy float format",
+			data: `19.99`,
+			want: message.NewMoney(1999, message.DefaultCurrency),
+		},
+		{
+			name: "legacy integer format",
+			data: `10`,
+			want: message.NewMoney(1000, message.DefaultCurrency),
+		},
+		{
+			name: "object format",
+			data: `{"amount": 1999, "currency": "USD"}`,
+			want: message.NewMoney(1999, "USD"),
+		},
+		{
+			name: "object format without currency",
+			data: `{"amount": 1999}`,
+			want: message.NewMoney(1999, message.DefaultCurrency),
+		},
+		{
+			name: "null",
+			data: `null`,
+			want: message.Money{},
+		},
+		{
+			name:    "invalid format",
+			data:    `true`,
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var m message.Money
+			err := json.Unmarshal([]byte(tc.data), &m)
+
+			assert.Equal(t, tc.want, m)
+			if tc.wantErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestMoney_MarshalJSON(t *testing.T) {
+	b, err := json.Marshal(message.NewMoney(1999, "BRL"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, `{"amount":1999,"currency":"BRL"}`, string(b))
+}
+
+func TestMoney_Arithmetic(t *testing.T) {
+	a := message.NewMoney(1000, "BRL")
+	b := message.NewMoney(250, "BRL")
+
+	sum, err := a.Add(b)
+	assert.Nil(t, err)
+	assert.Equal(t, message.NewMoney(1250, "BRL"), sum)
+
+	diff, err := a.Sub(b)
+	assert.Nil(t, err)
+	assert.Equal(t, message.NewMoney(750, "BRL"), diff)
+
+	assert.Equal(t, message.NewMoney(750, "BRL"), b.Multiply(3))
+
+	_, err = a.Add(message.NewMoney(1, "USD"))
+	assert.Equal(t, message.ErrCurrencyMismatch, err)
+	_, err = a.Sub(message.NewMoney(1, "USD"))
+	assert.Equal(t, message.ErrCurrencyMismatch, err)
+
+	assert.True(t, a.Equal(message.NewMoney(1000, "BRL")))
+	assert.False(t, a.Equal(message.NewMoney(1000, "USD")))
+	assert.True(t, message.NewMoney(0, "BRL").IsZero())
+}
+
+func TestMoney_String(t *testing.T) {
+	assert.Equal(t, "19.99 BRL", message.NewMoney(1999, "BRL").String())
+	assert.Equal(t, "1999 JPY", message.NewMoney(1999, "JPY").String())
+	assert.Equal(t, "1.999 KWD", message.NewMoney(1999, "KWD").String())
+	assert.Equal(t, 19.99, message.NewMoney(1999, "BRL").Float64())
+}
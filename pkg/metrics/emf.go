@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Metric units
+const (
+	UnitCount = "Count"
+	UnitNone  = "None"
+)
+
+// Metric represents a value published to CloudWatch
+type Metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// Fields returns the log fields that publish the metrics in the CloudWatch embedded metric format, CloudWatch
+// extracts the metrics from the log line written to the Lambda logs without any API call
+// The dimensions are also written as fields, to identify the metrics
+func Fields(namespace string, dimensions map[string]string, metrics []Metric) log.Fields {
+	names := make([]string, 0, len(dimensions))
+	for k := range dimensions {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	definitions := make([]map[string]string, len(metrics))
+	fields := log.Fields{}
+	for i, m := range metrics {
+		definitions[i] = map[string]string{"Name": m.Name, "Unit": m.Unit}
+		fields[m.Name] = m.Value
+	}
+	for k, v := range dimensions {
+		fields[k] = v
+	}
+	fields["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []map[string]interface{}{
+			{
+				"Namespace":  namespace,
+				"Dimensions": [][]string{names},
+				"Metrics":    definitions,
+			},
+		},
+	}
+	return fields
+}
@@ -0,0 +1,37 @@
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFields(t *testing.T) {
+	fields := metrics.Fields(
+		"Payments",
+		map[string]string{"Provider": "Example", "Function": "payments"},
+		[]metrics.Metric{
+			{Name: "CircuitOpen", Unit: metrics.UnitNone, Value: 1},
+			{Name: "CircuitRejected", Unit: metrics.UnitCount, Value: 3},
+		},
+	)
+
+	assert.Equal(t, "Example", fields["Provider"])
+	assert.Equal(t, "payments", fields["Function"])
+	assert.Equal(t, float64(1), fields["CircuitOpen"])
+	assert.Equal(t, float64(3), fields["CircuitRejected"])
+
+	aws := fields["_aws"].(map[string]interface{})
+	assert.NotZero(t, aws["Timestamp"])
+	assert.Equal(t, []map[string]interface{}{
+		{
+			"Namespace":  "Payments",
+			"Dimensions": [][]string{{"Function", "Provider"}},
+			"Metrics": []map[string]string{
+				{"Name": "CircuitOpen", "Unit": metrics.UnitNone},
+				{"Name": "CircuitRejected", "Unit": metrics.UnitCount},
+			},
+		},
+	}, aws["CloudWatchMetrics"])
+}
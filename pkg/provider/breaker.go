@@ -0,0 +1,205 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// BreakerList represents a list of providers with circuit breakers
+type BreakerList interface {
+	Breakers() []*Breaker
+}
+
+// BreakerStats represents the state of a circuit breaker, with the payments it rejected since the last collect
+type BreakerStats struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	Rejected int    `json:"rejected"`
+}
+
+// Breaker represents a circuit breaker around a provider
+// The circuit opens after PROVIDER_BREAKER_THRESHOLD consecutive infrastructure failures or requests with an uncertain
+// outcome (e.g. timeouts) and the payments are released without calling the provider until the cool-down ends. Then a
+// single payment is sent to the provider (half-open), closing the circuit when it doesn't fail that way or opening it
+// again otherwise
+type Breaker struct {
+	name      string
+	processor Processor
+	threshold int
+	cooldown  time.Duration
+	log       *log.Logger
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+	rejected int
+}
+
+// NewBreakers wraps each provider with a circuit breaker, the providers are returned unchanged when
+// PROVIDER_BREAKER_THRESHOLD is zero
+func NewBreakers(c *config.Config, l *log.Logger, p Providers) Providers {
+	if c.ProviderBreakerThreshold <= 0 {
+		return p
+	}
+	providers := Providers{}
+	for name, processor := range p {
+		providers[name] = NewBreaker(c, l, name, processor)
+	}
+	return providers
+}
+
+// NewBreaker creates a new closed circuit breaker around the provider
+func NewBreaker(c *config.Config, l *log.Logger, name string, p Processor) *Breaker {
+	b := &Breaker{
+		name:      name,
+		processor: p,
+		threshold: c.ProviderBreakerThreshold,
+		cooldown:  c.ProviderBreakerCooldown,
+		log:       l,
+		state:     BreakerClosed,
+	}
+	return b
+}
+
+// Process process a message with the provider when the circuit allows it, otherwise the message is released until
+// the end of the cool-down
+func (b *Breaker) Process(ctx context.Context, m message.Message) (ProcessResult, error) {
+	if err := b.allow(); err != nil {
+		return ProcessResult{}, err
+	}
+	result, err := b.processor.Process(ctx, m)
+	if _, ok := errors.Cause(err).(*perrors.ReleaseError); ok {
+		// The payment didn't reach the provider or the provider asked to slow down, it says nothing about its health
+		b.cancel()
+		return result, err
+	}
+	b.record(unhealthy(err))
+	return result, err
+}
+
+// Collect returns the stats of the circuit breaker, restarting the count of the rejected payments
+func (b *Breaker) Collect() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BreakerStats{
+		Provider: b.name,
+		State:    b.state,
+		Failures: b.failures,
+		Rejected: b.rejected,
+	}
+	b.rejected = 0
+	return s
+}
+
+// allow checks if a payment can be sent to the provider, moving an open circuit to half-open after the cool-down
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if remaining := b.cooldown - time.Since(b.openedAt); remaining > 0 {
+			return b.reject(remaining)
+		}
+		b.setState(BreakerHalfOpen)
+	case BreakerHalfOpen:
+		// Only a single payment checks if the provider is back
+		if b.probing {
+			return b.reject(b.cooldown)
+		}
+	default:
+		return nil
+	}
+	b.probing = true
+	return nil
+}
+
+// record records the result of a payment sent to the provider
+// The results of the payments sent before the circuit was opened are ignored
+func (b *Breaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		return
+	}
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.setState(BreakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// cancel ends a payment sent without a result, allowing another payment to check the provider when half-open
+func (b *Breaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// reject returns the error of a payment released while the circuit is open
+func (b *Breaker) reject(delay time.Duration) error {
+	b.rejected++
+	err := fmt.Errorf("the circuit breaker of the provider %s is open", b.name)
+	return perrors.NewReleaseError(perrors.ReleaseCircuitOpen, delay, err)
+}
+
+// setState changes the state of the circuit, logging the change
+func (b *Breaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	b.log.WithFields(log.Fields{
+		"provider": b.name,
+		"from":     b.state,
+		"to":       state,
+		"failures": b.failures,
+	}).Info("circuit breaker state changed")
+	b.state = state
+}
+
+// Breakers returns the circuit breakers of the providers, sorted by the provider name
+func (providers Providers) Breakers() []*Breaker {
+	var breakers []*Breaker
+	for _, p := range providers {
+		if b, ok := p.(*Breaker); ok {
+			breakers = append(breakers, b)
+		}
+	}
+	sort.Slice(breakers, func(i, j int) bool {
+		return breakers[i].name < breakers[j].name
+	})
+	return breakers
+}
+
+// unhealthy checks if the error shows that the provider is unhealthy, an infrastructure failure or a request with an
+// uncertain outcome like a timeout
+func unhealthy(err error) bool {
+	if _, ok := errors.Cause(err).(*perrors.UncertainError); ok {
+		return true
+	}
+	return IsInfrastructureFailure(err)
+}
@@ -0,0 +1,183 @@
+package provider_test
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newBreakerLogger() *log.Logger {
+	l := log.New()
+	l.Out = ioutil.Discard
+	return l
+}
+
+func TestNewBreakers(t *testing.T) {
+	p := provider.Providers{"Example": new(provider.MockProvider)}
+
+	disabled := provider.NewBreakers(&config.Config{}, newBreakerLogger(), p)
+	assert.Equal(t, p, disabled)
+	assert.Empty(t, disabled.Breakers())
+
+	enabled := provider.NewBreakers(&config.Config{ProviderBreakerThreshold: 1}, newBreakerLogger(), p)
+	assert.IsType(t, &provider.Breaker{}, enabled["Example"])
+	if assert.Len(t, enabled.Breakers(), 1) {
+		assert.Equal(t, "Example", enabled.Breakers()[0].Collect().Provider)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		wantState string
+		wantCalls int
+	}{
+		{
+			name:      "closed below the threshold",
+			errs:      []error{provider.ErrFailedRequest, provider.ErrFailedRequest, nil},
+			wantState: provider.BreakerClosed,
+			wantCalls: 3,
+		},
+		{
+			name:      "opened by consecutive infrastructure failures",
+			errs:      []error{provider.ErrFailedRequest, provider.ErrProviderUnavailable, provider.ErrFailedRequest},
+			wantState: provider.BreakerOpen,
+			wantCalls: 3,
+		},
+		{
+			name:      "failures restarted by a successful payment",
+			errs:      []error{provider.ErrFailedRequest, provider.ErrFailedRequest, nil, provider.ErrFailedRequest},
+			wantState: provider.BreakerClosed,
+			wantCalls: 4,
+		},
+		{
+			name:      "declines are not failures",
+			errs:      []error{provider.ErrFailProcessPayment, provider.ErrFailProcessPayment, provider.ErrFailProcessPayment},
+			wantState: provider.BreakerClosed,
+			wantCalls: 3,
+		},
+		{
+			name: "payments released while open",
+			errs: []error{
+				provider.ErrFailedRequest, provider.ErrFailedRequest, provider.ErrFailedRequest,
+				provider.ErrFailedRequest, provider.ErrFailedRequest,
+			},
+			wantState: provider.BreakerOpen,
+			wantCalls: 3,
+		},
+	}
+
+	ctx := context.TODO()
+	m := message.Message{Provider: "Example"}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			providerMock := new(provider.MockProvider)
+			for _, err := range tc.errs {
+				providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, err).Once()
+			}
+			c := &config.Config{ProviderBreakerThreshold: 3, ProviderBreakerCooldown: time.Minute}
+			b := provider.NewBreaker(c, newBreakerLogger(), "Example", providerMock)
+
+			var err error
+			for range tc.errs {
+				_, err = b.Process(ctx, m)
+			}
+
+			providerMock.AssertNumberOfCalls(t, "Process", tc.wantCalls)
+			s := b.Collect()
+			assert.Equal(t, tc.wantState, s.State)
+			assert.Equal(t, len(tc.errs)-tc.wantCalls, s.Rejected)
+			if s.Rejected > 0 {
+				if assert.IsType(t, &perrors.ReleaseError{}, err) {
+					e := err.(*perrors.ReleaseError)
+					assert.Equal(t, perrors.ReleaseCircuitOpen, e.Reason)
+					assert.True(t, e.Delay > 0 && e.Delay <= time.Minute)
+				}
+			}
+			assert.Equal(t, 0, b.Collect().Rejected)
+		})
+	}
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	ctx := context.TODO()
+	m := message.Message{Provider: "Example"}
+	c := &config.Config{ProviderBreakerThreshold: 1, ProviderBreakerCooldown: 20 * time.Millisecond}
+
+	t.Run("closed by a successful probe", func(t *testing.T) {
+		release := make(chan time.Time)
+		providerMock := new(provider.MockProvider)
+		providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, provider.ErrFailedRequest).Once()
+		providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, nil).WaitUntil(release).Once()
+		providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, nil)
+		b := provider.NewBreaker(c, newBreakerLogger(), "Example", providerMock)
+
+		_, err := b.Process(ctx, m)
+		assert.Equal(t, provider.ErrFailedRequest, err)
+		time.Sleep(30 * time.Millisecond)
+
+		// A single payment checks the provider, the others are released while it's running
+		done := make(chan error)
+		go func() {
+			_, err := b.Process(ctx, m)
+			done <- err
+		}()
+		for i := 0; i < 1000 && b.Collect().State != provider.BreakerHalfOpen; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		_, err = b.Process(ctx, m)
+		assert.IsType(t, &perrors.ReleaseError{}, err)
+
+		close(release)
+		assert.Nil(t, <-done)
+		assert.Equal(t, provider.BreakerClosed, b.Collect().State)
+		_, err = b.Process(ctx, m)
+		assert.Nil(t, err)
+	})
+
+	t.Run("opened again by a failed probe", func(t *testing.T) {
+		providerMock := new(provider.MockProvider)
+		providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, provider.ErrFailedRequest)
+		b := provider.NewBreaker(c, newBreakerLogger(), "Example", providerMock)
+
+		_, _ = b.Process(ctx, m)
+		time.Sleep(30 * time.Millisecond)
+		_, err := b.Process(ctx, m)
+		assert.Equal(t, provider.ErrFailedRequest, err)
+		assert.Equal(t, provider.BreakerOpen, b.Collect().State)
+
+		_, err = b.Process(ctx, m)
+		assert.IsType(t, &perrors.ReleaseError{}, err)
+		providerMock.AssertNumberOfCalls(t, "Process", 2)
+	})
+}
+
+func TestBreaker_Released(t *testing.T) {
+	ctx := context.TODO()
+	m := message.Message{Provider: "Example"}
+	released := perrors.NewReleaseError(perrors.ReleaseRateLimited, time.Second, provider.ErrRateLimited)
+
+	providerMock := new(provider.MockProvider)
+	providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, provider.ErrFailedRequest).Once()
+	providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, released).Once()
+	providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, provider.ErrFailedRequest).Once()
+	c := &config.Config{ProviderBreakerThreshold: 2, ProviderBreakerCooldown: time.Minute}
+	b := provider.NewBreaker(c, newBreakerLogger(), "Example", providerMock)
+
+	// A released payment doesn't restart the failures
+	for i := 0; i < 3; i++ {
+		_, _ = b.Process(ctx, m)
+	}
+	assert.Equal(t, provider.BreakerOpen, b.Collect().State)
+}
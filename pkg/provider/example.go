@@ -1,7 +1,14 @@
 package provider
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/fredw/igti-aws-lambda-payments/pkg/client"
@@ -14,16 +21,69 @@ import (
 // List of errors
 var (
 	ErrFailProcessPayment       = errors.New("fail to process the payment")
-	ErrFailedRequest            = errors.New("failed to do a request to the providerExample")
+	ErrConnectionFailed         = perrors.NewInfrastructureError("failed to connect to the providerExample")
+	ErrFailedRequest            = perrors.NewUncertainError("failed to do a request to the providerExample")
+	ErrProviderUnavailable      = perrors.NewInfrastructureError("providerExample is unavailable")
+	ErrRateLimited              = errors.New("providerExample rate limit exceeded")
 	ErrCriticalProviderInternal = perrors.NewCriticalError("payment can't be processed due a providerExample internal error")
+	ErrCriticalInvalidResponse  = perrors.NewCriticalError("payment response from providerExample can't be decoded")
+	ErrCriticalUnknownStatus    = perrors.NewCriticalError("payment response from providerExample has an unknown status")
 )
 
+// DefaultRetryAfter is how long the payments wait after a 429 Too Many Requests response without a valid Retry-After
+const DefaultRetryAfter = time.Second
+
 // Example represents an example providerExample
 type Example struct {
 	config *config.Config
 	Client client.HttpCaller
 }
 
+// ExampleRequest represents the payment request sent to the providerExample, for example:
+//
+//	{
+//	  "reference": "order-1",
+//	  "payment_method": "credit_card",
+//	  "total": {"amount": 11050, "currency": "BRL"},
+//	  "shipping_amount": {"amount": 1000, "currency": "BRL"},
+//	  "items": [{"id": "item-1", "name": "Book", "unit_price": {"amount": 10050, "currency": "BRL"}}],
+//	  "customer": {"id": "customer-1", "first_name": "John", "last_name": "Doe", "email": "john@doe.com", ...},
+//	  "billing_address": {"street": "Main Street", "number": "1", "zip_code": "90000-000", ...},
+//	  "shipping_address": {"street": "Main Street", "number": "1", "zip_code": "90000-000", ...}
+//	}
+type ExampleRequest struct {
+	Reference       string              `json:"reference"`
+	PaymentMethod   string              `json:"payment_method"`
+	Total           message.Money       `json:"total"`
+	ShippingAmount  message.Money       `json:"shipping_amount"`
+	Items           []message.OrderItem `json:"items"`
+	Customer        message.Customer    `json:"customer"`
+	BillingAddress  message.Address     `json:"billing_address"`
+	ShippingAddress message.Address     `json:"shipping_address"`
+}
+
+// ExampleResponse represents the payment response returned by the providerExample, for example:
+//
+//	{
+//	  "transaction_id": "tx-1",
+//	  "status": "approved",
+//	  "amount_captured": {"amount": 11050, "currency": "BRL"},
+//	  "authorization_code": "A1B2C3",
+//	  "decline_code": "",
+//	  "message": "authorized"
+//	}
+//
+// The status is optional on successful responses (approved is assumed), but the providerExample may answer
+// with pending or requires_action when the payment isn't finished yet, or with declined. Any other status is rejected
+type ExampleResponse struct {
+	TransactionID     string        `json:"transaction_id"`
+	Status            string        `json:"status"`
+	AmountCaptured    message.Money `json:"amount_captured"`
+	AuthorizationCode string        `json:"authorization_code"`
+	DeclineCode       string        `json:"decline_code"`
+	Message           string        `json:"message"`
+}
+
 // NewExampleProvider returns a new example providerExample
 func NewExampleProvider(config *config.Config) Example {
 	// Calculate the request timeout
@@ -39,35 +99,143 @@ func NewExampleProvider(config *config.Config) Example {
 	return p
 }
 
+// NewExampleRequest creates the providerExample request from the message order
+func NewExampleRequest(m message.Message) ExampleRequest {
+	return ExampleRequest{
+		Reference:       m.Order.Id,
+		PaymentMethod:   m.Order.PaymentMethod,
+		Total:           m.Order.Total,
+		ShippingAmount:  m.Order.ShippingAmount,
+		Items:           m.Order.OrderItem,
+		Customer:        m.Order.Customer,
+		BillingAddress:  m.Order.BillingAddress,
+		ShippingAddress: m.Order.ShippingAddress,
+	}
+}
+
 // Process process a message
-func (p Example) Process(m message.Message) error {
+func (p Example) Process(ctx context.Context, m message.Message) (ProcessResult, error) {
+	body, err := json.Marshal(NewExampleRequest(m))
+	if err != nil {
+		return ProcessResult{}, errors.Wrap(err, "failed to marshal the request")
+	}
+
 	// Create a request to the providerExample
-	req, err := http.NewRequest(http.MethodPost, p.config.ProviderExampleRequestURI, nil)
+	req, err := http.NewRequest(http.MethodPost, p.config.ProviderExampleRequestURI, bytes.NewReader(body))
 	if err != nil {
-		return errors.Wrap(err, "failed to create a request")
+		return ProcessResult{}, errors.Wrap(err, "failed to create a request")
 	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
 
-	// Do the request
+	// Do the request, only a request that was never sent is known to not have processed the payment
 	resp, err := p.Client.Do(req)
 	if err != nil {
-		return ErrFailedRequest
+		if notSent(err) {
+			return ProcessResult{}, ErrConnectionFailed
+		}
+		return ProcessResult{}, ErrFailedRequest
+	}
 
+	// Decode the response before checking the status, declined payments also carry the gateway reason
+	// The response may be of a processed payment, so a failure to read it has an uncertain outcome
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ProcessResult{}, ErrFailedRequest
 	}
 	if err = resp.Body.Close(); err != nil {
-		return errors.Wrap(err, "error on close response body")
+		return ProcessResult{}, errors.Wrap(err, "error on close response body")
+	}
+	var er ExampleResponse
+	errDecode := json.Unmarshal(raw, &er)
+
+	// The request quota of the providerExample was exceeded, the payment wasn't processed and it's released to be sent
+	// again after the Retry-After delay
+	if resp.StatusCode == http.StatusTooManyRequests {
+		delay := client.RetryAfter(resp, time.Now())
+		if delay <= 0 {
+			delay = DefaultRetryAfter
+		}
+		result := ProcessResult{Metadata: map[string]string{
+			"http_status": strconv.Itoa(resp.StatusCode),
+			"response":    string(raw),
+		}}
+		return result, perrors.NewReleaseError(perrors.ReleaseRateLimited, delay, ErrRateLimited)
 	}
 
 	// Critical failure on providerExample, the message shouldn't be processed again, moving directly to the DLQ
 	// For example, you can check for a specific error on message body. In this case we are checking for 500 Internal Server Error
 	if resp.StatusCode == http.StatusInternalServerError {
-		return ErrCriticalProviderInternal
+		return ProcessResult{}, ErrCriticalProviderInternal
+	}
+
+	// The other server errors (e.g. 502 Bad Gateway, 503 Service Unavailable) mean the providerExample is unavailable,
+	// the payment wasn't processed unless the response says otherwise
+	if resp.StatusCode > http.StatusInternalServerError {
+		return ProcessResult{
+			TransactionID:  er.TransactionID,
+			AmountCaptured: er.AmountCaptured,
+			Metadata: map[string]string{
+				"http_status": strconv.Itoa(resp.StatusCode),
+				"response":    string(raw),
+			},
+		}, ErrProviderUnavailable
+	}
+
+	result := ProcessResult{
+		TransactionID:     er.TransactionID,
+		Status:            PaymentStatusApproved,
+		AmountCaptured:    er.AmountCaptured,
+		AuthorizationCode: er.AuthorizationCode,
+		DeclineCode:       er.DeclineCode,
+		Message:           er.Message,
+		Metadata: map[string]string{
+			"http_status": strconv.Itoa(resp.StatusCode),
+			"response":    string(raw),
+		},
 	}
 
 	// Payment failed on providerExample
 	// For example, this providerExample consider a payment failure when the http status is different from 200 OK
 	if resp.StatusCode != http.StatusOK {
-		return ErrFailProcessPayment
+		result.Status = PaymentStatusDeclined
+		return result, ErrFailProcessPayment
+	}
+
+	// The payment may have been captured, but without a readable response it can't be safely retried
+	if errDecode != nil {
+		return ProcessResult{Status: PaymentStatusPending, Metadata: result.Metadata}, ErrCriticalInvalidResponse
 	}
 
-	return nil
+	// A response without status is an approved payment, a declined one fails like a non 200 response and an unknown
+	// status may be a captured payment that can't be safely retried
+	switch er.Status {
+	case "", PaymentStatusApproved:
+	case PaymentStatusDeclined:
+		result.Status = PaymentStatusDeclined
+		return result, ErrFailProcessPayment
+	case PaymentStatusPending, PaymentStatusRequiresAction:
+		result.Status = er.Status
+	default:
+		result.Status = PaymentStatusPending
+		return result, ErrCriticalUnknownStatus
+	}
+
+	return result, nil
+}
+
+// notSent checks if the request failed before it was sent, when the connection to the providerExample couldn't be
+// made (e.g. the host couldn't be resolved or the connection was refused or timed out)
+// The other timeouts and canceled requests may happen after the request was sent, they are not included
+func notSent(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	switch e := err.(type) {
+	case *net.DNSError:
+		return true
+	case *net.OpError:
+		return e.Op == "dial"
+	}
+	return false
 }
@@ -2,21 +2,36 @@ package provider_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/fredw/igti-aws-lambda-payments/pkg/client"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
 	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 var providerExample provider.Example
 
 var providerURI = "http://providerExample.host/"
 
+// errReader is a response body that fails to be read
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
 func init() {
 	c := &config.Config{
 		ProviderExampleRequestURI: providerURI,
@@ -28,13 +43,53 @@ func TestNewExampleProvider(t *testing.T) {
 	assert.IsType(t, provider.Example{}, providerExample)
 }
 
+func TestNewExampleRequest(t *testing.T) {
+	m := message.Message{
+		Provider: "Example",
+		Order: message.Order{
+			Id:             "order-1",
+			PaymentMethod:  "credit_card",
+			ShippingAmount: message.NewMoney(1000, "BRL"),
+			Total:          message.NewMoney(11050, "BRL"),
+			OrderItem: []message.OrderItem{
+				{Id: "item-1", Name: "Book", UnitPrice: message.NewMoney(10050, "BRL")},
+			},
+			Customer: message.Customer{
+				Id:    "customer-1",
+				Email: "john@doe.com",
+			},
+			BillingAddress:  message.Address{ZipCode: "90000-000"},
+			ShippingAddress: message.Address{ZipCode: "90000-001"},
+		},
+	}
+
+	want := provider.ExampleRequest{
+		Reference:      "order-1",
+		PaymentMethod:  "credit_card",
+		Total:          message.NewMoney(11050, "BRL"),
+		ShippingAmount: message.NewMoney(1000, "BRL"),
+		Items: []message.OrderItem{
+			{Id: "item-1", Name: "Book", UnitPrice: message.NewMoney(10050, "BRL")},
+		},
+		Customer: message.Customer{
+			Id:    "customer-1",
+			Email: "john@doe.com",
+		},
+		BillingAddress:  message.Address{ZipCode: "90000-000"},
+		ShippingAddress: message.Address{ZipCode: "90000-001"},
+	}
+
+	assert.Equal(t, want, provider.NewExampleRequest(m))
+}
+
 func TestProcess(t *testing.T) {
 	tests := []struct {
 		name          string
 		message       message.Message
 		response      *http.Response
 		responseError error
-		want          error
+		want          provider.ProcessResult
+		wantErr       error
 	}{
 		{
 			name: "success due a 200 OK from providerExample",
@@ -43,9 +98,80 @@ func TestProcess(t *testing.T) {
 			},
 			response: &http.Response{
 				StatusCode: http.StatusOK,
-				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"result":"authorized"}`)),
+				Body: ioutil.NopCloser(bytes.NewBufferString(
+					`{"transaction_id":"tx-1","amount_captured":110.5,"authorization_code":"A1B2C3","message":"authorized"}`,
+				)),
+			},
+			want: provider.ProcessResult{
+				TransactionID:     "tx-1",
+				Status:            provider.PaymentStatusApproved,
+				AmountCaptured:    message.NewMoney(11050, "BRL"),
+				AuthorizationCode: "A1B2C3",
+				Message:           "authorized",
+				Metadata: map[string]string{
+					"http_status": "200",
+					"response":    `{"transaction_id":"tx-1","amount_captured":110.5,"authorization_code":"A1B2C3","message":"authorized"}`,
+				},
+			},
+		},
+		{
+			name: "pending due a 200 OK with pending status from providerExample",
+			message: message.Message{
+				Provider: "Example",
+			},
+			response: &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"transaction_id":"tx-1","status":"pending"}`)),
+			},
+			want: provider.ProcessResult{
+				TransactionID: "tx-1",
+				Status:        provider.PaymentStatusPending,
+				Metadata: map[string]string{
+					"http_status": "200",
+					"response":    `{"transaction_id":"tx-1","status":"pending"}`,
+				},
+			},
+		},
+		{
+			name: "failed due a 200 OK with declined status from providerExample",
+			message: message.Message{
+				Provider: "Example",
+			},
+			response: &http.Response{
+				StatusCode: http.StatusOK,
+				Body: ioutil.NopCloser(bytes.NewBufferString(
+					`{"transaction_id":"tx-1","status":"declined","decline_code":"insufficient_funds"}`,
+				)),
 			},
-			want: nil,
+			want: provider.ProcessResult{
+				TransactionID: "tx-1",
+				Status:        provider.PaymentStatusDeclined,
+				DeclineCode:   "insufficient_funds",
+				Metadata: map[string]string{
+					"http_status": "200",
+					"response":    `{"transaction_id":"tx-1","status":"declined","decline_code":"insufficient_funds"}`,
+				},
+			},
+			wantErr: provider.ErrFailProcessPayment,
+		},
+		{
+			name: "failed due a 200 OK with an unknown status from providerExample",
+			message: message.Message{
+				Provider: "Example",
+			},
+			response: &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"transaction_id":"tx-1","status":"reversed"}`)),
+			},
+			want: provider.ProcessResult{
+				TransactionID: "tx-1",
+				Status:        provider.PaymentStatusPending,
+				Metadata: map[string]string{
+					"http_status": "200",
+					"response":    `{"transaction_id":"tx-1","status":"reversed"}`,
+				},
+			},
+			wantErr: provider.ErrCriticalUnknownStatus,
 		},
 		{
 			name: "failed due a response error",
@@ -56,7 +182,42 @@ func TestProcess(t *testing.T) {
 				Body: ioutil.NopCloser(bytes.NewBufferString(`{"error":"test"}`)),
 			},
 			responseError: provider.ErrFailedRequest,
-			want:          provider.ErrFailedRequest,
+			wantErr:       provider.ErrFailedRequest,
+		},
+		{
+			name: "failed due a connection refused by providerExample",
+			message: message.Message{
+				Provider: "Example",
+			},
+			responseError: &url.Error{Op: "Post", URL: providerURI, Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+			wantErr:       provider.ErrConnectionFailed,
+		},
+		{
+			name: "failed due a providerExample host not found",
+			message: message.Message{
+				Provider: "Example",
+			},
+			responseError: &url.Error{Op: "Post", URL: providerURI, Err: &net.DNSError{Err: "no such host", Name: "providerExample.host"}},
+			wantErr:       provider.ErrConnectionFailed,
+		},
+		{
+			name: "failed due a timeout after the request was sent",
+			message: message.Message{
+				Provider: "Example",
+			},
+			responseError: &url.Error{Op: "Post", URL: providerURI, Err: context.DeadlineExceeded},
+			wantErr:       provider.ErrFailedRequest,
+		},
+		{
+			name: "failed due a response body that can't be read",
+			message: message.Message{
+				Provider: "Example",
+			},
+			response: &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(errReader{}),
+			},
+			wantErr: provider.ErrFailedRequest,
 		},
 		{
 			name: "failed due a 400 Bad Request from providerExample",
@@ -65,9 +226,74 @@ func TestProcess(t *testing.T) {
 			},
 			response: &http.Response{
 				StatusCode: http.StatusBadRequest,
-				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"foo":"bar"}`)),
+				Body: ioutil.NopCloser(bytes.NewBufferString(
+					`{"transaction_id":"tx-1","decline_code":"insufficient_funds","message":"declined"}`,
+				)),
+			},
+			want: provider.ProcessResult{
+				TransactionID: "tx-1",
+				Status:        provider.PaymentStatusDeclined,
+				DeclineCode:   "insufficient_funds",
+				Message:       "declined",
+				Metadata: map[string]string{
+					"http_status": "400",
+					"response":    `{"transaction_id":"tx-1","decline_code":"insufficient_funds","message":"declined"}`,
+				},
+			},
+			wantErr: provider.ErrFailProcessPayment,
+		},
+		{
+			name: "failed due a 400 Bad Request from providerExample without body",
+			message: message.Message{
+				Provider: "Example",
+			},
+			response: &http.Response{
+				StatusCode: http.StatusBadRequest,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
+			},
+			want: provider.ProcessResult{
+				Status: provider.PaymentStatusDeclined,
+				Metadata: map[string]string{
+					"http_status": "400",
+					"response":    "",
+				},
+			},
+			wantErr: provider.ErrFailProcessPayment,
+		},
+		{
+			name: "released due a 429 Too Many Requests with Retry-After from providerExample",
+			message: message.Message{
+				Provider: "Example",
+			},
+			response: &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     http.Header{"Retry-After": []string{"5"}},
+				Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
+			},
+			want: provider.ProcessResult{
+				Metadata: map[string]string{
+					"http_status": "429",
+					"response":    "",
+				},
+			},
+			wantErr: perrors.NewReleaseError(perrors.ReleaseRateLimited, 5*time.Second, provider.ErrRateLimited),
+		},
+		{
+			name: "released due a 429 Too Many Requests without Retry-After from providerExample",
+			message: message.Message{
+				Provider: "Example",
 			},
-			want: provider.ErrFailProcessPayment,
+			response: &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
+			},
+			want: provider.ProcessResult{
+				Metadata: map[string]string{
+					"http_status": "429",
+					"response":    "",
+				},
+			},
+			wantErr: perrors.NewReleaseError(perrors.ReleaseRateLimited, provider.DefaultRetryAfter, provider.ErrRateLimited),
 		},
 		{
 			name: "failed due a 500 Internal Server Error from providerExample",
@@ -78,23 +304,86 @@ func TestProcess(t *testing.T) {
 				StatusCode: http.StatusInternalServerError,
 				Body:       ioutil.NopCloser(bytes.NewBufferString(``)),
 			},
-			want: provider.ErrCriticalProviderInternal,
+			wantErr: provider.ErrCriticalProviderInternal,
+		},
+		{
+			name: "failed due a 503 Service Unavailable from providerExample",
+			message: message.Message{
+				Provider: "Example",
+			},
+			response: &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`unavailable`)),
+			},
+			want: provider.ProcessResult{
+				Metadata: map[string]string{
+					"http_status": "503",
+					"response":    "unavailable",
+				},
+			},
+			wantErr: provider.ErrProviderUnavailable,
+		},
+		{
+			name: "failed due a 502 Bad Gateway with a transaction from providerExample",
+			message: message.Message{
+				Provider: "Example",
+			},
+			response: &http.Response{
+				StatusCode: http.StatusBadGateway,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"transaction_id":"tx-1"}`)),
+			},
+			want: provider.ProcessResult{
+				TransactionID: "tx-1",
+				Metadata: map[string]string{
+					"http_status": "502",
+					"response":    `{"transaction_id":"tx-1"}`,
+				},
+			},
+			wantErr: provider.ErrProviderUnavailable,
+		},
+		{
+			name: "failed due a 200 OK with an invalid body from providerExample",
+			message: message.Message{
+				Provider: "Example",
+			},
+			response: &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`this is not a valid json body`)),
+			},
+			want: provider.ProcessResult{
+				Status: provider.PaymentStatusPending,
+				Metadata: map[string]string{
+					"http_status": "200",
+					"response":    "this is not a valid json body",
+				},
+			},
+			wantErr: provider.ErrCriticalInvalidResponse,
 		},
 	}
 
+	ctx := context.WithValue(context.Background(), struct{}{}, "test")
+
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			// Create a mocked http client
-			mock := new(client.MockHTTPClient)
-			req, _ := http.NewRequest(http.MethodPost, providerURI, nil)
-			mock.On("Do", req).Return(tc.response, tc.responseError)
-			c := client.NewHttpClient(mock)
+			// Create a mocked http client, checking the request sent to the providerExample
+			wantBody, _ := json.Marshal(provider.NewExampleRequest(tc.message))
+			mockClient := new(client.MockHTTPClient)
+			mockClient.On("Do", mock.MatchedBy(func(req *http.Request) bool {
+				body, _ := ioutil.ReadAll(req.Body)
+				return req.Context() == ctx &&
+					req.Method == http.MethodPost &&
+					req.URL.String() == providerURI &&
+					req.Header.Get("Content-Type") == "application/json" &&
+					bytes.Equal(wantBody, body)
+			})).Return(tc.response, tc.responseError)
+			c := client.NewHttpClient(mockClient)
 
 			// Overwrite the http client on providerExample
 			providerExample.Client = c
 
-			err := providerExample.Process(tc.message)
-			assert.Equal(t, tc.want, err)
+			result, err := providerExample.Process(ctx, tc.message)
+			assert.Equal(t, tc.want, result)
+			assert.Equal(t, tc.wantErr, err)
 		})
 	}
 }
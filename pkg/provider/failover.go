@@ -0,0 +1,55 @@
+package provider
+
+import (
+	"strings"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/pkg/errors"
+)
+
+// Failover represents the failover chains of providers by payment method, the providers of a chain are tried in order
+// when a payment fails due an infrastructure failure of the provider
+type Failover map[string][]string
+
+// NewFailover creates the failover chains of the PROVIDER_FAILOVER variable, where the providers of each payment
+// method are separated by "|", for example: credit_card:Example|Backup,pix:Backup|Example
+func NewFailover(c *config.Config) Failover {
+	f := Failover{}
+	for method, chain := range c.ProviderFailover {
+		var providers []string
+		for _, p := range strings.Split(chain, "|") {
+			if p = strings.TrimSpace(p); p != "" {
+				providers = append(providers, p)
+			}
+		}
+		if len(providers) > 0 {
+			f[strings.ToLower(strings.TrimSpace(method))] = providers
+		}
+	}
+	return f
+}
+
+// Chain returns the failover chain of the payment method, ignoring the case
+func (f Failover) Chain(paymentMethod string) []string {
+	return f[strings.ToLower(paymentMethod)]
+}
+
+// IsInfrastructureFailure checks if the error is a failure to reach the provider or a provider outage, that is not a
+// decline of the payment and didn't process it
+func IsInfrastructureFailure(err error) bool {
+	_, ok := errors.Cause(err).(*perrors.InfrastructureError)
+	return ok
+}
+
+// CanFailover checks if a failed payment can be sent to another provider, which requires an infrastructure failure and
+// an answer showing that nothing was captured, or a payment released without calling the provider
+func CanFailover(r ProcessResult, err error) bool {
+	if _, ok := errors.Cause(err).(*perrors.ReleaseError); ok {
+		return true
+	}
+	if !IsInfrastructureFailure(err) {
+		return false
+	}
+	return r.Status == "" && r.TransactionID == "" && r.AmountCaptured.IsZero()
+}
@@ -0,0 +1,95 @@
+package provider_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFailover(t *testing.T) {
+	f := provider.NewFailover(&config.Config{ProviderFailover: map[string]string{
+		"Credit_Card": "Example| Backup",
+		"pix":         "Backup|",
+		"boleto":      "",
+	}})
+
+	assert.Equal(t, provider.Failover{
+		"credit_card": {"Example", "Backup"},
+		"pix":         {"Backup"},
+	}, f)
+	assert.Equal(t, []string{"Example", "Backup"}, f.Chain("CREDIT_CARD"))
+	assert.Nil(t, f.Chain("boleto"))
+}
+
+func TestCanFailover(t *testing.T) {
+	tests := []struct {
+		name   string
+		result provider.ProcessResult
+		err    error
+		want   bool
+	}{
+		{
+			name: "connection failed",
+			err:  provider.ErrConnectionFailed,
+			want: true,
+		},
+		{
+			name: "failed request with an uncertain outcome",
+			err:  provider.ErrFailedRequest,
+		},
+		{
+			name: "timeout after the request was sent",
+			err:  perrors.NewUncertainError("timeout"),
+		},
+		{
+			name:   "provider unavailable with the response metadata",
+			result: provider.ProcessResult{Metadata: map[string]string{"http_status": "503"}},
+			err:    errors.Wrap(provider.ErrProviderUnavailable, "test"),
+			want:   true,
+		},
+		{
+			name:   "provider unavailable with a transaction",
+			result: provider.ProcessResult{TransactionID: "tx-1"},
+			err:    provider.ErrProviderUnavailable,
+		},
+		{
+			name:   "provider unavailable with a captured amount",
+			result: provider.ProcessResult{AmountCaptured: message.NewMoney(1000, "BRL")},
+			err:    provider.ErrProviderUnavailable,
+		},
+		{
+			name:   "provider unavailable with a pending payment",
+			result: provider.ProcessResult{Status: provider.PaymentStatusPending},
+			err:    provider.ErrProviderUnavailable,
+		},
+		{
+			name: "payment released by the circuit breaker",
+			err:  perrors.NewReleaseError(perrors.ReleaseCircuitOpen, time.Second, errors.New("test")),
+			want: true,
+		},
+		{
+			name:   "declined payment",
+			result: provider.ProcessResult{Status: provider.PaymentStatusDeclined},
+			err:    provider.ErrFailProcessPayment,
+		},
+		{
+			name: "critical error",
+			err:  perrors.NewCriticalError("test"),
+		},
+		{
+			name: "successful payment",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, provider.CanFailover(tc.result, tc.err))
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limiter represents a token bucket rate limiter around a provider
+// The bucket holds up to PROVIDER_RATE_BURST requests and it's refilled with PROVIDER_RATE_LIMIT requests per second.
+// A payment waits for its request up to PROVIDER_RATE_MAX_WAIT, otherwise it's released until there is a request
+// available. When the provider answers that the quota was exceeded, the bucket is emptied until its Retry-After delay
+type Limiter struct {
+	name      string
+	processor Processor
+	rate      float64
+	burst     float64
+	maxWait   time.Duration
+	log       *log.Logger
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiters wraps each provider of PROVIDER_RATE_LIMIT with a rate limiter, the other providers are not limited
+func NewLimiters(c *config.Config, l *log.Logger, p Providers) Providers {
+	providers := Providers{}
+	for name, processor := range p {
+		providers[name] = processor
+		if c.ProviderRateLimit[name] > 0 {
+			providers[name] = NewLimiter(c, l, name, processor)
+		}
+	}
+	return providers
+}
+
+// NewLimiter creates a new rate limiter around the provider with a full bucket, the burst is one request when it's
+// not set
+func NewLimiter(c *config.Config, l *log.Logger, name string, p Processor) *Limiter {
+	burst := float64(c.ProviderRateBurst[name])
+	if burst < 1 {
+		burst = 1
+	}
+	lim := &Limiter{
+		name:      name,
+		processor: p,
+		rate:      c.ProviderRateLimit[name],
+		burst:     burst,
+		maxWait:   c.ProviderRateMaxWait,
+		log:       l,
+		tokens:    burst,
+		last:      time.Now(),
+	}
+	return lim
+}
+
+// Process process a message with the provider when there is a request available, waiting for it when needed
+func (lim *Limiter) Process(ctx context.Context, m message.Message) (ProcessResult, error) {
+	wait, ok := lim.reserve()
+	if !ok {
+		err := fmt.Errorf("the rate limit of the provider %s was reached", lim.name)
+		return ProcessResult{}, perrors.NewReleaseError(perrors.ReleaseRateLimited, wait, err)
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			// The provider wasn't called, the message is released instead of failed
+			t.Stop()
+			lim.cancel()
+			return ProcessResult{}, perrors.NewReleaseError(perrors.ReleaseRateLimited, wait, ctx.Err())
+		}
+	}
+
+	result, err := lim.processor.Process(ctx, m)
+	if e, ok := errors.Cause(err).(*perrors.ReleaseError); ok && e.Reason == perrors.ReleaseRateLimited {
+		lim.pause(e.Delay)
+	}
+	return result, err
+}
+
+// reserve takes a request from the bucket, returning how long to wait until it's available
+// The request isn't taken when the wait is longer than the maximum wait
+func (lim *Limiter) reserve() (time.Duration, bool) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	now := time.Now()
+	if now.After(lim.last) {
+		lim.tokens += now.Sub(lim.last).Seconds() * lim.rate
+		if lim.tokens > lim.burst {
+			lim.tokens = lim.burst
+		}
+		lim.last = now
+	}
+
+	var wait time.Duration
+	if lim.tokens < 1 {
+		wait = lim.last.Sub(now) + time.Duration((1-lim.tokens)/lim.rate*float64(time.Second))
+	}
+	if wait > lim.maxWait {
+		return wait, false
+	}
+	lim.tokens--
+	return wait, true
+}
+
+// cancel gives back a request that wasn't used
+func (lim *Limiter) cancel() {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	lim.tokens++
+}
+
+// pause empties the bucket until the end of the delay, slowing down the requests to the provider
+func (lim *Limiter) pause(delay time.Duration) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	until := time.Now().Add(delay)
+	if until.After(lim.last) {
+		lim.last = until
+	}
+	lim.tokens = 0
+	lim.log.WithFields(log.Fields{"provider": lim.name, "retry_after": delay.String()}).Info("provider rate limit exceeded, slowing down")
+}
@@ -0,0 +1,175 @@
+package provider_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNewLimiters(t *testing.T) {
+	example := new(provider.MockProvider)
+	backup := new(provider.MockProvider)
+	c := &config.Config{ProviderRateLimit: map[string]float64{"Example": 10}}
+
+	p := provider.NewLimiters(c, newBreakerLogger(), provider.Providers{"Example": example, "Backup": backup})
+
+	assert.IsType(t, &provider.Limiter{}, p["Example"])
+	assert.Equal(t, backup, p["Backup"])
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.TODO()
+	m := message.Message{Provider: "Example"}
+
+	tests := []struct {
+		name         string
+		burst        int
+		maxWait      time.Duration
+		calls        int
+		wantCalls    int
+		wantReleased int
+		wantMinTime  time.Duration
+	}{
+		{
+			name:      "burst sent without waiting",
+			burst:     3,
+			maxWait:   time.Second,
+			calls:     3,
+			wantCalls: 3,
+		},
+		{
+			name:        "requests over the burst wait for the refill",
+			burst:       1,
+			maxWait:     time.Second,
+			calls:       3,
+			wantCalls:   3,
+			wantMinTime: 40 * time.Millisecond,
+		},
+		{
+			name:         "requests over the maximum wait released",
+			burst:        2,
+			maxWait:      10 * time.Millisecond,
+			calls:        4,
+			wantCalls:    2,
+			wantReleased: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			providerMock := new(provider.MockProvider)
+			providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, nil)
+			c := &config.Config{
+				ProviderRateLimit:   map[string]float64{"Example": 50},
+				ProviderRateBurst:   map[string]int{"Example": tc.burst},
+				ProviderRateMaxWait: tc.maxWait,
+			}
+			lim := provider.NewLimiter(c, newBreakerLogger(), "Example", providerMock)
+
+			start := time.Now()
+			released := 0
+			for i := 0; i < tc.calls; i++ {
+				_, err := lim.Process(ctx, m)
+				if err == nil {
+					continue
+				}
+				if assert.IsType(t, &perrors.ReleaseError{}, err) {
+					e := err.(*perrors.ReleaseError)
+					assert.Equal(t, perrors.ReleaseRateLimited, e.Reason)
+					assert.True(t, e.Delay > tc.maxWait && e.Delay <= 20*time.Millisecond, "delay %s", e.Delay)
+				}
+				released++
+			}
+
+			providerMock.AssertNumberOfCalls(t, "Process", tc.wantCalls)
+			assert.Equal(t, tc.wantReleased, released)
+			assert.True(t, time.Since(start) >= tc.wantMinTime)
+		})
+	}
+}
+
+func TestLimiter_RetryAfter(t *testing.T) {
+	ctx := context.TODO()
+	m := message.Message{Provider: "Example"}
+	c := &config.Config{
+		ProviderRateLimit:   map[string]float64{"Example": 1000},
+		ProviderRateBurst:   map[string]int{"Example": 10},
+		ProviderRateMaxWait: 10 * time.Millisecond,
+	}
+	rateLimited := perrors.NewReleaseError(perrors.ReleaseRateLimited, time.Minute, provider.ErrRateLimited)
+
+	providerMock := new(provider.MockProvider)
+	providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, rateLimited).Once()
+	lim := provider.NewLimiter(c, newBreakerLogger(), "Example", providerMock)
+
+	_, err := lim.Process(ctx, m)
+	assert.Equal(t, rateLimited, err)
+
+	// The next payments are released until the Retry-After delay, without calling the provider
+	_, err = lim.Process(ctx, m)
+	if assert.IsType(t, &perrors.ReleaseError{}, err) {
+		d := err.(*perrors.ReleaseError).Delay
+		assert.True(t, d > 59*time.Second && d <= time.Minute+time.Millisecond, "delay %s", d)
+	}
+	providerMock.AssertNumberOfCalls(t, "Process", 1)
+}
+
+func TestLimiter_Canceled(t *testing.T) {
+	m := message.Message{Provider: "Example"}
+	c := &config.Config{
+		ProviderRateLimit:   map[string]float64{"Example": 10},
+		ProviderRateMaxWait: time.Second,
+	}
+	providerMock := new(provider.MockProvider)
+	providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, nil)
+	lim := provider.NewLimiter(c, newBreakerLogger(), "Example", providerMock)
+
+	_, err := lim.Process(context.TODO(), m)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = lim.Process(ctx, m)
+	if assert.IsType(t, &perrors.ReleaseError{}, err) {
+		assert.Equal(t, perrors.ReleaseRateLimited, err.(*perrors.ReleaseError).Reason)
+		assert.Equal(t, context.DeadlineExceeded, err.(*perrors.ReleaseError).Err)
+	}
+	providerMock.AssertNumberOfCalls(t, "Process", 1)
+}
+
+func TestLimiter_Breaker(t *testing.T) {
+	m := message.Message{Provider: "Example"}
+	c := &config.Config{
+		ProviderBreakerThreshold: 3,
+		ProviderBreakerCooldown:  time.Minute,
+		ProviderRateLimit:        map[string]float64{"Example": 10},
+		ProviderRateBurst:        map[string]int{"Example": 2},
+		ProviderRateMaxWait:      time.Second,
+	}
+	providerMock := new(provider.MockProvider)
+	providerMock.On("Process", mock.Anything, m).Return(provider.ProcessResult{}, provider.ErrConnectionFailed)
+	p := provider.NewBreakers(c, newBreakerLogger(), provider.NewLimiters(c, newBreakerLogger(), provider.Providers{"Example": providerMock}))
+	b := p.Breakers()[0]
+
+	for i := 0; i < 2; i++ {
+		_, err := p["Example"].Process(context.TODO(), m)
+		assert.Equal(t, provider.ErrConnectionFailed, err)
+	}
+
+	// A wait canceled before calling the provider doesn't restart the failures of the circuit breaker
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := p["Example"].Process(ctx, m)
+	assert.IsType(t, &perrors.ReleaseError{}, err)
+	s := b.Collect()
+	assert.Equal(t, provider.BreakerClosed, s.State)
+	assert.Equal(t, 2, s.Failures)
+	providerMock.AssertNumberOfCalls(t, "Process", 2)
+}
@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
@@ -12,6 +13,14 @@ const (
 	ExampleProvider = "Example"
 )
 
+// Payment statuses
+const (
+	PaymentStatusApproved       = "approved"
+	PaymentStatusDeclined       = "declined"
+	PaymentStatusPending        = "pending"
+	PaymentStatusRequiresAction = "requires_action"
+)
+
 // HTTPClient representation of the client call
 type HTTPClient interface {
 	Do(r *http.Request) (*http.Response, error)
@@ -27,8 +36,21 @@ type ProcessorList interface {
 }
 
 // Processor represents a providerExample that can process a message
+// The context carries the cancellation, the deadline and the request scoped values of the invocation
 type Processor interface {
-	Process(m message.Message) error
+	Process(ctx context.Context, m message.Message) (ProcessResult, error)
+}
+
+// ProcessResult represents what the provider answered when processing a message
+// An empty status means the provider didn't give an answer (e.g. the request itself failed)
+type ProcessResult struct {
+	TransactionID     string            `json:"transaction_id,omitempty"`
+	Status            string            `json:"status"`
+	AmountCaptured    message.Money     `json:"amount_captured"`
+	AuthorizationCode string            `json:"authorization_code,omitempty"`
+	DeclineCode       string            `json:"decline_code,omitempty"`
+	Message           string            `json:"message,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
 }
 
 // NewProviders create a list of all available providers
@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"context"
 	"reflect"
 
 	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
@@ -13,9 +14,9 @@ type MockProvider struct {
 }
 
 // Process mocks the process of the message
-func (mp *MockProvider) Process(m message.Message) error {
-	args := mp.Called(m)
-	return args.Error(0)
+func (mp *MockProvider) Process(ctx context.Context, m message.Message) (ProcessResult, error) {
+	args := mp.Called(ctx, m)
+	return args.Get(0).(ProcessResult), args.Error(1)
 }
 
 // MockProviderList is a mocked list of the provider
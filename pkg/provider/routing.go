@@ -0,0 +1,232 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/pkg/errors"
+)
+
+// ProviderAuto is the provider of the messages routed by the rules, like the messages without a provider
+const ProviderAuto = "auto"
+
+// Rules represents the routing rules, loaded from a JSON file
+// The rules are evaluated by priority, the highest first and the ones with the same priority in the file order. The
+// first rule that matches the message chooses the provider, the fallback is used when none of them matches
+type Rules struct {
+	Rules    []Rule `json:"rules"`
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// Rule represents a routing rule, that chooses the provider of the messages that match all its criteria
+type Rule struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	Provider string `json:"provider"`
+	Match    Match  `json:"match"`
+}
+
+// Match represents the criteria of a rule, the empty ones match all the messages
+// A list matches when one of its values is the value of the order, ignoring the case. The country is the one of the
+// billing address and the amount is the order total in minor units, whatever its currency
+type Match struct {
+	PaymentMethods []string      `json:"payment_methods,omitempty"`
+	Countries      []string      `json:"countries,omitempty"`
+	Currencies     []string      `json:"currencies,omitempty"`
+	Amount         *AmountRange  `json:"amount,omitempty"`
+	Customer       CustomerMatch `json:"customer,omitempty"`
+}
+
+// AmountRange represents an inclusive range of amounts in minor units, without a limit when it's not set
+type AmountRange struct {
+	Min *int64 `json:"min,omitempty"`
+	Max *int64 `json:"max,omitempty"`
+}
+
+// CustomerMatch represents the criteria of the customer of the order
+type CustomerMatch struct {
+	IDs          []string `json:"ids,omitempty"`
+	EmailDomains []string `json:"email_domains,omitempty"`
+	Genders      []string `json:"genders,omitempty"`
+}
+
+// Decision represents how the provider of a message was chosen
+// Explicit is set when the message has its own provider, Skipped has the rules evaluated before the chosen one and
+// why they didn't match
+type Decision struct {
+	Provider string        `json:"provider,omitempty"`
+	Rule     string        `json:"rule,omitempty"`
+	Explicit bool          `json:"explicit,omitempty"`
+	Fallback bool          `json:"fallback,omitempty"`
+	Skipped  []SkippedRule `json:"skipped,omitempty"`
+}
+
+// SkippedRule represents a rule that didn't match the message
+type SkippedRule struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// Explainer represents a list of providers that explains how the provider of a message is chosen
+type Explainer interface {
+	Explain(m message.Message) Decision
+}
+
+// Router represents a list of providers that chooses the provider of the messages without one by the routing rules
+type Router struct {
+	providers Providers
+	rules     Rules
+}
+
+// LoadRules reads the routing rules from a JSON file
+func LoadRules(path string) (Rules, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Rules{}, errors.Wrap(err, "failed to read the routing rules")
+	}
+	var rules Rules
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return Rules{}, errors.Wrap(err, "failed to decode the routing rules")
+	}
+	return rules, nil
+}
+
+// NewRouterFromConfig creates a new router of the providers with the rules of the PROVIDER_ROUTING_RULES file, without
+// the file only the messages with a provider are routed
+func NewRouterFromConfig(c *config.Config, p Providers) (*Router, error) {
+	rules := Rules{}
+	if c.ProviderRoutingRules != "" {
+		var err error
+		if rules, err = LoadRules(c.ProviderRoutingRules); err != nil {
+			return nil, err
+		}
+	}
+	return NewRouter(p, rules)
+}
+
+// NewRouter creates a new router of the providers, checking that the rules only choose available providers
+func NewRouter(p Providers, rules Rules) (*Router, error) {
+	names := make(map[string]bool)
+	for i, r := range rules.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("the routing rule %d has no name", i+1)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("the routing rule %s is duplicated", r.Name)
+		}
+		names[r.Name] = true
+		if _, ok := p[r.Provider]; !ok {
+			return nil, fmt.Errorf("the provider %q of the routing rule %s is not available", r.Provider, r.Name)
+		}
+	}
+	if _, ok := p[rules.Fallback]; rules.Fallback != "" && !ok {
+		return nil, fmt.Errorf("the fallback provider %q is not available", rules.Fallback)
+	}
+
+	sorted := make([]Rule, len(rules.Rules))
+	copy(sorted, rules.Rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	rules.Rules = sorted
+
+	r := &Router{
+		providers: p,
+		rules:     rules,
+	}
+	return r, nil
+}
+
+// GetByMessage returns the provider of the message, chosen by the rules when the message has no provider
+func (r *Router) GetByMessage(m message.Message) Processor {
+	d := r.Explain(m)
+	if d.Provider == "" {
+		return nil
+	}
+	return r.providers[d.Provider]
+}
+
+// GetNames returns the providers names
+func (r *Router) GetNames() []string {
+	return r.providers.GetNames()
+}
+
+// Breakers returns the circuit breakers of the providers
+func (r *Router) Breakers() []*Breaker {
+	return r.providers.Breakers()
+}
+
+// Explain returns how the provider of the message is chosen, without processing it
+func (r *Router) Explain(m message.Message) Decision {
+	if m.Provider != "" && m.Provider != ProviderAuto {
+		return Decision{Provider: m.Provider, Explicit: true}
+	}
+
+	d := Decision{}
+	for _, rule := range r.rules.Rules {
+		if reason := rule.Match.mismatch(m.Order); reason != "" {
+			d.Skipped = append(d.Skipped, SkippedRule{Rule: rule.Name, Reason: reason})
+			continue
+		}
+		d.Provider = rule.Provider
+		d.Rule = rule.Name
+		return d
+	}
+	d.Provider = r.rules.Fallback
+	d.Fallback = r.rules.Fallback != ""
+	return d
+}
+
+// mismatch returns why the order doesn't match the criteria, empty when it matches
+func (m Match) mismatch(o message.Order) string {
+	if !matchAny(m.PaymentMethods, o.PaymentMethod) {
+		return fmt.Sprintf("payment method %q is not one of %s", o.PaymentMethod, strings.Join(m.PaymentMethods, ", "))
+	}
+	if !matchAny(m.Countries, o.BillingAddress.Country) {
+		return fmt.Sprintf("country %q is not one of %s", o.BillingAddress.Country, strings.Join(m.Countries, ", "))
+	}
+	if !matchAny(m.Currencies, o.Total.Currency) {
+		return fmt.Sprintf("currency %q is not one of %s", o.Total.Currency, strings.Join(m.Currencies, ", "))
+	}
+	if a := m.Amount; a != nil {
+		if a.Min != nil && o.Total.Amount < *a.Min {
+			return fmt.Sprintf("amount %d is lower than %d", o.Total.Amount, *a.Min)
+		}
+		if a.Max != nil && o.Total.Amount > *a.Max {
+			return fmt.Sprintf("amount %d is greater than %d", o.Total.Amount, *a.Max)
+		}
+	}
+	c := m.Customer
+	if !matchAny(c.IDs, o.Customer.Id) {
+		return fmt.Sprintf("customer %q is not one of %s", o.Customer.Id, strings.Join(c.IDs, ", "))
+	}
+	domain := ""
+	if i := strings.LastIndex(o.Customer.Email, "@"); i >= 0 {
+		domain = o.Customer.Email[i+1:]
+	}
+	if !matchAny(c.EmailDomains, domain) {
+		return fmt.Sprintf("customer email domain %q is not one of %s", domain, strings.Join(c.EmailDomains, ", "))
+	}
+	if !matchAny(c.Genders, o.Customer.Gender) {
+		return fmt.Sprintf("customer gender %q is not one of %s", o.Customer.Gender, strings.Join(c.Genders, ", "))
+	}
+	return ""
+}
+
+// matchAny checks if the value is one of the values, an empty list matches all the values
+func matchAny(values []string, v string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package provider_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+const routingRules = `{
+  "rules": [
+    {"name": "low-amounts", "priority": 1, "provider": "Cheap", "match": {"amount": {"max": 5000}}},
+    {"name": "pix-brazil", "priority": 10, "provider": "Local", "match": {"payment_methods": ["pix"], "countries": ["BR"], "currencies": ["BRL"]}},
+    {"name": "vip", "priority": 10, "provider": "Premium", "match": {"customer": {"email_domains": ["vip.com"]}, "amount": {"min": 100000}}}
+  ],
+  "fallback": "Example"
+}`
+
+// newRoutingProviders creates the providers chosen by the routing rules
+func newRoutingProviders() provider.Providers {
+	return provider.Providers{
+		"Example": new(provider.MockProvider),
+		"Cheap":   new(provider.MockProvider),
+		"Local":   new(provider.MockProvider),
+		"Premium": new(provider.MockProvider),
+	}
+}
+
+// newRoutingRules writes the routing rules to a file
+func newRoutingRules(t *testing.T, rules string) (string, func()) {
+	dir, err := ioutil.TempDir("", "routing")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, "rules.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(rules), 0600))
+	return path, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestRouter_Explain(t *testing.T) {
+	path, cleanup := newRoutingRules(t, routingRules)
+	defer cleanup()
+	router, err := provider.NewRouterFromConfig(&config.Config{ProviderRoutingRules: path}, newRoutingProviders())
+	assert.Nil(t, err)
+
+	order := func(paymentMethod, country string, total message.Money, email string) message.Order {
+		return message.Order{
+			PaymentMethod:  paymentMethod,
+			Total:          total,
+			Customer:       message.Customer{Email: email},
+			BillingAddress: message.Address{Country: country},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		message message.Message
+		want    provider.Decision
+	}{
+		{
+			name:    "explicit provider",
+			message: message.Message{Provider: "Cheap", Order: order("pix", "BR", message.NewMoney(1000, "BRL"), "")},
+			want:    provider.Decision{Provider: "Cheap", Explicit: true},
+		},
+		{
+			name:    "auto provider routed by the first rule by priority",
+			message: message.Message{Provider: "auto", Order: order("pix", "br", message.NewMoney(1000, "BRL"), "")},
+			want:    provider.Decision{Provider: "Local", Rule: "pix-brazil"},
+		},
+		{
+			name:    "empty provider routed by the customer attributes",
+			message: message.Message{Order: order("credit_card", "US", message.NewMoney(200000, "USD"), "john@vip.com")},
+			want: provider.Decision{
+				Provider: "Premium",
+				Rule:     "vip",
+				Skipped: []provider.SkippedRule{
+					{Rule: "pix-brazil", Reason: `payment method "credit_card" is not one of pix`},
+				},
+			},
+		},
+		{
+			name:    "rule with a lower priority",
+			message: message.Message{Order: order("credit_card", "US", message.NewMoney(5000, "USD"), "john@vip.com")},
+			want: provider.Decision{
+				Provider: "Cheap",
+				Rule:     "low-amounts",
+				Skipped: []provider.SkippedRule{
+					{Rule: "pix-brazil", Reason: `payment method "credit_card" is not one of pix`},
+					{Rule: "vip", Reason: "amount 5000 is lower than 100000"},
+				},
+			},
+		},
+		{
+			name:    "customer attributes not matched",
+			message: message.Message{Order: order("credit_card", "US", message.NewMoney(200000, "USD"), "john@doe.com")},
+			want: provider.Decision{
+				Provider: "Example",
+				Fallback: true,
+				Skipped: []provider.SkippedRule{
+					{Rule: "pix-brazil", Reason: `payment method "credit_card" is not one of pix`},
+					{Rule: "vip", Reason: `customer email domain "doe.com" is not one of vip.com`},
+					{Rule: "low-amounts", Reason: "amount 200000 is greater than 5000"},
+				},
+			},
+		},
+		{
+			name:    "fallback",
+			message: message.Message{Order: order("pix", "AR", message.NewMoney(5001, "ARS"), "john@doe.com")},
+			want: provider.Decision{
+				Provider: "Example",
+				Fallback: true,
+				Skipped: []provider.SkippedRule{
+					{Rule: "pix-brazil", Reason: `country "AR" is not one of BR`},
+					{Rule: "vip", Reason: "amount 5001 is lower than 100000"},
+					{Rule: "low-amounts", Reason: "amount 5001 is greater than 5000"},
+				},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, router.Explain(tc.message))
+		})
+	}
+}
+
+func TestRouter_GetByMessage(t *testing.T) {
+	providers := newRoutingProviders()
+
+	router, err := provider.NewRouter(providers, provider.Rules{
+		Rules: []provider.Rule{
+			{Name: "brl", Provider: "Local", Match: provider.Match{Currencies: []string{"BRL"}}},
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, providers["Local"], router.GetByMessage(message.Message{Order: message.Order{Total: message.NewMoney(1, "BRL")}}))
+	assert.Equal(t, providers["Cheap"], router.GetByMessage(message.Message{Provider: "Cheap"}))
+	assert.Nil(t, router.GetByMessage(message.Message{Provider: "Unknown"}))
+	// Without a fallback, the messages that don't match any rule have no provider
+	assert.Nil(t, router.GetByMessage(message.Message{Provider: "auto", Order: message.Order{Total: message.NewMoney(1, "USD")}}))
+	assert.ElementsMatch(t, []string{"Example", "Cheap", "Local", "Premium"}, router.GetNames())
+}
+
+func TestNewRouter(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     string
+		wantError string
+	}{
+		{
+			name:  "valid rules",
+			rules: routingRules,
+		},
+		{
+			name:      "invalid json",
+			rules:     `rules: []`,
+			wantError: "failed to decode the routing rules: invalid character 'r' looking for beginning of value",
+		},
+		{
+			name:      "rule without name",
+			rules:     `{"rules": [{"provider": "Example"}]}`,
+			wantError: "the routing rule 1 has no name",
+		},
+		{
+			name:      "duplicated rule",
+			rules:     `{"rules": [{"name": "all", "provider": "Example"}, {"name": "all", "provider": "Cheap"}]}`,
+			wantError: "the routing rule all is duplicated",
+		},
+		{
+			name:      "unknown provider",
+			rules:     `{"rules": [{"name": "all", "provider": "Other"}]}`,
+			wantError: `the provider "Other" of the routing rule all is not available`,
+		},
+		{
+			name:      "unknown fallback",
+			rules:     `{"fallback": "Other"}`,
+			wantError: `the fallback provider "Other" is not available`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path, cleanup := newRoutingRules(t, tc.rules)
+			defer cleanup()
+
+			_, err := provider.NewRouterFromConfig(&config.Config{ProviderRoutingRules: path}, newRoutingProviders())
+
+			if tc.wantError != "" {
+				if assert.NotNil(t, err) {
+					assert.Equal(t, tc.wantError, err.Error())
+				}
+				return
+			}
+			assert.Nil(t, err)
+		})
+	}
+
+	_, err := provider.NewRouterFromConfig(&config.Config{ProviderRoutingRules: "/missing/rules.json"}, newRoutingProviders())
+	assert.NotNil(t, err)
+}
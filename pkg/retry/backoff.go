@@ -0,0 +1,52 @@
+package retry
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff is an exponential backoff policy with jitter, the delay doubles on each attempt up to the max delay
+type Backoff struct {
+	base time.Duration
+	max  time.Duration
+}
+
+// NewBackoff creates a new backoff policy, a base lower or equal to zero disables the backoff
+func NewBackoff(base, max time.Duration) *Backoff {
+	if max < base {
+		max = base
+	}
+	b := &Backoff{
+		base: base,
+		max:  max,
+	}
+	return b
+}
+
+// Enabled returns if the policy delays the attempts
+func (b *Backoff) Enabled() bool {
+	return b.base > 0
+}
+
+// Delay returns the delay before the next attempt, after the given number of failed attempts
+// Half of the delay is fixed and the other half is random, so the messages that failed together don't come back
+// at the same time
+func (b *Backoff) Delay(attempt int) time.Duration {
+	if !b.Enabled() {
+		return 0
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	d := b.base
+	for i := 1; i < attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
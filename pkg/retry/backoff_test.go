@@ -0,0 +1,75 @@
+package retry_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    time.Duration
+		max     time.Duration
+		attempt int
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{
+			name:    "disabled",
+			max:     time.Minute,
+			attempt: 3,
+		},
+		{
+			name:    "first attempt",
+			base:    10 * time.Second,
+			max:     time.Minute,
+			attempt: 1,
+			wantMin: 5 * time.Second,
+			wantMax: 10 * time.Second,
+		},
+		{
+			name:    "unknown attempt as the first one",
+			base:    10 * time.Second,
+			max:     time.Minute,
+			wantMin: 5 * time.Second,
+			wantMax: 10 * time.Second,
+		},
+		{
+			name:    "delay doubled by attempt",
+			base:    10 * time.Second,
+			max:     time.Minute,
+			attempt: 3,
+			wantMin: 20 * time.Second,
+			wantMax: 40 * time.Second,
+		},
+		{
+			name:    "delay capped",
+			base:    10 * time.Second,
+			max:     time.Minute,
+			attempt: 100,
+			wantMin: 30 * time.Second,
+			wantMax: time.Minute,
+		},
+		{
+			name:    "max lower than base",
+			base:    10 * time.Second,
+			max:     time.Second,
+			attempt: 2,
+			wantMin: 5 * time.Second,
+			wantMax: 10 * time.Second,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := retry.NewBackoff(tc.base, tc.max)
+			for i := 0; i < 100; i++ {
+				d := b.Delay(tc.attempt)
+				assert.True(t, d >= tc.wantMin && d <= tc.wantMax, "delay %s out of [%s, %s]", d, tc.wantMin, tc.wantMax)
+			}
+		})
+	}
+}
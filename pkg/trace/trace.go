@@ -0,0 +1,77 @@
+package trace
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers used to propagate the request scoped values to the outbound requests
+const (
+	HeaderRequestID = "X-Request-Id"
+	HeaderTraceID   = "X-Amzn-Trace-Id"
+)
+
+// lambdaTraceIDKey is the context key used by the Lambda runtime to store the X-Ray trace id
+const lambdaTraceIDKey = "x-amzn-trace-id"
+
+// contextKey represents a key of the request scoped values stored on the context
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	traceIDKey
+)
+
+// WithRequestID returns a copy of the context with the request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request id of the context, or an empty string when there isn't one
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithTraceID returns a copy of the context with the trace id
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey, id)
+}
+
+// TraceID returns the trace id of the context, or an empty string when there isn't one
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey).(string)
+	return id
+}
+
+// FromLambda returns a copy of the context with the request id and the trace id of the Lambda invocation
+func FromLambda(ctx context.Context) context.Context {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		ctx = WithRequestID(ctx, lc.AwsRequestID)
+	}
+
+	traceID, _ := ctx.Value(lambdaTraceIDKey).(string)
+	if traceID == "" {
+		traceID = os.Getenv("_X_AMZN_TRACE_ID")
+	}
+	if traceID != "" {
+		ctx = WithTraceID(ctx, traceID)
+	}
+
+	return ctx
+}
+
+// Fields returns the request scoped values of the context as log fields
+func Fields(ctx context.Context) log.Fields {
+	fields := log.Fields{}
+	if id := RequestID(ctx); id != "" {
+		fields["request_id"] = id
+	}
+	if id := TraceID(ctx); id != "" {
+		fields["trace_id"] = id
+	}
+	return fields
+}
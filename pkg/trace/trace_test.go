@@ -0,0 +1,65 @@
+package trace_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/trace"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", trace.RequestID(ctx))
+	assert.Equal(t, "request-1", trace.RequestID(trace.WithRequestID(ctx, "request-1")))
+}
+
+func TestTraceID(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", trace.TraceID(ctx))
+	assert.Equal(t, "trace-1", trace.TraceID(trace.WithTraceID(ctx, "trace-1")))
+}
+
+func TestFromLambda(t *testing.T) {
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		env           string
+		wantRequestID string
+		wantTraceID   string
+	}{
+		{
+			name: "without lambda context",
+			ctx:  context.Background(),
+		},
+		{
+			name:          "with lambda context and trace id",
+			ctx:           lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "request-1"}),
+			env:           "trace-1",
+			wantRequestID: "request-1",
+			wantTraceID:   "trace-1",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_ = os.Setenv("_X_AMZN_TRACE_ID", tc.env)
+			defer os.Unsetenv("_X_AMZN_TRACE_ID")
+
+			ctx := trace.FromLambda(tc.ctx)
+
+			assert.Equal(t, tc.wantRequestID, trace.RequestID(ctx))
+			assert.Equal(t, tc.wantTraceID, trace.TraceID(ctx))
+		})
+	}
+}
+
+func TestFields(t *testing.T) {
+	assert.Equal(t, log.Fields{}, trace.Fields(context.Background()))
+
+	ctx := trace.WithTraceID(trace.WithRequestID(context.Background(), "request-1"), "trace-1")
+	assert.Equal(t, log.Fields{"request_id": "request-1", "trace_id": "trace-1"}, trace.Fields(ctx))
+}
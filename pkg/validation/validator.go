@@ -0,0 +1,170 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+)
+
+// Validation messages
+const (
+	MessageRequired            = "is required"
+	MessageInvalid             = "is invalid"
+	MessageNegative            = "must not be negative"
+	MessageUnsupported         = "is not supported"
+	MessageCurrencyMismatch    = "must have the same currency of the order total"
+	MessageTotalMismatchFormat = "must be the sum of the items and the shipping amount (%s)"
+)
+
+// Formats
+var (
+	emailFormat   = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	countryFormat = regexp.MustCompile(`^[A-Z]{2}$`)
+	zipCodeFormat = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 -]{1,8}[A-Za-z0-9]$`)
+	// Zip code formats of specific countries
+	zipCodeFormats = map[string]*regexp.Regexp{
+		"BR": regexp.MustCompile(`^\d{5}-?\d{3}$`),
+		"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+	}
+)
+
+// Validator represents a validator of the messages before they are processed by a provider
+type Validator interface {
+	Validate(m message.Message) error
+}
+
+// OrderValidator validates the order of the message
+type OrderValidator struct {
+	paymentMethods map[string]bool
+}
+
+// NewOrderValidator creates a new order validator
+func NewOrderValidator(c *config.Config) *OrderValidator {
+	v := &OrderValidator{
+		paymentMethods: make(map[string]bool),
+	}
+	for _, pm := range c.SupportedPaymentMethods {
+		v.paymentMethods[pm] = true
+	}
+	return v
+}
+
+// Validate validates the message order, returning a validation error with all the invalid fields
+func (v *OrderValidator) Validate(m message.Message) error {
+	var errs []perrors.FieldError
+	add := func(field, msg string) {
+		errs = append(errs, perrors.FieldError{Field: field, Message: msg})
+	}
+
+	o := m.Order
+	if o.Id == "" {
+		add("order.id", MessageRequired)
+	}
+	if o.PaymentMethod == "" {
+		add("order.payment_method", MessageRequired)
+	} else if !v.paymentMethods[o.PaymentMethod] {
+		add("order.payment_method", MessageUnsupported)
+	}
+
+	// Amounts, the total is only checked when all of them are in the same currency
+	sameCurrency := v.validateMoney("order.total", o.Total, o.Total.Currency, add)
+	sameCurrency = v.validateMoney("order.shipping_amount", o.ShippingAmount, o.Total.Currency, add) && sameCurrency
+	if len(o.OrderItem) == 0 {
+		add("order.items", MessageRequired)
+	}
+	sum := message.NewMoney(0, o.Total.Currency)
+	for i, item := range o.OrderItem {
+		field := fmt.Sprintf("order.items[%d]", i)
+		if item.Id == "" {
+			add(field+".id", MessageRequired)
+		}
+		if item.Name == "" {
+			add(field+".name", MessageRequired)
+		}
+		sameCurrency = v.validateMoney(field+".unit_price", item.UnitPrice, o.Total.Currency, add) && sameCurrency
+		sum.Amount += item.UnitPrice.Amount
+	}
+	sum.Amount += o.ShippingAmount.Amount
+	if sameCurrency && len(o.OrderItem) > 0 && !sum.Equal(o.Total) {
+		add("order.total", fmt.Sprintf(MessageTotalMismatchFormat, sum))
+	}
+
+	// Customer
+	c := o.Customer
+	if c.Id == "" {
+		add("order.customer.id", MessageRequired)
+	}
+	if c.FirstName == "" {
+		add("order.customer.first_name", MessageRequired)
+	}
+	if c.LastName == "" {
+		add("order.customer.last_name", MessageRequired)
+	}
+	if c.Email == "" {
+		add("order.customer.email", MessageRequired)
+	} else if !emailFormat.MatchString(c.Email) {
+		add("order.customer.email", MessageInvalid)
+	}
+
+	// Addresses
+	v.validateAddress("order.billing_address", o.BillingAddress, add)
+	v.validateAddress("order.shipping_address", o.ShippingAddress, add)
+
+	if len(errs) > 0 {
+		return perrors.NewValidationError(errs)
+	}
+	return nil
+}
+
+// validateMoney validates an amount of the order, that must be positive and in the order currency
+// It returns whether the currency is valid and the same of the order
+func (v *OrderValidator) validateMoney(field string, m message.Money, currency string, add func(field, msg string)) bool {
+	if m.Amount < 0 {
+		add(field, MessageNegative)
+	}
+	if m.Currency == "" {
+		add(field+".currency", MessageRequired)
+		return false
+	}
+	if _, ok := message.CurrencyExponent(m.Currency); !ok {
+		add(field+".currency", MessageUnsupported)
+		return false
+	}
+	if m.Currency != currency {
+		add(field+".currency", MessageCurrencyMismatch)
+		return false
+	}
+	return true
+}
+
+// validateAddress validates the required fields and the formats of an address
+func (v *OrderValidator) validateAddress(field string, a message.Address, add func(field, msg string)) {
+	if a.Street == "" {
+		add(field+".street", MessageRequired)
+	}
+	if a.Number == "" {
+		add(field+".number", MessageRequired)
+	}
+	if a.City == "" {
+		add(field+".city", MessageRequired)
+	}
+
+	if a.Country == "" {
+		add(field+".country", MessageRequired)
+	} else if !countryFormat.MatchString(a.Country) {
+		add(field+".country", MessageInvalid)
+	}
+
+	format, ok := zipCodeFormats[a.Country]
+	if !ok {
+		format = zipCodeFormat
+	}
+	if a.ZipCode == "" {
+		add(field+".zip_code", MessageRequired)
+	} else if !format.MatchString(a.ZipCode) {
+		add(field+".zip_code", MessageInvalid)
+	}
+}
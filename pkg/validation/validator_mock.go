@@ -0,0 +1,17 @@
+package validation
+
+import (
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockValidator represents a mocked validator
+type MockValidator struct {
+	mock.Mock
+}
+
+// Validate mocks the message validation
+func (mv *MockValidator) Validate(m message.Message) error {
+	args := mv.Called(m)
+	return args.Error(0)
+}
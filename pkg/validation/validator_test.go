@@ -0,0 +1,168 @@
+package validation_test
+
+import (
+	"testing"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/config"
+	perrors "github.com/fredw/igti-aws-lambda-payments/pkg/errors"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/message"
+	"github.com/fredw/igti-aws-lambda-payments/pkg/validation"
+	"github.com/stretchr/testify/assert"
+)
+
+// validMessage returns a message that passes all the validations
+func validMessage() message.Message {
+	address := message.Address{
+		FirstName: "John",
+		LastName:  "Doe",
+		Street:    "Main Street",
+		Number:    "1",
+		ZipCode:   "90000-000",
+		City:      "Porto Alegre",
+		State:     "RS",
+		Country:   "BR",
+	}
+	return message.Message{
+		Provider: "Example",
+		Order: message.Order{
+			Id:             "order-1",
+			PaymentMethod:  "credit_card",
+			ShippingAmount: message.NewMoney(1000, "BRL"),
+			Total:          message.NewMoney(11050, "BRL"),
+			OrderItem: []message.OrderItem{
+				{Id: "item-1", Name: "Book", UnitPrice: message.NewMoney(6050, "BRL")},
+				{Id: "item-2", Name: "Pen", UnitPrice: message.NewMoney(4000, "BRL")},
+			},
+			Customer: message.Customer{
+				Id:        "customer-1",
+				FirstName: "John",
+				LastName:  "Doe",
+				Email:     "john@doe.com",
+			},
+			BillingAddress:  address,
+			ShippingAddress: address,
+		},
+	}
+}
+
+func TestOrderValidator_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		message func() message.Message
+		want    []perrors.FieldError
+	}{
+		{
+			name:    "valid message",
+			message: validMessage,
+		},
+		{
+			name: "missing required fields",
+			message: func() message.Message {
+				m := validMessage()
+				m.Order.Id = ""
+				m.Order.PaymentMethod = ""
+				m.Order.OrderItem[0].Name = ""
+				m.Order.Customer.Id = ""
+				m.Order.BillingAddress.Street = ""
+				return m
+			},
+			want: []perrors.FieldError{
+				{Field: "order.id", Message: validation.MessageRequired},
+				{Field: "order.payment_method", Message: validation.MessageRequired},
+				{Field: "order.items[0].name", Message: validation.MessageRequired},
+				{Field: "order.customer.id", Message: validation.MessageRequired},
+				{Field: "order.billing_address.street", Message: validation.MessageRequired},
+			},
+		},
+		{
+			name: "without items",
+			message: func() message.Message {
+				m := validMessage()
+				m.Order.OrderItem = nil
+				return m
+			},
+			want: []perrors.FieldError{
+				{Field: "order.items", Message: validation.MessageRequired},
+			},
+		},
+		{
+			name: "total different from the items and shipping amount",
+			message: func() message.Message {
+				m := validMessage()
+				m.Order.Total = message.NewMoney(11000, "BRL")
+				return m
+			},
+			want: []perrors.FieldError{
+				{Field: "order.total", Message: "must be the sum of the items and the shipping amount (110.50 BRL)"},
+			},
+		},
+		{
+			name: "invalid amounts",
+			message: func() message.Message {
+				m := validMessage()
+				m.Order.ShippingAmount = message.NewMoney(-1000, "BRL")
+				m.Order.OrderItem[0].UnitPrice = message.NewMoney(8050, "USD")
+				m.Order.OrderItem[1].UnitPrice = message.NewMoney(1000, "XXX")
+				return m
+			},
+			want: []perrors.FieldError{
+				{Field: "order.shipping_amount", Message: validation.MessageNegative},
+				{Field: "order.items[0].unit_price.currency", Message: validation.MessageCurrencyMismatch},
+				{Field: "order.items[1].unit_price.currency", Message: validation.MessageUnsupported},
+			},
+		},
+		{
+			name: "unsupported payment method",
+			message: func() message.Message {
+				m := validMessage()
+				m.Order.PaymentMethod = "cash"
+				return m
+			},
+			want: []perrors.FieldError{
+				{Field: "order.payment_method", Message: validation.MessageUnsupported},
+			},
+		},
+		{
+			name: "invalid formats",
+			message: func() message.Message {
+				m := validMessage()
+				m.Order.Customer.Email = "john.doe.com"
+				m.Order.BillingAddress.ZipCode = "9000"
+				m.Order.ShippingAddress.Country = "Brazil"
+				m.Order.ShippingAddress.ZipCode = "#"
+				return m
+			},
+			want: []perrors.FieldError{
+				{Field: "order.customer.email", Message: validation.MessageInvalid},
+				{Field: "order.billing_address.zip_code", Message: validation.MessageInvalid},
+				{Field: "order.shipping_address.country", Message: validation.MessageInvalid},
+				{Field: "order.shipping_address.zip_code", Message: validation.MessageInvalid},
+			},
+		},
+		{
+			name: "zip code of another country",
+			message: func() message.Message {
+				m := validMessage()
+				m.Order.ShippingAddress.Country = "US"
+				m.Order.ShippingAddress.ZipCode = "94105-1234"
+				return m
+			},
+		},
+	}
+
+	v := validation.NewOrderValidator(&config.Config{
+		SupportedPaymentMethods: []string{"credit_card", "boleto"},
+	})
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := v.Validate(tc.message())
+
+			if tc.want == nil {
+				assert.Nil(t, err)
+				return
+			}
+			assert.Equal(t, perrors.NewValidationError(tc.want), err)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package worker
+
+import "sync"
+
+// Pool runs tasks concurrently, bounded by a global number of workers and by an optional limit per key
+// (e.g. the number of requests in flight to the same provider)
+type Pool struct {
+	size   int
+	limits map[string]int
+
+	mu      sync.Mutex
+	workers chan struct{}
+	keys    map[string]*keyQueue
+}
+
+// keyQueue has the tasks of a key with limit, the ones running and the ones waiting for a slot of the key
+type keyQueue struct {
+	running int
+	pending []func()
+}
+
+// NewPool creates a new pool with size workers, a size lower than one runs the tasks one by one
+func NewPool(size int, limits map[string]int) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	p := &Pool{
+		size:    size,
+		limits:  limits,
+		workers: make(chan struct{}, size),
+		keys:    make(map[string]*keyQueue),
+	}
+	return p
+}
+
+// Size returns the global number of workers
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// Run runs the task for each index from 0 to n-1 and returns when all of them are done
+// The key of each index selects the limit applied to the task, tasks of a key without limit only use the global one
+// A task whose key is at its limit waits in the queue of the key, without holding a worker or delaying the tasks of
+// the other keys, and runs when a task of the same key finishes
+// Tasks start in the index order, so a pool with a single worker runs them sequentially
+func (p *Pool) Run(n int, key func(i int) string, task func(i int)) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		i := i
+		run := func() {
+			defer wg.Done()
+			task(i)
+		}
+
+		k := key(i)
+		if !p.acquire(k, run) {
+			continue
+		}
+		p.workers <- struct{}{}
+		go func() {
+			defer func() { <-p.workers }()
+			// The worker keeps the slot of the key while there are tasks of the key waiting for it
+			for run != nil {
+				run()
+				run = p.next(k)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// acquire takes a slot of the key and returns true when the task can run, otherwise the task is queued
+func (p *Pool) acquire(key string, run func()) bool {
+	limit, ok := p.limits[key]
+	if !ok || limit < 1 {
+		return true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	q, ok := p.keys[key]
+	if !ok {
+		q = &keyQueue{}
+		p.keys[key] = q
+	}
+	if q.running >= limit {
+		q.pending = append(q.pending, run)
+		return false
+	}
+	q.running++
+	return true
+}
+
+// next returns the next task waiting for a slot of the key or releases the slot and returns nil
+func (p *Pool) next(key string) func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	q, ok := p.keys[key]
+	if !ok {
+		return nil
+	}
+	if len(q.pending) == 0 {
+		q.running--
+		return nil
+	}
+	run := q.pending[0]
+	q.pending = q.pending[1:]
+	return run
+}
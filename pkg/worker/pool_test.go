@@ -0,0 +1,129 @@
+package worker_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fredw/igti-aws-lambda-payments/pkg/worker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPool(t *testing.T) {
+	assert.Equal(t, 1, worker.NewPool(0, nil).Size())
+	assert.Equal(t, 5, worker.NewPool(5, nil).Size())
+}
+
+func TestPool_Run(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int
+		limits       map[string]int
+		keys         []string
+		wantMax      int
+		wantMaxByKey map[string]int
+	}{
+		{
+			name:         "single worker runs one task at a time",
+			size:         1,
+			keys:         []string{"a", "b", "a", "b"},
+			wantMax:      1,
+			wantMaxByKey: map[string]int{"a": 1, "b": 1},
+		},
+		{
+			name:         "global limit",
+			size:         2,
+			keys:         []string{"a", "b", "c", "d", "e", "f"},
+			wantMax:      2,
+			wantMaxByKey: map[string]int{"a": 1, "b": 1, "c": 1, "d": 1, "e": 1, "f": 1},
+		},
+		{
+			name:         "limit per key",
+			size:         10,
+			limits:       map[string]int{"a": 1},
+			keys:         []string{"a", "a", "a", "b", "b"},
+			wantMaxByKey: map[string]int{"a": 1, "b": 2},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			running, max := 0, 0
+			runningByKey, maxByKey := map[string]int{}, map[string]int{}
+
+			p := worker.NewPool(tc.size, tc.limits)
+			p.Run(
+				len(tc.keys),
+				func(i int) string { return tc.keys[i] },
+				func(i int) {
+					k := tc.keys[i]
+					mu.Lock()
+					running++
+					runningByKey[k]++
+					if running > max {
+						max = running
+					}
+					if runningByKey[k] > maxByKey[k] {
+						maxByKey[k] = runningByKey[k]
+					}
+					mu.Unlock()
+
+					time.Sleep(10 * time.Millisecond)
+
+					mu.Lock()
+					running--
+					runningByKey[k]--
+					mu.Unlock()
+				},
+			)
+
+			if tc.wantMax > 0 {
+				assert.Equal(t, tc.wantMax, max)
+			}
+			assert.Equal(t, tc.wantMaxByKey, maxByKey)
+		})
+	}
+}
+
+func TestPool_RunOrder(t *testing.T) {
+	var order []int
+	p := worker.NewPool(1, nil)
+	p.Run(5, func(i int) string { return "" }, func(i int) { order = append(order, i) })
+
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, order)
+}
+
+func TestPool_RunKeyLimitDoesNotDelayOtherKeys(t *testing.T) {
+	keys := []string{"A", "A", "A", "B"}
+	started := make(chan struct{})
+	waited := make([]bool, len(keys))
+
+	p := worker.NewPool(10, map[string]int{"A": 1})
+	p.Run(
+		len(keys),
+		func(i int) string { return keys[i] },
+		func(i int) {
+			if keys[i] == "B" {
+				close(started)
+				return
+			}
+			// The tasks of A wait for B, which must start while the first task of A still runs
+			select {
+			case <-started:
+				waited[i] = true
+			case <-time.After(time.Second):
+			}
+		},
+	)
+
+	assert.Equal(t, []bool{true, true, true, false}, waited)
+}
+
+func TestPool_RunKeyOrder(t *testing.T) {
+	var order []int
+	p := worker.NewPool(5, map[string]int{"a": 1})
+	p.Run(5, func(i int) string { return "a" }, func(i int) { order = append(order, i) })
+
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, order)
+}